@@ -15,6 +15,17 @@ go test "$REPO/plugins/..."
 
 status=$?
 
+# the tests of the repository manager fake cvmfs_server and the registry,
+# they need neither root nor network
+SRC="repository-manager"
+DST="$GOPATH/src/$REPO/repository-manager"
+
+mkdir -p "$DST" > /dev/null
+cp -r "$SRC"/* "$DST"
+
+go get  "$REPO/repository-manager/..."
+go test "$REPO/repository-manager/..." || status=$?
+
 if [ "$status" == "0" ]; then
     echo "Unit tests passed"
     exit 0
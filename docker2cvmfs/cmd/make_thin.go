@@ -5,11 +5,11 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"fmt"
 	"github.com/cvmfs/docker-graphdriver/docker2cvmfs/lib"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
 	"github.com/spf13/cobra"
+	"io"
 	"log"
 	"strings"
 )
@@ -38,32 +38,11 @@ var MakeThin = &cobra.Command{
 		if err != nil {
 			log.Println("Unable to get the configuration for the image")
 		} else {
-			// setting the option for the docker image
-			var config map[string]interface{}
-			json.Unmarshal([]byte(configString), &config)
-			configConfigInterface, ok := config["config"]
-			if ok {
-				configConfig := configConfigInterface.(map[string]interface{})
-				envInterface, okEnv := configConfig["Env"]
-				if okEnv {
-					env := envInterface.([]interface{})
-					for e := range env {
-						envStr := interface{}(env[e]).(string)
-						changes = append(changes,
-							fmt.Sprintf("ENV %s", envStr))
-					}
-				}
-				cmdInterface, okCmd := configConfig["Cmd"]
-
-				if okCmd {
-					cmd := cmdInterface.([]interface{})
-					for c := range cmd {
-						cmdStr := interface{}(cmd[c].(string))
-						changes = append(changes,
-							fmt.Sprintf("CMD %s", cmdStr))
-					}
-				}
+			configChanges, err := lib.ConfigChanges(configString)
+			if err != nil {
+				log.Println("Unable to parse the configuration for the image: ", err)
 			}
+			changes = append(changes, configChanges...)
 		}
 
 		origin := inputReference + "@" + registry
@@ -96,17 +75,29 @@ var MakeThin = &cobra.Command{
 		if err != nil {
 			log.Fatal("Impossible to get a docker client using your env variables: ", err)
 		}
-		image := types.ImageImportSource{
-			Source:     bytes.NewBuffer(imageTarFileStorange.Bytes()),
-			SourceName: "-",
-		}
+		var importResult io.ReadCloser
+		for {
+			image := types.ImageImportSource{
+				Source:     bytes.NewBuffer(imageTarFileStorange.Bytes()),
+				SourceName: "-",
+			}
 
-		options := types.ImageImportOptions{
-			Tag:     "",
-			Message: "",
-			Changes: changes,
+			options := types.ImageImportOptions{
+				Tag:     "",
+				Message: "",
+				Changes: changes,
+			}
+			importResult, err = dockerClient.ImageImport(context.Background(), image, outputReference, options)
+			if err == nil {
+				break
+			}
+			accepted, refused := lib.WithoutRefusedChanges(changes, err)
+			if len(refused) == 0 {
+				break
+			}
+			log.Println("The docker daemon does not accept these changes, importing without them: ", refused)
+			changes = accepted
 		}
-		importResult, err := dockerClient.ImageImport(context.Background(), image, outputReference, options)
 		if err != nil {
 			log.Fatal("Error in importing the images: ", err)
 		} else {
@@ -0,0 +1,150 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// ConfigChanges translates the configuration of an image in the Dockerfile
+// instructions to pass to the docker import, so that the thin image keeps the
+// configuration of the original image.
+func ConfigChanges(configString string) ([]string, error) {
+	var config struct {
+		Config *container.Config `json:"config"`
+	}
+	if err := json.Unmarshal([]byte(configString), &config); err != nil {
+		return nil, err
+	}
+	c := config.Config
+	var changes []string
+	if c == nil {
+		return changes, nil
+	}
+	for _, e := range c.Env {
+		keyValue := strings.SplitN(e, "=", 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("ENV %s=%s", keyValue[0], quoteChange(keyValue[1])))
+	}
+	if c.Entrypoint != nil {
+		changes = append(changes, "ENTRYPOINT "+jsonChange(c.Entrypoint))
+	}
+	if c.Cmd != nil {
+		changes = append(changes, "CMD "+jsonChange(c.Cmd))
+	}
+	if c.WorkingDir != "" {
+		changes = append(changes, "WORKDIR "+escapeVariables(c.WorkingDir))
+	}
+	if c.User != "" {
+		changes = append(changes, "USER "+escapeVariables(c.User))
+	}
+	if len(c.ExposedPorts) > 0 {
+		var ports []string
+		for port := range c.ExposedPorts {
+			ports = append(ports, string(port))
+		}
+		sort.Strings(ports)
+		changes = append(changes, "EXPOSE "+strings.Join(ports, " "))
+	}
+	if len(c.Volumes) > 0 {
+		var volumes []string
+		for volume := range c.Volumes {
+			volumes = append(volumes, volume)
+		}
+		sort.Strings(volumes)
+		changes = append(changes, "VOLUME "+jsonChange(volumes))
+	}
+	var labels []string
+	for key := range c.Labels {
+		labels = append(labels, key)
+	}
+	sort.Strings(labels)
+	for _, key := range labels {
+		changes = append(changes, fmt.Sprintf("LABEL %s=%s", quoteChange(key), quoteChange(c.Labels[key])))
+	}
+	if c.StopSignal != "" {
+		changes = append(changes, "STOPSIGNAL "+c.StopSignal)
+	}
+	if change := healthcheckChange(c.Healthcheck); change != "" {
+		changes = append(changes, change)
+	}
+	if len(c.Shell) > 0 {
+		changes = append(changes, "SHELL "+jsonChange(c.Shell))
+	}
+	return changes, nil
+}
+
+func healthcheckChange(health *container.HealthConfig) string {
+	if health == nil || len(health.Test) == 0 {
+		return ""
+	}
+	if health.Test[0] == "NONE" {
+		return "HEALTHCHECK NONE"
+	}
+	options := []string{"HEALTHCHECK"}
+	for _, option := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"interval", health.Interval},
+		{"timeout", health.Timeout},
+		{"start-period", health.StartPeriod},
+	} {
+		if option.value > 0 {
+			options = append(options, fmt.Sprintf("--%s=%s", option.name, option.value))
+		}
+	}
+	if health.Retries > 0 {
+		options = append(options, fmt.Sprintf("--retries=%d", health.Retries))
+	}
+	switch health.Test[0] {
+	case "CMD":
+		return strings.Join(options, " ") + " CMD " + jsonChange(health.Test[1:])
+	case "CMD-SHELL":
+		return strings.Join(options, " ") + " CMD " + strings.Join(health.Test[1:], " ")
+	}
+	return ""
+}
+
+func jsonChange(list []string) string {
+	if list == nil {
+		list = []string{}
+	}
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(list)
+	return strings.TrimSpace(buffer.String())
+}
+
+func quoteChange(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return `"` + escapeVariables(value) + `"`
+}
+
+func escapeVariables(value string) string {
+	return strings.Replace(value, "$", `\$`, -1)
+}
+
+// WithoutRefusedChanges splits the changes in the ones accepted and the ones
+// refused by the docker daemon in err, older daemons do not accept STOPSIGNAL
+// and SHELL in an import.
+func WithoutRefusedChanges(changes []string, err error) (accepted []string, refused []string) {
+	for _, change := range changes {
+		instruction := strings.ToLower(strings.SplitN(change, " ", 2)[0])
+		if strings.Contains(err.Error(), instruction+" is not a valid change command") {
+			refused = append(refused, change)
+			continue
+		}
+		accepted = append(accepted, change)
+	}
+	return
+}
@@ -0,0 +1,75 @@
+package lib
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestConfigChanges(t *testing.T) {
+	config := `{"config":{
+		"Env":["PATH=/usr/bin:/bin","GREETING=say \"hi\" to $USER"],
+		"Entrypoint":["/entrypoint.sh"],
+		"Cmd":["nginx","-g","daemon off;"],
+		"WorkingDir":"/srv/www",
+		"User":"nginx:nginx",
+		"ExposedPorts":{"443/tcp":{},"80/tcp":{}},
+		"Volumes":{"/var/log":{},"/data":{}},
+		"Labels":{"maintainer":"ops <ops@example.ch>","version":"1.0"},
+		"StopSignal":"SIGQUIT",
+		"Healthcheck":{"Test":["CMD-SHELL","curl -f http://localhost/ || exit 1"],
+			"Interval":30000000000,"Timeout":5000000000,"Retries":3},
+		"Shell":["/bin/bash","-c"]}}`
+	expected := []string{
+		`ENV PATH="/usr/bin:/bin"`,
+		`ENV GREETING="say \"hi\" to \$USER"`,
+		`ENTRYPOINT ["/entrypoint.sh"]`,
+		`CMD ["nginx","-g","daemon off;"]`,
+		`WORKDIR /srv/www`,
+		`USER nginx:nginx`,
+		`EXPOSE 443/tcp 80/tcp`,
+		`VOLUME ["/data","/var/log"]`,
+		`LABEL "maintainer"="ops <ops@example.ch>"`,
+		`LABEL "version"="1.0"`,
+		`STOPSIGNAL SIGQUIT`,
+		`HEALTHCHECK --interval=30s --timeout=5s --retries=3 CMD curl -f http://localhost/ || exit 1`,
+		`SHELL ["/bin/bash","-c"]`,
+	}
+	changes, err := ConfigChanges(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Wrong changes:\n%q\nexpected:\n%q", changes, expected)
+	}
+
+	// an empty command overrides the one of the base image, it must be kept
+	changes, err = ConfigChanges(`{"config":{"Entrypoint":["/bin/app"],"Cmd":[],
+		"Healthcheck":{"Test":["NONE"]}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{`ENTRYPOINT ["/bin/app"]`, `CMD []`, `HEALTHCHECK NONE`}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Wrong changes: %q", changes)
+	}
+	if changes, err := ConfigChanges(`{}`); err != nil || len(changes) != 0 {
+		t.Errorf("Expected no changes without configuration: %q %v", changes, err)
+	}
+	if _, err := ConfigChanges(`not json`); err == nil {
+		t.Errorf("Expected an error for an invalid configuration")
+	}
+}
+
+func TestWithoutRefusedChanges(t *testing.T) {
+	changes := []string{`ENV A="1"`, "STOPSIGNAL SIGQUIT", `CMD ["sh"]`}
+	err := errors.New("Error response from daemon: stopsignal is not a valid change command")
+	accepted, refused := WithoutRefusedChanges(changes, err)
+	if !reflect.DeepEqual(accepted, []string{`ENV A="1"`, `CMD ["sh"]`}) ||
+		!reflect.DeepEqual(refused, []string{"STOPSIGNAL SIGQUIT"}) {
+		t.Errorf("Wrong refused changes: %q %q", accepted, refused)
+	}
+	if _, refused := WithoutRefusedChanges(changes, errors.New("connection refused")); len(refused) != 0 {
+		t.Errorf("Changes refused for an unrelated error: %q", refused)
+	}
+}
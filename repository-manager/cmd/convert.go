@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"context"
+	"encoding/json"
 	"io/ioutil"
 	"os"
 
@@ -12,12 +14,19 @@ import (
 
 var (
 	convertAgain, overwriteLayer, convertSingularity bool
+	retireImages, deleteThinImages                   bool
+	jobs                                             int
+	reportFormat                                     string
 )
 
 func init() {
 	convertCmd.Flags().BoolVarP(&overwriteLayer, "overwrite-layers", "f", false, "overwrite the layer if they are already inside the CVMFS repository")
 	convertCmd.Flags().BoolVarP(&convertAgain, "convert-again", "g", false, "convert again images that are already successfull converted")
 	convertCmd.Flags().BoolVarP(&convertSingularity, "convert-singularity", "s", true, "also create a singularity images")
+	convertCmd.Flags().IntVarP(&jobs, "jobs", "j", 1, "how many wishes to convert concurrently, the CVMFS transactions are still serialized")
+	convertCmd.Flags().BoolVar(&retireImages, "retire-images", false, "retire the images converted in the repositories of the recipe that are not in the recipe anymore")
+	convertCmd.Flags().BoolVar(&deleteThinImages, "delete-thin-images", false, "with --retire-images, delete also the thin images of the images retired from the registry")
+	convertCmd.Flags().StringVar(&reportFormat, "report", "", "write the report of the conversions on the standard output, in the given format: json")
 	rootCmd.AddCommand(convertCmd)
 }
 
@@ -26,27 +35,58 @@ var convertCmd = &cobra.Command{
 	Short: "Convert the wishes",
 	Run: func(cmd *cobra.Command, args []string) {
 		AliveMessage()
-		defer lib.ExecCommand("docker", "system", "prune", "--force", "--all")
+		if reportFormat != "" && reportFormat != "json" {
+			lib.Log().WithFields(log.Fields{"format": reportFormat}).Fatal("Unknown format of the report")
+		}
 
 		data, err := ioutil.ReadFile(args[0])
 		if err != nil {
 			lib.LogE(err).Fatal("Impossible to read the recipe file")
 			os.Exit(1)
 		}
-		recipe, err := lib.ParseYamlRecipeV1(data)
+		recipe, err := lib.ParseYamlRecipe(data)
 		if err != nil {
 			lib.LogE(err).Fatal("Impossible to parse the recipe file")
 			os.Exit(1)
 		}
-		for _, wish := range recipe.Wishes {
-			fields := log.Fields{"input image": wish.InputName,
-				"repository":   wish.CvmfsRepo,
-				"output image": wish.OutputName}
-			lib.Log().WithFields(fields).Info("Start conversion of wish")
-			err = lib.ConvertWish(wish, convertAgain, overwriteLayer, convertSingularity)
-			if err != nil {
-				lib.LogE(err).WithFields(fields).Error("Error in converting wish, going on")
+		recipe.SetRepositoryRoots()
+		reports, stopped := lib.ConvertWishes(ShutdownContext(), recipe.Wishes, jobs, convertSingleWish)
+		if !stopped {
+			retireRemovedImages(recipe)
+		}
+		if reportFormat == "json" {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(reports); err != nil {
+				lib.LogE(err).Fatal("Impossible to write the report")
 			}
 		}
 	},
 }
+
+// retire the images not in the recipe anymore, if requested
+func retireRemovedImages(recipe lib.Recipe) {
+	if !retireImages {
+		return
+	}
+	retired, err := lib.RetireImages(recipe, deleteThinImages)
+	if err != nil {
+		lib.LogE(err).Error("Error in retiring the images not in the recipe anymore, going on")
+	}
+	lib.Log().WithFields(log.Fields{"retired": len(retired)}).Info("Retired the images not in the recipe anymore")
+}
+
+func convertSingleWish(ctx context.Context, wish lib.WishFriendly) lib.ConversionReport {
+	fields := log.Fields{"input image": wish.InputName,
+		"repository":   wish.CvmfsRepo,
+		"platform":     wish.Platform,
+		"output image": wish.OutputName}
+	lib.Log().WithFields(fields).Info("Start conversion of wish")
+	report, err := lib.ConvertWish(ctx, wish, convertAgain, overwriteLayer, convertSingularity)
+	if err != nil {
+		lib.LogE(err).WithFields(fields).Error("Error in converting wish, going on")
+	} else {
+		lib.Log().WithFields(fields).WithFields(log.Fields{"outcome": report.Outcome}).Info("Wish converted")
+	}
+	return report
+}
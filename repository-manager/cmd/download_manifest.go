@@ -12,11 +12,12 @@ import (
 )
 
 var (
-	username string
+	username, platform string
 )
 
 func init() {
 	downloadManifestCmd.Flags().StringVarP(&username, "username", "u", "", "username to use to log in into the registry.")
+	downloadManifestCmd.Flags().StringVarP(&platform, "platform", "p", "", "platform to select if the image is a manifest list, in the form os/architecture[/variant].")
 	rootCmd.AddCommand(downloadManifestCmd)
 }
 
@@ -37,6 +38,7 @@ var downloadManifestCmd = &cobra.Command{
 		if username != "" {
 			img.User = username
 		}
+		img.Platform = platform
 
 		manifest, err := img.GetManifest()
 		if err != nil {
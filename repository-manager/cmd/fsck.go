@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/cvmfs/docker-graphdriver/repository-manager/lib"
+)
+
+var fsckOptions lib.FsckOptions
+
+func init() {
+	fsckCmd.Flags().BoolVar(&fsckOptions.Repair, "repair", false, "repair what can be repaired, the images with broken layers are converted again at the next conversion")
+	fsckCmd.Flags().BoolVar(&fsckOptions.VerifyContent, "verify-content", false, "hash again the content of the layers and compare it with the files ingested")
+	fsckCmd.Flags().StringVar(&reportFormat, "report", "", "write the report of the check on the standard output, in the given format: json")
+	rootCmd.AddCommand(fsckCmd)
+}
+
+var fsckCmd = &cobra.Command{
+	Use:     "fsck",
+	Short:   "Check that the repository is coherent and optionally repair it",
+	Aliases: []string{"verify"},
+	Args:    cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if reportFormat != "" && reportFormat != "json" {
+			lib.Log().WithFields(log.Fields{"format": reportFormat}).Fatal("Unknown format of the report")
+			os.Exit(1)
+		}
+		report, err := lib.Fsck(args[0], fsckOptions)
+		if err != nil {
+			lib.LogE(err).Fatal("Error in checking the repository")
+			os.Exit(1)
+		}
+		if reportFormat == "json" {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(report); err != nil {
+				lib.LogE(err).Fatal("Impossible to write the report")
+				os.Exit(1)
+			}
+		} else {
+			for _, problem := range report.Problems {
+				status := "not repaired"
+				if problem.Repaired {
+					status = "repaired"
+				}
+				fmt.Printf("%s %s (%s) %s\n", problem.Kind, problem.Path, status, problem.Detail)
+			}
+			fmt.Printf("%d images and %d layers checked, %d problems\n",
+				report.Images, report.Layers, len(report.Problems))
+		}
+		if report.Unrepaired() {
+			os.Exit(1)
+		}
+	},
+}
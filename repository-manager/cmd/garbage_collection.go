@@ -1,60 +1,51 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"strings"
+	"time"
 
-	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
 	"github.com/cvmfs/docker-graphdriver/repository-manager/lib"
 )
 
+var (
+	gracePeriod time.Duration
+	dryRun      bool
+)
+
 func init() {
+	garbageCollectionCmd.Flags().DurationVar(&gracePeriod, "grace-period", 24*time.Hour, "keep what was written less than GRACE-PERIOD ago, it may belong to a conversion in progress")
+	garbageCollectionCmd.Flags().BoolVar(&dryRun, "dry-run", false, "only print what would be removed and the space reclaimed")
 	rootCmd.AddCommand(garbageCollectionCmd)
 }
 
 var garbageCollectionCmd = &cobra.Command{
 	Use:     "garbage-collection",
-	Short:   "Removes layers that are not necessary anymore",
+	Short:   "Removes layers and singularity images not used by any image",
 	Aliases: []string{"gc"},
 	Args:    cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-
-		fmt.Println("Start")
-		repo := args[0]
-		llog := func(l *log.Entry) *log.Entry {
-			return l.WithFields(log.Fields{"action": "garbage collect",
-				"repo": repo,
-			})
-		}
-
-		manifestToRemove, err := lib.FindImageToGarbageCollect(repo)
+		result, err := lib.GarbageCollect(context.Background(), args[0], lib.GarbageCollectionOptions{
+			GracePeriod: gracePeriod,
+			DryRun:      dryRun})
 		if err != nil {
-			llog(lib.LogE(err)).Warning(
-				"Error in finding the image to remove from the scheduler, goin on...")
+			lib.LogE(err).Fatal("Error in the garbage collection")
+			os.Exit(1)
 		}
-		images2layers := make(map[string][]string)
-
-		for _, manifest := range manifestToRemove {
-			digest := strings.Split(manifest.Config.Digest, ":")[1]
-			for _, layerStruct := range manifest.Layers {
-				layerName := strings.Split(layerStruct.Digest, ":")[1]
-				images2layers[digest] = append(images2layers[digest], layerName)
-			}
+		action := "Removed"
+		if dryRun {
+			action = "Would remove"
 		}
-
-		for image, layers := range images2layers {
-			for _, layer := range layers {
-				err = lib.GarbageCollectSingleLayer(repo, image, layer)
-				if err != nil {
-					llog(lib.LogE(err)).Warning(
-						"Error in removing a single layer from the repository, going on...")
-				}
-			}
+		for _, garbage := range result.Removed {
+			fmt.Printf("%s %s (%d bytes)\n", action, garbage.Path, garbage.Size)
 		}
-
-		os.Exit(0)
+		for _, symlink := range result.Symlinks {
+			fmt.Printf("%s %s\n", action, symlink)
+		}
+		fmt.Printf("%s %d directories, %d bytes reclaimed, %d kept in the grace period\n",
+			action, len(result.Removed), result.Reclaimed, result.Kept)
 	},
 }
@@ -1,16 +1,68 @@
 package cmd
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
 	"github.com/cvmfs/docker-graphdriver/repository-manager/lib"
 )
 
+var (
+	publisher    lib.PublisherConfig
+	cvmfsRoot    string
+	dockerConfig string
+	blobCache    string
+	blobCacheMax string
+	mirrors      []string
+)
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&cvmfsRoot, "cvmfs-root", "/cvmfs", "where the repositories are mounted, the repository $REPO is in CVMFS-ROOT/$REPO")
+	rootCmd.PersistentFlags().StringVar(&publisher.Type, "publisher", lib.PublisherCvmfsServer, "how to publish into the repositories: cvmfs_server, gateway or directory")
+	rootCmd.PersistentFlags().StringVar(&publisher.LeasePath, "lease-path", "", "gateway publisher only, the subpath of the repository to ask the lease for")
+	rootCmd.PersistentFlags().IntVar(&publisher.LeaseRetries, "lease-retries", 5, "gateway publisher only, how many times to try to acquire a busy lease")
+	rootCmd.PersistentFlags().StringVar(&publisher.Directory, "publisher-directory", "", "directory publisher only, the repositories are written and read in DIRECTORY/$REPO, instead of CVMFS-ROOT/$REPO")
+	rootCmd.PersistentFlags().StringVar(&blobCache, "blob-cache", "", "directory where the downloaded layers are cached, by default in the cache directory of the user")
+	rootCmd.PersistentFlags().StringVar(&blobCacheMax, "blob-cache-max-size", "20G", "maximum size of the blob cache, ex: 500M or 20G, 0 for no limit")
+	rootCmd.PersistentFlags().StringArrayVar(&mirrors, "registry-mirror", []string{}, "mirrors of a registry, tried in order before it, as REGISTRY=MIRROR[,MIRROR...], can be repeated for several registries")
+	rootCmd.PersistentFlags().StringVar(&dockerConfig, "docker-config", "", "the docker configuration file with the credentials of the registries, by default $DOCKER_CONFIG/config.json or ~/.docker/config.json")
+}
+
 var rootCmd = &cobra.Command{
 	Use:   "repository-manager",
 	Short: "Show the several commands available.",
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		lib.SetCVMFSMountRoot(cvmfsRoot)
+		lib.SetDockerConfigPath(dockerConfig)
+		lib.SetBlobCacheDirectory(blobCache)
+		maxSize, err := lib.ParseSize(blobCacheMax)
+		if err != nil {
+			lib.LogE(err).Fatal("Wrong maximum size of the blob cache")
+			os.Exit(1)
+		}
+		lib.SetBlobCacheMaxSize(maxSize)
+		for _, spec := range mirrors {
+			upstream, registryMirrors, err := lib.ParseRegistryMirrors(spec)
+			if err == nil {
+				err = lib.SetRegistryMirrors(upstream, registryMirrors)
+			}
+			if err != nil {
+				lib.LogE(err).Fatal("Wrong registry mirror")
+				os.Exit(1)
+			}
+		}
+		err = lib.SetPublisher(publisher)
+		if err != nil {
+			lib.LogE(err).Fatal("Wrong publisher configuration")
+			os.Exit(1)
+		}
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		cmd.Help()
 	},
@@ -28,3 +80,26 @@ func AliveMessage() {
 		}
 	}()
 }
+
+// ShutdownContext returns a context canceled by the first SIGINT or SIGTERM:
+// no other wish is started, the running conversions finish the operation in
+// progress, publish if they were already publishing, and abort their
+// transactions. The second signal aborts the open transactions and exits
+// immediately.
+func ShutdownContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		received := <-signals
+		lib.Log().WithFields(log.Fields{"signal": received}).Info(
+			"Received signal, finishing the running conversions, send it again to exit immediately")
+		cancel()
+		received = <-signals
+		lib.Log().WithFields(log.Fields{"signal": received}).Warning(
+			"Received signal again, aborting the open transactions and exiting")
+		lib.AbortOpenTransactions()
+		os.Exit(1)
+	}()
+	return ctx
+}
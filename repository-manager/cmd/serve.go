@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/cvmfs/docker-graphdriver/repository-manager/lib"
+)
+
+var (
+	listenAddress  string
+	stateDirectory string
+)
+
+func init() {
+	serveCmd.Flags().BoolVarP(&overwriteLayer, "overwrite-layers", "f", false, "overwrite the layer if they are already inside the CVMFS repository")
+	serveCmd.Flags().BoolVarP(&convertSingularity, "convert-singularity", "s", true, "also create a singularity images")
+	serveCmd.Flags().DurationVar(&gracePeriod, "grace-period", 24*time.Hour, "the garbage collections keep what was written less than GRACE-PERIOD ago")
+	serveCmd.Flags().StringVar(&listenAddress, "listen", "127.0.0.1:8080", "address where to serve the HTTP API")
+	serveCmd.Flags().StringVar(&stateDirectory, "state-directory", "/var/lib/repository-manager", "where to keep the wishes, the queue of the jobs and their logs")
+	rootCmd.AddCommand(serveCmd)
+}
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Convert the wishes submitted through an HTTP API",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		AliveMessage()
+		queue, err := lib.OpenJobQueue(stateDirectory)
+		if err != nil {
+			lib.LogE(err).Fatal("Impossible to open the queue of the jobs")
+			os.Exit(1)
+		}
+		server := lib.NewServer(queue, lib.ServerOptions{
+			ForceDownload:      overwriteLayer,
+			ConvertSingularity: convertSingularity,
+			GracePeriod:        gracePeriod})
+
+		ctx := ShutdownContext()
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.Run(ctx)
+		}()
+
+		httpServer := &http.Server{Addr: listenAddress, Handler: server.Handler()}
+		go func() {
+			<-ctx.Done()
+			shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			httpServer.Shutdown(shutdown)
+		}()
+		lib.Log().WithFields(log.Fields{"address": listenAddress}).Info("Serving the HTTP API")
+		err = httpServer.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			lib.LogE(err).Fatal("Error in serving the HTTP API")
+			os.Exit(1)
+		}
+		wg.Wait()
+		lib.Log().Info("All the jobs stopped, quitting")
+	},
+}
@@ -15,6 +15,7 @@ type Layer struct {
 	MediaType string
 	Size      int
 	Digest    string
+	URLs      []string `json:",omitempty"`
 }
 
 type Manifest struct {
@@ -24,6 +25,155 @@ type Manifest struct {
 	Layers        []Layer
 }
 
+const (
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+)
+
+const (
+	MediaTypeDockerLayer        = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	MediaTypeDockerForeignLayer = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+
+	MediaTypeOCILayer     = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeOCILayerGzip = "application/vnd.oci.image.layer.v1.tar+gzip"
+	MediaTypeOCILayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+	MediaTypeOCINonDistributableLayer     = "application/vnd.oci.image.layer.nondistributable.v1.tar"
+	MediaTypeOCINonDistributableLayerGzip = "application/vnd.oci.image.layer.nondistributable.v1.tar+gzip"
+	MediaTypeOCINonDistributableLayerZstd = "application/vnd.oci.image.layer.nondistributable.v1.tar+zstd"
+)
+
+// the media types we are able to handle when asking for a manifest, the
+// registry will pick the first one it is able to serve
+var ManifestMediaTypes = []string{
+	MediaTypeDockerManifest,
+	MediaTypeOCIManifest,
+	MediaTypeDockerManifestList,
+	MediaTypeOCIIndex,
+}
+
+// a manifest, as opposed to a manifest list, describes a single image
+func IsManifest(mediaType string) bool {
+	return mediaType == MediaTypeDockerManifest || mediaType == MediaTypeOCIManifest
+}
+
+// a manifest list (docker) or an image index (OCI) point to several
+// manifests, one for each platform the image is built for
+func IsManifestList(mediaType string) bool {
+	return mediaType == MediaTypeDockerManifestList || mediaType == MediaTypeOCIIndex
+}
+
+type Compression int
+
+const (
+	Uncompressed Compression = iota
+	Gzip
+	Zstd
+)
+
+func (c Compression) String() string {
+	switch c {
+	case Uncompressed:
+		return "uncompressed"
+	case Gzip:
+		return "gzip"
+	case Zstd:
+		return "zstd"
+	}
+	return "unknown"
+}
+
+// how the layer blob is compressed, an empty media type is what we get from
+// old manifests and it was always gzip
+func GetLayerCompression(mediaType string) (Compression, error) {
+	switch mediaType {
+	case "", MediaTypeDockerLayer, MediaTypeDockerForeignLayer,
+		MediaTypeOCILayerGzip, MediaTypeOCINonDistributableLayerGzip:
+		return Gzip, nil
+	case MediaTypeOCILayerZstd, MediaTypeOCINonDistributableLayerZstd:
+		return Zstd, nil
+	case MediaTypeOCILayer, MediaTypeOCINonDistributableLayer:
+		return Uncompressed, nil
+	}
+	return Uncompressed, fmt.Errorf("Unknown layer media type: %s", mediaType)
+}
+
+// foreign (docker) or non distributable (OCI) layers may not be served by the
+// registry, they should be downloaded from the URLs in the descriptor
+func IsForeignLayer(mediaType string) bool {
+	switch mediaType {
+	case MediaTypeDockerForeignLayer, MediaTypeOCINonDistributableLayer,
+		MediaTypeOCINonDistributableLayerGzip, MediaTypeOCINonDistributableLayerZstd:
+		return true
+	}
+	return false
+}
+
+type Platform struct {
+	Architecture string
+	OS           string
+	Variant      string
+}
+
+var DefaultPlatform = Platform{OS: "linux", Architecture: "amd64"}
+
+// parse a platform in the usual docker syntax, os/architecture[/variant]
+// ex: linux/amd64 or linux/arm64/v8
+func ParsePlatform(platform string) (Platform, error) {
+	splitted := strings.Split(platform, "/")
+	if len(splitted) < 2 || len(splitted) > 3 {
+		return Platform{}, fmt.Errorf("Impossible to parse the platform: %s, expected os/architecture[/variant]", platform)
+	}
+	for _, s := range splitted {
+		if s == "" {
+			return Platform{}, fmt.Errorf("Impossible to parse the platform: %s, empty component", platform)
+		}
+	}
+	p := Platform{OS: splitted[0], Architecture: splitted[1]}
+	if len(splitted) == 3 {
+		p.Variant = splitted[2]
+	}
+	return p, nil
+}
+
+func (p Platform) String() string {
+	if p.Variant == "" {
+		return p.OS + "/" + p.Architecture
+	}
+	return p.OS + "/" + p.Architecture + "/" + p.Variant
+}
+
+type ManifestDescriptor struct {
+	MediaType string
+	Size      int
+	Digest    string
+	Platform  Platform
+}
+
+type ManifestList struct {
+	SchemaVersion int
+	MediaType     string
+	Manifests     []ManifestDescriptor
+}
+
+// select from the list the manifest that matches the platform, if the
+// variant is not specified we pick the first manifest matching os and
+// architecture
+func (l ManifestList) SelectPlatform(p Platform) (ManifestDescriptor, error) {
+	for _, m := range l.Manifests {
+		if m.Platform.OS != p.OS || m.Platform.Architecture != p.Architecture {
+			continue
+		}
+		if p.Variant != "" && m.Platform.Variant != p.Variant {
+			continue
+		}
+		return m, nil
+	}
+	return ManifestDescriptor{}, fmt.Errorf("No manifest in the list for the platform: %s", p)
+}
+
 type ThinImageLayer struct {
 	Digest string `json:"digest"`
 	Url    string `json:"url,omitempty"`
@@ -53,15 +203,16 @@ func MakeThinImage(m Manifest, layersMapping map[string]string, origin string) (
 	fmt.Println(m.Layers)
 
 	for i, layer := range m.Layers {
-		digest := strings.Split(layer.Digest, ":")[1]
+		// only the hex, whatever the algorithm
+		digest := layer.Digest[strings.Index(layer.Digest, ":")+1:]
 		location, ok := layersMapping[layer.Digest]
 		if !ok {
 			err := fmt.Errorf("Impossible to create thin image, missing layer")
 			return ThinImage{}, err
 		}
-		// the location comes as /cvmfs/$reponame/$path
-		// we need to remove the /cvmfs/ part, which are 7 chars
-		url := url_base + location[7:]
+		// the location comes as $reponame/$path, independently of
+		// where the repository is mounted
+		url := url_base + strings.TrimLeft(location, "/")
 		layers[i] = ThinImageLayer{Digest: digest, Url: url}
 	}
 
@@ -0,0 +1,319 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	da "github.com/cvmfs/docker-graphdriver/repository-manager/docker-api"
+)
+
+// The compressed layers are downloaded into a local cache, addressed by their
+// digest, shared by all the wishes and kept between runs: a layer used by
+// several images is downloaded only once. A download that fails is kept as
+// $digest.partial and resumed with a Range request. The cache is pruned, the
+// least recently used blobs first, when it grows over its maximum size.
+//
+// The same cache may be shared by several processes, ex: a convert and a
+// serve, so each blob is also locked with flock on $digest.lock, and the
+// prunes are serialized on .prune.lock in the directory of the cache.
+
+var (
+	blobCacheLock      sync.Mutex
+	blobCacheDirectory string
+	blobCacheMaxSize   int64
+	// a download at a time for each blob, the other wishes wait for it
+	blobLocks = make(map[string]*sync.Mutex)
+)
+
+// the cache is in directory, by default in the cache directory of the user
+func SetBlobCacheDirectory(directory string) {
+	blobCacheLock.Lock()
+	defer blobCacheLock.Unlock()
+	blobCacheDirectory = directory
+}
+
+// the maximum size of the cache in bytes, 0 for no limit
+func SetBlobCacheMaxSize(size int64) {
+	blobCacheLock.Lock()
+	defer blobCacheLock.Unlock()
+	blobCacheMaxSize = size
+}
+
+func getBlobCacheDirectory() string {
+	blobCacheLock.Lock()
+	defer blobCacheLock.Unlock()
+	if blobCacheDirectory != "" {
+		return blobCacheDirectory
+	}
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		cache = os.TempDir()
+	}
+	return filepath.Join(cache, "docker2cvmfs", "blobs")
+}
+
+func blobCachePath(digest string) string {
+	algorithmHex := strings.SplitN(digest, ":", 2)
+	if len(algorithmHex) != 2 {
+		return filepath.Join(getBlobCacheDirectory(), digest)
+	}
+	return filepath.Join(getBlobCacheDirectory(), algorithmHex[0], algorithmHex[1])
+}
+
+func lockBlob(digest string) func() {
+	blobCacheLock.Lock()
+	lock, ok := blobLocks[digest]
+	if !ok {
+		lock = &sync.Mutex{}
+		blobLocks[digest] = lock
+	}
+	blobCacheLock.Unlock()
+	lock.Lock()
+	unlockFile := lockFile(blobCachePath(digest) + ".lock")
+	return func() {
+		unlockFile()
+		lock.Unlock()
+	}
+}
+
+// lock the file, created if needed, against the other processes, until the
+// returned function is called. If the file can not be locked we go on
+// without it, the lock between the processes is lost but not the download
+func lockFile(path string) func() {
+	llog := func(l *log.Entry) *log.Entry {
+		return l.WithFields(log.Fields{"action": "lock file", "file": path})
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		llog(LogE(err)).Warning("Error in creating the directory of the lock file")
+		return func() {}
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		llog(LogE(err)).Warning("Error in opening the lock file")
+		return func() {}
+	}
+	for {
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		llog(LogE(err)).Warning("Error in locking the file")
+		file.Close()
+		return func() {}
+	}
+	return func() {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}
+}
+
+// remove the blob from the cache, ex: because it does not match its digest
+func removeCachedBlob(digest string) {
+	path := blobCachePath(digest)
+	os.Remove(path)
+	os.Remove(path + ".partial")
+}
+
+// return the path of the blob in the cache, downloading it from url if it is
+// not there yet. The content is not verified here, the caller checks it
+// against the digest while it reads it.
+func fetchBlob(ctx context.Context, layer da.Layer, url string, auth *registryAuth) (string, error) {
+	llog := func(l *log.Entry) *log.Entry {
+		return l.WithFields(log.Fields{"action": "fetch blob",
+			"layer": layer.Digest,
+			"url":   url})
+	}
+	path := blobCachePath(layer.Digest)
+	if _, err := os.Stat(path); err == nil {
+		llog(LogC(ctx)).Info("Layer found in the blob cache")
+		now := time.Now()
+		os.Chtimes(path, now, now)
+		return path, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		llog(LogCE(ctx, err)).Error("Error in creating the directory of the blob cache")
+		return "", err
+	}
+
+	partialPath := path + ".partial"
+	partial, err := os.OpenFile(partialPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		llog(LogCE(ctx, err)).Error("Error in opening the partial download")
+		return "", err
+	}
+	defer partial.Close()
+	offset, err := partial.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		LogCE(ctx, err).Error("Impossible to create the HTTP request.")
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := auth.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent:
+		start, err := contentRangeStart(resp.Header.Get("Content-Range"))
+		if err != nil || start != offset {
+			partial.Truncate(0)
+			return "", fmt.Errorf("Wrong range in the answer: %s", resp.Header.Get("Content-Range"))
+		}
+		llog(LogC(ctx)).WithFields(log.Fields{"offset": offset}).Info("Resuming the download of the layer")
+	case resp.StatusCode == http.StatusOK:
+		// the server ignored the range, we start from scratch
+		if err = partial.Truncate(0); err != nil {
+			return "", err
+		}
+		if _, err = partial.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		offset = 0
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		partial.Truncate(0)
+		return "", fmt.Errorf("Partial download of layer %s larger than the layer", layer.Digest)
+	default:
+		return "", fmt.Errorf("Layer not received, status code: %d", resp.StatusCode)
+	}
+
+	// what we got so far stays in the partial file, the next attempt
+	// resumes from there
+	n, err := io.Copy(partial, resp.Body)
+	if err != nil {
+		llog(LogCE(ctx, err)).WithFields(log.Fields{"received": offset + n}).Warning(
+			"Download interrupted, keeping the partial layer")
+		return "", err
+	}
+	if layer.Size > 0 && offset+n != int64(layer.Size) {
+		partial.Truncate(0)
+		return "", fmt.Errorf("Size mismatch for layer %s, expected %d bytes got %d", layer.Digest, layer.Size, offset+n)
+	}
+	if err = partial.Close(); err != nil {
+		return "", err
+	}
+	if err = os.Rename(partialPath, path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// the start of the range in a header like: bytes 100-199/200
+func contentRangeStart(contentRange string) (int64, error) {
+	var start, end int64
+	var total string
+	_, err := fmt.Sscanf(contentRange, "bytes %d-%d/%s", &start, &end, &total)
+	if err != nil {
+		return 0, fmt.Errorf("Wrong Content-Range header: %s", contentRange)
+	}
+	return start, nil
+}
+
+// remove the least recently used blobs until the cache fits in its maximum
+// size, the partial downloads are removed only if older than a day
+func PruneBlobCache() error {
+	blobCacheLock.Lock()
+	maxSize := blobCacheMaxSize
+	blobCacheLock.Unlock()
+	if maxSize <= 0 {
+		return nil
+	}
+	directory := getBlobCacheDirectory()
+	unlock := lockFile(filepath.Join(directory, ".prune.lock"))
+	defer unlock()
+
+	type blob struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var blobs []blob
+	var total int64
+	err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() || strings.HasSuffix(path, ".lock") {
+			return nil
+		}
+		if strings.HasSuffix(path, ".partial") && time.Since(info.ModTime()) < 24*time.Hour {
+			total += info.Size()
+			return nil
+		}
+		blobs = append(blobs, blob{path, info.Size(), info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		LogE(err).WithFields(log.Fields{"directory": directory}).Error("Error in walking the blob cache")
+		return err
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].modTime.Before(blobs[j].modTime) })
+	for _, b := range blobs {
+		if total <= maxSize {
+			break
+		}
+		unlock := lockBlob(blobDigestFromPath(b.path))
+		err := os.Remove(b.path)
+		unlock()
+		if err != nil && !os.IsNotExist(err) {
+			LogE(err).WithFields(log.Fields{"blob": b.path}).Warning("Error in removing the blob from the cache")
+			continue
+		}
+		total -= b.size
+	}
+	Log().WithFields(log.Fields{"directory": directory, "size": total}).Info("Pruned the blob cache")
+	return nil
+}
+
+func blobDigestFromPath(path string) string {
+	name := strings.TrimSuffix(filepath.Base(path), ".partial")
+	return filepath.Base(filepath.Dir(path)) + ":" + name
+}
+
+// parse sizes like 100M or 20G, a number without suffix is in bytes
+func ParseSize(size string) (int64, error) {
+	size = strings.TrimSpace(strings.ToUpper(size))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int64
+	}{{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40}} {
+		if strings.HasSuffix(size, unit.suffix) {
+			multiplier = unit.multiplier
+			size = strings.TrimSuffix(size, unit.suffix)
+			break
+		}
+	}
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Wrong size: %s", size)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,188 @@
+package lib
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func blobRequests(registry *fakeRegistry, repository, digest string) []string {
+	var requests []string
+	prefix := "GET /v2/" + repository + "/blobs/" + digest
+	for _, request := range registry.Requests() {
+		if len(request) >= len(prefix) && request[:len(prefix)] == prefix {
+			requests = append(requests, request)
+		}
+	}
+	return requests
+}
+
+func TestConvertWishResumesDownload(t *testing.T) {
+	cvmfs := newFakeCvmfs(t, testRepo)
+	defer cvmfs.Close()
+	registry := newFakeRegistry()
+	defer registry.Close()
+	_, restore := fakePush(t, registry)
+	defer restore()
+
+	manifest := registry.AddImage(t, "library/test", "latest",
+		map[string]string{"etc/os-release": "fake"})
+	layer := manifest.Layers[0].Digest
+	registry.InterruptBlob(layer, 10)
+
+	_, err := ConvertWish(context.Background(), testWish(registry, "library/test", "latest"), false, false, false)
+	if err != nil {
+		t.Fatalf("Error in converting the wish: %s", err)
+	}
+	requests := blobRequests(registry, "library/test", layer)
+	if len(requests) < 2 || requests[len(requests)-1] != "GET /v2/library/test/blobs/"+layer+" bytes=10-" {
+		t.Errorf("The download was not resumed: %v", requests)
+	}
+	if _, err := os.Stat(filepath.Join(LayerRootfsPath(testRepo, digestHex(layer)), "etc/os-release")); err != nil {
+		t.Errorf("Layer not ingested: %s", err)
+	}
+}
+
+func TestConvertWishSkipsKnownLayers(t *testing.T) {
+	cvmfs := newFakeCvmfs(t, testRepo)
+	defer cvmfs.Close()
+	registry := newFakeRegistry()
+	defer registry.Close()
+	_, restore := fakePush(t, registry)
+	defer restore()
+
+	shared := map[string]string{"etc/os-release": "shared"}
+	first := registry.AddImage(t, "library/first", "latest", shared)
+	second := registry.AddImage(t, "library/second", "latest", shared,
+		map[string]string{"usr/bin/hello": "hello"})
+	sharedLayer := first.Layers[0].Digest
+
+	if _, err := ConvertWish(context.Background(), testWish(registry, "library/first", "latest"), false, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ConvertWish(context.Background(), testWish(registry, "library/second", "latest"), false, false, false); err != nil {
+		t.Fatal(err)
+	}
+	// the layer is already in the repository, the second image does not
+	// download it
+	if requests := blobRequests(registry, "library/second", sharedLayer); len(requests) != 0 {
+		t.Errorf("A layer already in the repository was downloaded: %v", requests)
+	}
+	if requests := blobRequests(registry, "library/second", second.Layers[1].Digest); len(requests) == 0 {
+		t.Errorf("The new layer was not downloaded")
+	}
+
+	// forcing the download, the layer comes from the blob cache
+	if _, err := ConvertWish(context.Background(), testWish(registry, "library/first", "latest"), true, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if requests := blobRequests(registry, "library/first", sharedLayer); len(requests) != 1 {
+		t.Errorf("The cached layer was downloaded again: %v", requests)
+	}
+}
+
+func TestPruneBlobCache(t *testing.T) {
+	cache, err := ioutil.TempDir("", "blob_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cache)
+	oldCache := getBlobCacheDirectory()
+	SetBlobCacheDirectory(cache)
+	defer SetBlobCacheDirectory(oldCache)
+	defer SetBlobCacheMaxSize(0)
+
+	now := time.Now()
+	for i, name := range []string{"old", "middle", "new"} {
+		path := blobCachePath("sha256:" + name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, make([]byte, 100), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modTime := now.Add(time.Duration(i-3) * time.Hour)
+		os.Chtimes(path, modTime, modTime)
+	}
+
+	SetBlobCacheMaxSize(200)
+	if err := PruneBlobCache(); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]bool{"old": false, "middle": true, "new": true} {
+		_, err := os.Stat(blobCachePath("sha256:" + name))
+		if (err == nil) != expected {
+			t.Errorf("Wrong pruning of the blob %s, expected to be kept: %v", name, expected)
+		}
+	}
+}
+
+func TestPruneBlobCacheLockedByAnotherProcess(t *testing.T) {
+	cache, err := ioutil.TempDir("", "blob_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cache)
+	oldCache := getBlobCacheDirectory()
+	SetBlobCacheDirectory(cache)
+	defer SetBlobCacheDirectory(oldCache)
+	defer SetBlobCacheMaxSize(0)
+
+	path := blobCachePath("sha256:used")
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := ioutil.WriteFile(path, make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// another process is reading the blob, flock locks of different open
+	// files conflict also inside the same process
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+
+	SetBlobCacheMaxSize(10)
+	pruned := make(chan error)
+	go func() { pruned <- PruneBlobCache() }()
+	select {
+	case <-pruned:
+		t.Fatalf("The prune did not wait for the lock of the blob")
+	case <-time.After(200 * time.Millisecond):
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("A locked blob was removed: %s", err)
+	}
+	syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+	if err := <-pruned; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err == nil {
+		t.Errorf("The blob was not removed once unlocked")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for size, expected := range map[string]int64{
+		"0":    0,
+		"512":  512,
+		"10k":  10 << 10,
+		"20G":  20 << 30,
+		"1T ":  1 << 40,
+		"300M": 300 << 20,
+	} {
+		n, err := ParseSize(size)
+		if err != nil || n != expected {
+			t.Errorf("Wrong size for %s: %d %v", size, n, err)
+		}
+	}
+	for _, wrong := range []string{"", "G", "-1", "1.5G"} {
+		if _, err := ParseSize(wrong); err == nil {
+			t.Errorf("Expected an error for the size %s", wrong)
+		}
+	}
+}
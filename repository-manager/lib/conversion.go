@@ -4,19 +4,16 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync"
+	"time"
 
 	da "github.com/cvmfs/docker-graphdriver/repository-manager/docker-api"
 
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/client"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -30,97 +27,177 @@ const (
 
 var subDirInsideRepo = ".layers"
 
-func ConvertWish(wish WishFriendly, convertAgain, forceDownload, convertSingularity bool) (err error) {
+// convert the wishes with convert using up to `jobs` workers, all the CVMFS
+// transactions for the same repository are serialized by the publish queue of
+// the repository, so only the downloads run really in parallel.
+// When ctx is canceled we don't start any other wish, we wait for the ones
+// already running to give up and return true. The reports of the wishes
+// converted are in the order of the wishes.
+func ConvertWishes(ctx context.Context, wishes []WishFriendly, jobs int, convert func(context.Context, WishFriendly) ConversionReport) (reports []ConversionReport, stopped bool) {
+	if jobs < 1 {
+		jobs = 1
+	}
+	type indexedWish struct {
+		index int
+		wish  WishFriendly
+	}
+	wishChan := make(chan indexedWish)
+	results := make([]*ConversionReport, len(wishes))
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for w := range wishChan {
+				report := convert(ctx, w.wish)
+				results[w.index] = &report
+			}
+		}()
+	}
+	defer func() {
+		close(wishChan)
+		wg.Wait()
+		for _, report := range results {
+			if report != nil {
+				reports = append(reports, *report)
+			}
+		}
+	}()
 
-	err = CreateCatalogIntoDir(wish.CvmfsRepo, subDirInsideRepo)
-	if err != nil {
-		LogE(err).WithFields(log.Fields{
-			"directory": subDirInsideRepo}).Error(
-			"Impossible to create subcatalog in super-directory.")
+	for i, wish := range wishes {
+		// check first, a select with several ready cases picks one at random
+		select {
+		case <-ctx.Done():
+			LogC(ctx).Info("Stopping, waiting for the running conversions")
+			return nil, true
+		default:
+		}
+		select {
+		case <-ctx.Done():
+			LogC(ctx).Info("Stopping, waiting for the running conversions")
+			return nil, true
+		case wishChan <- indexedWish{i, wish}:
+		}
 	}
-	err = CreateCatalogIntoDir(wish.CvmfsRepo, ".flat")
-	if err != nil {
-		LogE(err).WithFields(log.Fields{
-			"directory": ".flat"}).Error(
-			"Impossible to create subcatalog in super-directory.")
+	return nil, ctx.Err() != nil
+}
+
+// the new layers are ingested each with its own publish once they are all
+// downloaded, the other modifications to the repository needed by the wish
+// (metadata of the layers, singularity image, reference index, manifest and
+// remove schedule) are collected in two transactions published at the end of
+// the conversion, before and after the push of the thin image.
+// The report tells what happened, also when the conversion fails.
+//
+// Canceling ctx stops the downloads and gives up the conversion before the
+// push, once the transaction is open the operation in progress and the
+// publish are completed and the rest of the transaction is aborted.
+func ConvertWish(ctx context.Context, wish WishFriendly, convertAgain, forceDownload, convertSingularity bool) (report ConversionReport, err error) {
+	convertSingularity = convertSingularity && !wish.SkipSingularity
+	report = newConversionReport(wish)
+	var layers layerReports
+	var manifest da.Manifest
+	published := false
+	defer func() {
+		report.Layers = layers.list(manifest, published)
+		if err != nil && ctx.Err() != nil {
+			report.Outcome = OutcomeCanceled
+		}
+		report.finish(err)
+	}()
+	if err = ctx.Err(); err != nil {
+		return
 	}
 
+	transaction := NewTransaction(wish.CvmfsRepo)
+	transaction.CreateCatalog(subDirInsideRepo)
+	transaction.CreateCatalog(".flat")
+
 	outputImage, err := ParseImage(wish.OutputName)
 	outputImage.User = wish.UserOutput
 	if err != nil {
 		return
 	}
-	password, err := getPassword()
+	credentials, err := GetOutputCredentials(outputImage.Registry, wish.UserOutput, wish.OutputCredentials)
 	if err != nil {
 		return
 	}
+	if credentials.IsAnonymous() {
+		err = fmt.Errorf("No credentials to push to the registry %s", outputImage.Registry)
+		LogCE(ctx, err).Error("Impossible to push the thin image")
+		return
+	}
 	inputImage, err := ParseImage(wish.InputName)
 	inputImage.User = wish.UserInput
+	inputImage.Platform = wish.Platform
+	inputImage.Credentials = wish.InputCredentials
 	if err != nil {
 		return
 	}
-	manifest, err := inputImage.GetManifest()
+	manifest, err = inputImage.GetManifest()
 	if err != nil {
 		return
 	}
+	report.ConfigDigest = manifest.Config.Digest
 
 	alreadyConverted := AlreadyConverted(wish.CvmfsRepo, inputImage, manifest.Config.Digest)
-	Log().WithFields(log.Fields{"alreadyConverted": alreadyConverted}).Info(
+	LogC(ctx).WithFields(log.Fields{"alreadyConverted": alreadyConverted}).Info(
 		"Already converted the image, skipping.")
 
 	switch alreadyConverted {
 
 	case ConversionMatch:
 		{
-			Log().Info("Already converted the image.")
+			LogC(ctx).Info("Already converted the image.")
 			if convertAgain == false {
-				return nil
+				report.Outcome = OutcomeAlreadyConverted
+				for _, layer := range manifest.Layers {
+					layers.set(LayerReport{Digest: layer.Digest, Status: LayerSkipped})
+				}
+				return report, nil
 			}
 
 		}
 	}
 
 	layersChanell := make(chan downloadedLayer, 3)
-	manifestChanell := make(chan string, 1)
-	stopGettingLayers := make(chan bool, 1)
 	noErrorInConversion := make(chan bool, 1)
 
 	type LayerRepoLocation struct {
 		Digest   string
-		Location string //location does NOT need the prefix `/cvmfs`
+		Location string // $REPO/path/of/the/layer, without the mount root
 	}
 	layerRepoLocationChan := make(chan LayerRepoLocation, 3)
-	layerDigestChan := make(chan string, 3)
+	// written by the ingestion goroutine, read only after noErrorInConversion
+	var verifications []LayerVerification
+	fileLists := make(map[string]map[string]LayerFile)
+	// the layers just downloaded, to build the singularity image
+	tarballs := make(map[string]string)
+	type layerIngestion struct {
+		report  LayerReport
+		tarball string
+		path    string
+	}
+	var ingestions []layerIngestion
 	go func() {
 		noErrors := true
 		var wg sync.WaitGroup
 		defer func() {
 			wg.Wait()
 			close(layerRepoLocationChan)
-			close(layerDigestChan)
 		}()
 		defer func() {
 			noErrorInConversion <- noErrors
-			stopGettingLayers <- true
-			close(stopGettingLayers)
 		}()
-		cleanup := func(location string) {
-			Log().Info("Running clean up function deleting the last layer.")
-
-			err := ExecCommand("cvmfs_server", "abort", "-f", wish.CvmfsRepo).Start()
-			if err != nil {
-				LogE(err).Warning("Error in the abort command inside the cleanup function, this warning is usually normal")
-			}
-
-			err = ExecCommand("cvmfs_server", "ingest", "--delete", location, wish.CvmfsRepo).Start()
-			if err != nil {
-				LogE(err).Error("Error in the cleanup command")
-			}
-		}
 		for layer := range layersChanell {
+			if layer.Err != nil {
+				layers.set(LayerReport{Digest: layer.Name, Status: LayerFailed, Error: layer.Err.Error()})
+				noErrors = false
+				continue
+			}
 
-			Log().WithFields(log.Fields{"layer": layer.Name}).Info("Start Ingesting the file into CVMFS")
-			layerDigest := strings.Split(layer.Name, ":")[1]
+			LogC(ctx).WithFields(log.Fields{"layer": layer.Name}).Info("Layer received")
+			layerDigest := withoutAlgorithm(layer.Name)
 			layerPath := LayerRootfsPath(wish.CvmfsRepo, layerDigest)
 
 			var pathExists bool
@@ -129,81 +206,76 @@ func ConvertWish(wish WishFriendly, convertAgain, forceDownload, convertSingular
 			} else {
 				pathExists = true
 			}
+			if layer.Path == "" && !pathExists {
+				// it was there when we decided not to download it
+				LogC(ctx).WithFields(log.Fields{"layer": layer.Name}).Error(
+					"Layer removed from the repository during the conversion")
+				layers.set(LayerReport{Digest: layer.Name, Status: LayerFailed,
+					Error: "layer removed from the repository during the conversion"})
+				noErrors = false
+				continue
+			}
 
 			// need to run this into a goroutine to avoid a deadlock
 			wg.Add(1)
-			go func(layerName, layerLocation, layerDigest string) {
+			go func(layerName, layerLocation string) {
 				layerRepoLocationChan <- LayerRepoLocation{
 					Digest:   layerName,
 					Location: layerLocation}
-				layerDigestChan <- layerDigest
 				wg.Done()
-			}(layer.Name, layerPath, layerDigest)
+			}(layer.Name, filepath.Join(wish.CvmfsRepo, TrimCVMFSRepoPrefix(wish.CvmfsRepo, layerPath)))
 
-			if pathExists == false || forceDownload {
+			if layer.Path != "" && (pathExists == false || forceDownload) {
 
 				// need to create the "super-directory", those
 				// directory starting with 2 char prefix of the
 				// digest itself, and put a .cvmfscatalog files
-				// in it, if the directory still doesn't
-				// exists. Similarly we need a .cvmfscatalog in
-				// the layerfs directory, the one that host the
-				// whole layer
-
-				for _, dir := range []string{
-					filepath.Dir(filepath.Dir(TrimCVMFSRepoPrefix(layerPath))),
-					//TrimCVMFSRepoPrefix(layerPath)} {
-				} {
-
-					Log().WithFields(log.Fields{"catalogdirectory": dir}).Info("Working on CATALOGDIRECTORY")
-					err = CreateCatalogIntoDir(wish.CvmfsRepo, dir)
-					if err != nil {
-						LogE(err).WithFields(log.Fields{
-							"directory": dir}).Error(
-							"Impossible to create subcatalog in super-directory.")
-					} else {
-						Log().WithFields(log.Fields{
-							"directory": dir}).Info(
-							"Created subcatalog in directory")
-					}
-				}
-				err = ExecCommand("cvmfs_server", "ingest", "--catalog", "-t", layer.Path, "-b", TrimCVMFSRepoPrefix(layerPath), wish.CvmfsRepo).Start()
-
-				if err != nil {
-					LogE(err).WithFields(log.Fields{"layer": layer.Name}).Error("Some error in ingest the layer")
-					noErrors = false
-					cleanup(TrimCVMFSRepoPrefix(layerPath))
-					return
-				}
-				Log().WithFields(log.Fields{"layer": layer.Name}).Info("Finish Ingesting the file")
+				// in it. The layerfs directory, the one that
+				// host the whole layer, gets its own catalog
+				// during the ingestion
+				transaction.CreateCatalog(filepath.Dir(filepath.Dir(TrimCVMFSRepoPrefix(wish.CvmfsRepo, layerPath))))
+
+				verifications = append(verifications, layer.Verification)
+				fileLists[layer.Name] = layer.Files
+				tarballs[layer.Name] = layer.Path
+				layerReport := LayerReport{Digest: layer.Name, Status: LayerDownloaded,
+					DownloadSeconds: layer.Elapsed.Seconds()}
+				layers.set(layerReport)
+				ingestions = append(ingestions, layerIngestion{
+					report:  layerReport,
+					tarball: layer.Path,
+					path:    TrimCVMFSRepoPrefix(wish.CvmfsRepo, layerPath)})
 			} else {
-				Log().WithFields(log.Fields{"layer": layer.Name}).Info("Skipping ingestion of layer, already exists")
+				LogC(ctx).WithFields(log.Fields{"layer": layer.Name}).Info("Skipping ingestion of layer, already exists")
+				layers.set(LayerReport{Digest: layer.Name, Status: LayerSkipped})
 			}
-			//os.Remove(layer.Path)
 		}
-		Log().Info("Finished pushing the layers into CVMFS")
+		LogC(ctx).Info("Finished receiving the layers")
 	}()
 	// we create a temp directory for all the files needed, when this function finish we can remove the temp directory cleaning up
 	tmpDir, err := ioutil.TempDir("", "conversion")
 	if err != nil {
-		LogE(err).Error("Error in creating a temporary direcotry for all the files")
+		LogCE(ctx, err).Error("Error in creating a temporary direcotry for all the files")
 		return
 	}
 	defer os.RemoveAll(tmpDir)
 
 	// this wil start to feed the above goroutine by writing into layersChanell
-	err = inputImage.GetLayers(layersChanell, manifestChanell, stopGettingLayers, tmpDir)
-
-	var singularity Singularity
-	if convertSingularity {
-		singularity, err = inputImage.DownloadSingularityDirectory(tmpDir)
-		if err != nil {
-			LogE(err).Error("Error in dowloading the singularity image")
-			return
+	// the layers already in the repository are not even downloaded
+	isIngested := func(layer da.Layer) bool {
+		if forceDownload {
+			return false
 		}
-		defer os.RemoveAll(singularity.TempDirectory)
+		_, err := os.Stat(LayerRootfsPath(wish.CvmfsRepo, withoutAlgorithm(layer.Digest)))
+		return err == nil
+	}
+	layersStart := time.Now()
+	layersErr := inputImage.GetLayers(ctx, manifest, layersChanell, tmpDir, isIngested)
+
+	if !convertSingularity {
+		report.Singularity = StepSkipped
 	}
-	changes, _ := inputImage.GetChanges()
+	inputConfig, configErr := inputImage.GetConfig(manifest)
 
 	var wg sync.WaitGroup
 
@@ -216,15 +288,36 @@ func ConvertWish(wish WishFriendly, convertAgain, forceDownload, convertSingular
 		wg.Done()
 	}()
 
-	var layerDigests []string
-	wg.Add(1)
-	go func() {
-		for layerDigest := range layerDigestChan {
-			layerDigests = append(layerDigests, layerDigest)
-		}
-		wg.Done()
-	}()
 	wg.Wait()
+	report.Timings.Layers = time.Since(layersStart).Seconds()
+	// the channels are drained, we can give up without leaving goroutines
+	// behind, before pushing or writing anything
+	for _, e := range []error{layersErr, configErr} {
+		if e != nil {
+			err = e
+			return
+		}
+	}
+	if !<-noErrorInConversion {
+		err = fmt.Errorf("Some layers of the image are missing")
+		LogCE(ctx, err).Error("Incomplete set of layers, giving up the conversion")
+		return
+	}
+	if err = ctx.Err(); err != nil {
+		LogC(ctx).Info("Conversion canceled, not publishing the layers")
+		return
+	}
+
+	// all the layers are here, the singularity image is built from them
+	var singularity Singularity
+	if convertSingularity {
+		singularity, err = inputImage.BuildSingularityDirectory(ctx, wish.CvmfsRepo, manifest, inputConfig, tarballs, tmpDir)
+		if err != nil {
+			LogCE(ctx, err).Error("Error in building the singularity image")
+			report.Singularity = StepFailed
+			return
+		}
+	}
 
 	thin, err := da.MakeThinImage(manifest, layerLocations, inputImage.WholeName())
 	if err != nil {
@@ -235,7 +328,7 @@ func ConvertWish(wish WishFriendly, convertAgain, forceDownload, convertSingular
 	if err != nil {
 		return
 	}
-	fmt.Println(string(thinJson))
+	LogC(ctx).WithFields(log.Fields{"thin image": string(thinJson)}).Debug("Created the thin image")
 	var imageTar bytes.Buffer
 	tarFile := tar.NewWriter(&imageTar)
 	header := &tar.Header{Name: "thin.json", Mode: 0644, Size: int64(len(thinJson))}
@@ -252,111 +345,142 @@ func ConvertWish(wish WishFriendly, convertAgain, forceDownload, convertSingular
 		return
 	}
 
-	dockerClient, err := client.NewClientWithOpts(client.WithVersion("1.19"))
+	thinImageConfig, err := makeThinConfig(inputConfig, imageTar.Bytes(), inputImage.WholeName())
 	if err != nil {
 		return
 	}
-
-	image := types.ImageImportSource{
-		Source:     bytes.NewBuffer(imageTar.Bytes()),
-		SourceName: "-",
+	// the layers and the singularity image are published before pushing the
+	// thin image, so that it never refers to layers that are not in the
+	// repository
+	if convertSingularity {
+		err = singularity.AddToTransaction(transaction)
+		if err != nil {
+			LogCE(ctx, err).Error("Error in adding the singularity image to the transaction")
+			report.Singularity = StepFailed
+			return
+		}
 	}
-	importOptions := types.ImageImportOptions{
-		Tag:     outputImage.Tag,
-		Message: "",
-		Changes: changes,
+	err = SaveLayersVerification(transaction, verifications)
+	if err != nil {
+		LogCE(ctx, err).Error("Error in saving the verification of the layers")
+		return
 	}
-	importResult, err := dockerClient.ImageImport(
-		context.Background(),
-		image,
-		outputImage.GetSimpleName(),
-		importOptions)
+	err = SaveLayersFileList(transaction, fileLists)
 	if err != nil {
-		LogE(err).Error("Error in image import")
+		LogCE(ctx, err).Error("Error in saving the files of the layers")
 		return
 	}
-	defer importResult.Close()
-	Log().Info("Created the image in the local docker daemon")
-
-	// is necessary this mechanism to pass the authentication to the
-	// dockers even if the documentation says otherwise
-	authStruct := struct {
-		Username string
-		Password string
-	}{
-		Username: outputImage.User,
-		Password: password,
+	// the garbage collection may have removed the layers we did not download,
+	// the conversion fails and the next one downloads them again
+	checkLayers := func(transaction *Transaction) {
+		for _, layer := range manifest.Layers {
+			transaction.CheckExists(
+				TrimCVMFSRepoPrefix(wish.CvmfsRepo, LayerRootfsPath(wish.CvmfsRepo, withoutAlgorithm(layer.Digest))),
+				fmt.Errorf("The layer %s was removed during the conversion, convert the image again", layer.Digest))
+		}
 	}
-	authBytes, _ := json.Marshal(authStruct)
-	authCredential := base64.StdEncoding.EncodeToString(authBytes)
-	pushOptions := types.ImagePushOptions{
-		RegistryAuth: authCredential,
+	publishStart := time.Now()
+	// the layers are ingested with their own publish, outside of the
+	// transaction, if another wish ingests the same layer before us the layer
+	// is not ingested again
+	for _, ingestion := range ingestions {
+		err = IngestTarball(ctx, wish.CvmfsRepo, ingestion.tarball, ingestion.path, forceDownload)
+		if err != nil {
+			LogCE(ctx, err).WithFields(log.Fields{"layer": ingestion.report.Digest}).Error(
+				"Error in ingesting the layer into the repository")
+			report.Timings.Publish = time.Since(publishStart).Seconds()
+			report.Publish = StepFailed
+			return
+		}
+		ingestion.report.Status = LayerIngested
+		layers.set(ingestion.report)
 	}
-
-	res, err := dockerClient.ImagePush(
-		context.Background(),
-		outputImage.GetSimpleName(),
-		pushOptions)
+	checkLayers(transaction)
+	err = transaction.Commit(ctx)
+	report.Timings.Publish = time.Since(publishStart).Seconds()
 	if err != nil {
+		LogCE(ctx, err).Error("Error in publishing the layers into the repository")
+		report.Publish = StepFailed
+		return
+	}
+	published = true
+	if convertSingularity {
+		report.Singularity = StepDone
+	}
+	if err = ctx.Err(); err != nil {
+		LogC(ctx).Info("Conversion canceled, not pushing the thin image")
 		return
 	}
-	b, _ := ioutil.ReadAll(res)
-	fmt.Println(string(b))
-	defer res.Close()
-	// here is possible to use the result of the above ReadAll to have
-	// informantion about the status of the upload.
-	_, err = ioutil.ReadAll(res)
+
+	pushStart := time.Now()
+	report.ThinImageDigest, err = pushThinImage(outputImage, credentials, imageTar.Bytes(), thinImageConfig)
+	report.Timings.Push = time.Since(pushStart).Seconds()
 	if err != nil {
 		return
 	}
-	Log().Info("Finish pushing the image to the registry")
-	// we wait for the goroutines to finish
-	// and if there was no error we add everything to the converted table
-	noErrorInConversionValue := <-noErrorInConversion
+	LogC(ctx).Info("Finish pushing the image to the registry")
 
-	// here we can launch the ingestion for the singularity image
+	// the image is recorded as converted only once the thin image is pushed,
+	// with its digest
+	transaction = NewTransaction(wish.CvmfsRepo)
+	checkLayers(transaction)
+	AddImageToReferenceIndex(transaction, inputImage.GetPlatformName(), manifest, IndexedName{
+		InputImage:  wish.InputName,
+		OutputImage: wish.OutputName})
+
+	// the same manifest of the layers and of the thin image, also if the tag
+	// moved meanwhile
+	manifestJson, err := json.Marshal(manifest)
+	if err != nil {
+		return
+	}
+	transaction.WriteFile(filepath.Join(".metadata", inputImage.GetPlatformName(), "manifest.json"), manifestJson)
+	converted := ConvertedWish{
+		InputImage:        wish.InputName,
+		OutputImage:       wish.OutputName,
+		UserOutput:        wish.UserOutput,
+		OutputCredentials: wish.OutputCredentials,
+		ThinImageDigest:   report.ThinImageDigest}
 	if convertSingularity {
-		err = singularity.IngestIntoCVMFS(wish.CvmfsRepo)
-		if err != nil {
-			LogE(err).Error("Error in ingesting the singularity image into the CVMFS repository")
-			noErrorInConversionValue = false
-		}
+		converted.SingularitySymlink = inputImage.singularitySymlinkPath()
 	}
-
-	err = SaveLayersBacklink(wish.CvmfsRepo, inputImage, layerDigests)
+	convertedJson, err := json.Marshal(converted)
 	if err != nil {
-		LogE(err).Error("Error in saving the backlinks")
-		noErrorInConversionValue = false
+		return
+	}
+	transaction.WriteFile(filepath.Join(".metadata", inputImage.GetPlatformName(), "wish.json"), convertedJson)
+	if convertSingularity {
+		singularity.AddSymlinkToTransaction(transaction)
 	}
 
-	if noErrorInConversionValue {
-		manifestPath := filepath.Join(".metadata", inputImage.GetSimpleName(), "manifest.json")
-		errIng := IngestIntoCVMFS(wish.CvmfsRepo, manifestPath, <-manifestChanell)
-		if err != nil {
-			LogE(errIng).Error("Error in storing the manifest in the repository")
-		}
-		var errRemoveSchedule error
-		if alreadyConverted == ConversionNotMatch {
-			Log().Info("Image already converted, but it does not match the manifest, adding it to the remove scheduler")
-			errRemoveSchedule = AddManifestToRemoveScheduler(wish.CvmfsRepo, manifest)
-			if errRemoveSchedule != nil {
-				Log().Warning("Error in adding the image to the remove schedule")
-			}
-		}
-		if errIng == nil && errRemoveSchedule == nil {
-			Log().Info("Conversion completed")
-		}
-		return
+	if alreadyConverted == ConversionNotMatch {
+		LogC(ctx).Info("Image already converted, but it does not match the manifest, adding it to the remove scheduler")
+		AddManifestToRemoveScheduler(transaction, manifest)
 	} else {
-		Log().Warn("Some error during the conversion, we are not storing it into the database")
+		report.RemoveSchedule = StepSkipped
+	}
+
+	publishStart = time.Now()
+	err = transaction.Commit(ctx)
+	report.Timings.Publish += time.Since(publishStart).Seconds()
+	if err != nil {
+		LogCE(ctx, err).Error("Error in publishing the conversion into the repository")
+		report.Publish = StepFailed
 		return
 	}
+	report.Publish = StepDone
+	report.ReferenceIndex = StepDone
+	if alreadyConverted == ConversionNotMatch {
+		report.RemoveSchedule = StepDone
+	}
+	LogC(ctx).Info("Conversion completed")
+	PruneBlobCache()
+	return
 }
 
 func AlreadyConverted(CVMFSRepo string, img Image, reference string) ConversionResult {
-	path := filepath.Join("/", "cvmfs", CVMFSRepo, ".metadata", img.GetSimpleName(), "manifest.json")
+	path := RepositoryPath(CVMFSRepo, ".metadata", img.GetPlatformName(), "manifest.json")
 
-	fmt.Println(path)
 	manifestStat, err := os.Stat(path)
 	if os.IsNotExist(err) {
 		Log().Info("Manifest not existing")
@@ -382,15 +506,29 @@ func AlreadyConverted(CVMFSRepo string, img Image, reference string) ConversionR
 		LogE(err).Warning("Error in unmarshaling the manifest")
 		return ConversionNotFound
 	}
-	fmt.Printf("%s == %s\n", manifest.Config.Digest, reference)
+	// manifests stored before the OCI support don't carry the media type
+	if manifest.MediaType != "" && !da.IsManifest(manifest.MediaType) {
+		Log().WithFields(log.Fields{"media type": manifest.MediaType}).Warning(
+			"Stored manifest of unknown media type")
+		return ConversionNotFound
+	}
+	Log().WithFields(log.Fields{"converted": manifest.Config.Digest, "reference": reference}).Debug(
+		"Comparing the converted image")
 	if manifest.Config.Digest == reference {
 		return ConversionMatch
 	}
 	return ConversionNotMatch
 }
 
-func getPassword() (string, error) {
-	envVar := "DOCKER2CVMFS_DOCKER_REGISTRY_PASS"
+const defaultPasswordVariable = "DOCKER2CVMFS_DOCKER_REGISTRY_PASS"
+
+// the credentials reference is the name of the environment variable that
+// stores the password, by default DOCKER2CVMFS_DOCKER_REGISTRY_PASS
+func getPassword(credentials string) (string, error) {
+	envVar := credentials
+	if envVar == "" {
+		envVar = defaultPasswordVariable
+	}
 	pass := os.Getenv(envVar)
 	if pass == "" {
 		err := fmt.Errorf(
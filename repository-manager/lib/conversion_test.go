@@ -0,0 +1,688 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	da "github.com/cvmfs/docker-graphdriver/repository-manager/docker-api"
+)
+
+const testRepo = "unpacked.example.ch"
+
+type pushedImage struct {
+	name    string
+	tarball []byte
+	config  []byte
+}
+
+// replace the push of the thin images, the returned slice is filled with
+// what ConvertWish pushes, the registry is the one of the thin images
+func fakePush(t *testing.T, registry *fakeRegistry) (*[]pushedImage, func()) {
+	var pushed []pushedImage
+	var mutex sync.Mutex
+	old := pushThinImage
+	pushThinImage = func(outputImage Image, credentials Credentials, imageTar []byte, config []byte) (string, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		pushed = append(pushed, pushedImage{
+			name:    outputImage.GetSimpleName(),
+			tarball: imageTar,
+			config:  config})
+		return sha256Digest(config), nil
+	}
+	restorePassword := setenv(defaultPasswordVariable, "password")
+	restoreRegistry := setenv(defaultPasswordRegistryVariable, registry.Host())
+	return &pushed, func() {
+		pushThinImage = old
+		restorePassword()
+		restoreRegistry()
+	}
+}
+
+// set an environment variable, the returned function restores it
+func setenv(name, value string) func() {
+	old, had := os.LookupEnv(name)
+	os.Setenv(name, value)
+	return func() {
+		if had {
+			os.Setenv(name, old)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func testWish(registry *fakeRegistry, repository, tag string) WishFriendly {
+	return WishFriendly{
+		InputName:  "http://" + registry.Host() + "/" + repository + ":" + tag,
+		OutputName: "http://" + registry.Host() + "/thin/" + repository + ":" + tag,
+		CvmfsRepo:  testRepo}
+}
+
+func digestHex(digest string) string {
+	return strings.Split(digest, ":")[1]
+}
+
+func TestConvertWish(t *testing.T) {
+	cvmfs := newFakeCvmfs(t, testRepo)
+	defer cvmfs.Close()
+	registry := newFakeRegistry()
+	defer registry.Close()
+	pushed, restore := fakePush(t, registry)
+	defer restore()
+
+	manifest := registry.AddImage(t, "library/test", "latest",
+		map[string]string{"etc/os-release": "fake"},
+		map[string]string{"usr/bin/hello": "hello"})
+
+	report, err := ConvertWish(context.Background(), testWish(registry, "library/test", "latest"), false, false, false)
+	if err != nil {
+		t.Fatalf("Error in converting the wish: %s", err)
+	}
+
+	// each layer is ingested on its own, then the metadata of the layers
+	// and the image once the thin image is pushed
+	if revision := cvmfs.Revision(testRepo); revision != 4 {
+		t.Errorf("Expected four publishes, got %d", revision)
+	}
+	ingested := 0
+	for _, command := range cvmfs.Commands() {
+		if strings.HasPrefix(command, "ingest --catalog -t ") && strings.Contains(command, " -b .layers/") {
+			ingested++
+		}
+	}
+	if ingested != 2 {
+		t.Errorf("The layers were not ingested with cvmfs_server ingest: %q", cvmfs.Commands())
+	}
+	if report.Outcome != OutcomeConverted || report.Publish != StepDone ||
+		report.Singularity != StepSkipped || report.ReferenceIndex != StepDone ||
+		report.ThinImageDigest == "" || report.ConfigDigest != manifest.Config.Digest {
+		t.Errorf("Wrong report of the conversion: %+v", report)
+	}
+	if len(report.Layers) != 2 {
+		t.Fatalf("Wrong layers in the report: %+v", report.Layers)
+	}
+	for i, layer := range report.Layers {
+		if layer.Digest != manifest.Layers[i].Digest || layer.Status != LayerIngested {
+			t.Errorf("Wrong report of the layer: %+v", layer)
+		}
+	}
+	if cvmfs.InTransaction(testRepo) {
+		t.Errorf("Repository left in a transaction")
+	}
+	if len(*pushed) != 1 {
+		t.Fatalf("Expected one thin image pushed, got %d", len(*pushed))
+	}
+	if (*pushed)[0].name != registry.Host()+"/thin/library/test:latest" {
+		t.Errorf("Wrong name of the thin image: %s", (*pushed)[0].name)
+	}
+
+	var config thinConfig
+	if err := json.Unmarshal((*pushed)[0].config, &config); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.Config.Env, []string{"IMAGE=library/test:latest", "CVMFS_IMAGE=true"}) ||
+		!reflect.DeepEqual([]string(config.Config.Cmd), []string{"sh"}) || config.Architecture != "amd64" {
+		t.Errorf("Wrong configuration of the thin image: %s", (*pushed)[0].config)
+	}
+
+	thin := readThinImage(t, (*pushed)[0].tarball)
+	for i, layer := range thin.Layers {
+		expected := "cvmfs://" + testRepo + "/.layers/" + layer.Digest[:2] + "/" + layer.Digest + "/layerfs"
+		if layer.Digest != digestHex(manifest.Layers[i].Digest) || layer.Url != expected {
+			t.Errorf("Wrong layer in the thin image: %+v", layer)
+		}
+	}
+
+	index, err := ReadReferenceIndex(testRepo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, _ := ParseImage(testWish(registry, "library/test", "latest").InputName)
+	if digest, ok := index.ImageOfName(image.GetPlatformName()); !ok || digest != manifest.Config.Digest {
+		t.Errorf("Image not in the index: %+v", index.Images)
+	}
+	files := []string{"etc/os-release", "usr/bin/hello"}
+	for i, layer := range manifest.Layers {
+		rootfs := LayerRootfsPath(testRepo, digestHex(layer.Digest))
+		content, err := ioutil.ReadFile(filepath.Join(rootfs, files[i]))
+		if err != nil {
+			t.Errorf("Layer %s not ingested: %s", layer.Digest, err)
+		}
+		if i == 1 && string(content) != "hello" {
+			t.Errorf("Wrong content in the layer: %s", content)
+		}
+		if _, err := os.Stat(filepath.Join(rootfs, ".cvmfscatalog")); err != nil {
+			t.Errorf("Missing catalog in the layer %s", layer.Digest)
+		}
+
+		if images := index.ImagesOfLayer(layer.Digest); len(images) != 1 || images[0] != manifest.Config.Digest {
+			t.Errorf("Wrong images in the index for the layer %s: %v", layer.Digest, images)
+		}
+
+		var verification LayerVerification
+		content, err = ioutil.ReadFile(getVerificationPath(testRepo, digestHex(layer.Digest)))
+		if err != nil {
+			t.Fatalf("Missing verification of the layer: %s", err)
+		}
+		json.Unmarshal(content, &verification)
+		if !verification.Verified || verification.Digest != layer.Digest {
+			t.Errorf("Wrong verification of the layer: %+v", verification)
+		}
+	}
+
+	if AlreadyConverted(testRepo, image, manifest.Config.Digest) != ConversionMatch {
+		t.Errorf("The image should be already converted")
+	}
+
+	// converting again is a no-op
+	report, err = ConvertWish(context.Background(), testWish(registry, "library/test", "latest"), false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Outcome != OutcomeAlreadyConverted || report.Layers[0].Status != LayerSkipped {
+		t.Errorf("Wrong report of an image already converted: %+v", report)
+	}
+	if revision := cvmfs.Revision(testRepo); revision != 4 {
+		t.Errorf("An already converted image was published again")
+	}
+}
+
+func readThinImage(t *testing.T, tarball []byte) da.ThinImage {
+	reader := tar.NewReader(bytes.NewReader(tarball))
+	header, err := reader.Next()
+	if err != nil || header.Name != "thin.json" {
+		t.Fatalf("The thin image does not contain thin.json: %s", err)
+	}
+	var thin da.ThinImage
+	if err := json.NewDecoder(reader).Decode(&thin); err != nil {
+		t.Fatal(err)
+	}
+	return thin
+}
+
+func TestConvertWishCorruptedLayer(t *testing.T) {
+	cvmfs := newFakeCvmfs(t, testRepo)
+	defer cvmfs.Close()
+	registry := newFakeRegistry()
+	defer registry.Close()
+	pushed, restore := fakePush(t, registry)
+	defer restore()
+
+	manifest := registry.AddImage(t, "library/test", "latest",
+		map[string]string{"etc/os-release": "fake"})
+	registry.CorruptBlob(manifest.Layers[0].Digest)
+
+	report, err := ConvertWish(context.Background(), testWish(registry, "library/test", "latest"), false, false, false)
+	if err == nil {
+		t.Errorf("The conversion of a corrupted image should fail")
+	}
+	if report.Outcome != OutcomeFailed || report.Error == "" ||
+		len(report.Layers) != 1 || report.Layers[0].Status != LayerFailed {
+		t.Errorf("Wrong report of the failed conversion: %+v", report)
+	}
+	if len(*pushed) != 0 {
+		t.Errorf("A thin image of a corrupted image was pushed")
+	}
+	if revision := cvmfs.Revision(testRepo); revision != 0 {
+		t.Errorf("A corrupted image was published")
+	}
+	if _, err := os.Stat(LayerPath(testRepo, digestHex(manifest.Layers[0].Digest))); err == nil {
+		t.Errorf("A corrupted layer was ingested")
+	}
+}
+
+func TestConvertWishInvalidDigest(t *testing.T) {
+	cvmfs := newFakeCvmfs(t, testRepo)
+	defer cvmfs.Close()
+	registry := newFakeRegistry()
+	defer registry.Close()
+	pushed, restore := fakePush(t, registry)
+	defer restore()
+
+	layer := gzipTar(t, map[string]string{"etc/os-release": "fake"})
+	for _, digest := range []string{"sha256:../../../etc", "sha256", "md5:abcd"} {
+		registry.AddImageOfLayers(t, "library/test", "latest",
+			da.Layer{MediaType: da.MediaTypeDockerLayer, Size: len(layer), Digest: digest})
+		_, err := ConvertWish(context.Background(), testWish(registry, "library/test", "latest"), false, false, false)
+		if err == nil || !strings.Contains(err.Error(), "Invalid digest") {
+			t.Errorf("Expected an error for the layer digest %s, got: %v", digest, err)
+		}
+	}
+	if len(*pushed) != 0 || cvmfs.Revision(testRepo) != 0 {
+		t.Errorf("An image with an invalid digest was converted")
+	}
+}
+
+func TestConvertWishMissingLayer(t *testing.T) {
+	cvmfs := newFakeCvmfs(t, testRepo)
+	defer cvmfs.Close()
+	registry := newFakeRegistry()
+	defer registry.Close()
+	pushed, restore := fakePush(t, registry)
+	defer restore()
+
+	manifest := registry.AddImage(t, "library/test", "latest",
+		map[string]string{"etc/os-release": "fake"},
+		map[string]string{"usr/bin/hello": "hello"})
+	registry.StallBlob(manifest.Layers[0].Digest)
+	registry.DeleteBlob(manifest.Layers[1].Digest)
+
+	done := make(chan struct{})
+	var report ConversionReport
+	var err error
+	go func() {
+		report, err = ConvertWish(context.Background(), testWish(registry, "library/test", "latest"), false, false, false)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatalf("The download of the other layers was not canceled")
+	}
+	if err == nil {
+		t.Errorf("The conversion of an image with a missing layer should fail")
+	}
+	if len(*pushed) != 0 {
+		t.Errorf("A thin image with a missing layer was pushed")
+	}
+	if revision := cvmfs.Revision(testRepo); revision != 0 {
+		t.Errorf("An incomplete image was published")
+	}
+	if len(report.Layers) != 2 || report.Layers[0].Status != LayerFailed ||
+		report.Layers[1].Status != LayerFailed || !strings.Contains(report.Layers[1].Error, "404") {
+		t.Errorf("Wrong report of the layers: %+v", report.Layers)
+	}
+}
+
+func TestConvertWishCanceled(t *testing.T) {
+	cvmfs := newFakeCvmfs(t, testRepo)
+	defer cvmfs.Close()
+	registry := newFakeRegistry()
+	defer registry.Close()
+	pushed, restore := fakePush(t, registry)
+	defer restore()
+
+	manifest := registry.AddImage(t, "library/test", "latest",
+		map[string]string{"etc/os-release": "fake"})
+	registry.StallBlob(manifest.Layers[0].Digest)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	done := make(chan struct{})
+	var report ConversionReport
+	var err error
+	go func() {
+		report, err = ConvertWish(ctx, testWish(registry, "library/test", "latest"), false, false, false)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatalf("The conversion was not canceled")
+	}
+	if err == nil || report.Outcome != OutcomeCanceled {
+		t.Errorf("Wrong outcome of the canceled conversion: %s, %v", report.Outcome, err)
+	}
+	if len(*pushed) != 0 {
+		t.Errorf("The thin image of a canceled conversion was pushed")
+	}
+	if cvmfs.Revision(testRepo) != 0 || cvmfs.InTransaction(testRepo) {
+		t.Errorf("The canceled conversion touched the repository")
+	}
+}
+
+func TestConvertWishFailedPublish(t *testing.T) {
+	cvmfs := newFakeCvmfs(t, testRepo)
+	defer cvmfs.Close()
+	registry := newFakeRegistry()
+	defer registry.Close()
+	pushed, restore := fakePush(t, registry)
+	defer restore()
+
+	manifest := registry.AddImage(t, "library/test", "latest",
+		map[string]string{"etc/os-release": "fake"})
+	cvmfs.FailPublish(testRepo)
+
+	report, err := ConvertWish(context.Background(), testWish(registry, "library/test", "latest"), false, false, false)
+	if err == nil {
+		t.Errorf("The conversion should fail when the publish fails")
+	}
+	// the layer is ingested with its own publish, what refers to it is not
+	if report.Publish != StepFailed || report.Layers[0].Status != LayerIngested {
+		t.Errorf("Wrong report of the failed publish: %+v", report)
+	}
+	if cvmfs.InTransaction(testRepo) {
+		t.Errorf("The transaction was not aborted")
+	}
+	if _, err := os.Stat(getVerificationPath(testRepo, digestHex(manifest.Layers[0].Digest))); err == nil {
+		t.Errorf("The abort did not roll back the verification of the layer")
+	}
+	if len(*pushed) != 0 {
+		t.Errorf("The thin image was pushed without its layers in the repository")
+	}
+}
+
+func TestConvertWishFailedPush(t *testing.T) {
+	cvmfs := newFakeCvmfs(t, testRepo)
+	defer cvmfs.Close()
+	registry := newFakeRegistry()
+	defer registry.Close()
+	_, restore := fakePush(t, registry)
+	defer restore()
+	pushThinImage = func(Image, Credentials, []byte, []byte) (string, error) {
+		return "", fmt.Errorf("registry not available")
+	}
+
+	manifest := registry.AddImage(t, "library/test", "latest",
+		map[string]string{"etc/os-release": "fake"})
+	wish := testWish(registry, "library/test", "latest")
+	report, err := ConvertWish(context.Background(), wish, false, false, false)
+	if err == nil || report.Publish == StepDone {
+		t.Errorf("The conversion should fail when the push fails: %+v", report)
+	}
+
+	// the layers are published, the image is not recorded as converted
+	if cvmfs.Revision(testRepo) != 2 || report.Layers[0].Status != LayerIngested {
+		t.Errorf("The layers were not published before the push: %+v", report.Layers)
+	}
+	image, _ := ParseImage(wish.InputName)
+	if AlreadyConverted(testRepo, image, manifest.Config.Digest) != ConversionNotFound {
+		t.Errorf("An image not pushed is recorded as converted")
+	}
+}
+
+func TestConvertWishLayerRemoved(t *testing.T) {
+	cvmfs := newFakeCvmfs(t, testRepo)
+	defer cvmfs.Close()
+	registry := newFakeRegistry()
+	defer registry.Close()
+	pushed, restore := fakePush(t, registry)
+	defer restore()
+
+	first := registry.AddImage(t, "library/first", "latest", map[string]string{"shared": "shared"})
+	if _, err := ConvertWish(context.Background(), testWish(registry, "library/first", "latest"), false, false, false); err != nil {
+		t.Fatal(err)
+	}
+	shared := first.Layers[0]
+
+	// the shared layer is removed, as the garbage collection would do, while
+	// the other layer is downloaded
+	other := gzipTar(t, map[string]string{"other": "other"})
+	otherDigest := sha256Digest(other)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		os.RemoveAll(LayerPath(testRepo, digestHex(shared.Digest)))
+		w.Write(other)
+	}))
+	defer server.Close()
+	registry.AddImageOfLayers(t, "library/second", "latest", shared,
+		da.Layer{MediaType: da.MediaTypeDockerForeignLayer, Size: len(other), Digest: otherDigest,
+			URLs: []string{server.URL + "/layers/" + otherDigest}})
+
+	wish := testWish(registry, "library/second", "latest")
+	if _, err := ConvertWish(context.Background(), wish, false, false, false); err == nil {
+		t.Errorf("The conversion should fail when a layer is removed")
+	}
+	image, _ := ParseImage(wish.InputName)
+	if AlreadyConverted(testRepo, image, "") != ConversionNotFound || len(*pushed) != 1 {
+		t.Errorf("The conversion without the layer was published or pushed")
+	}
+
+	// the next conversion downloads the layer again
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(other)
+	})
+	report, err := ConvertWish(context.Background(), wish, false, false, false)
+	if err != nil || report.Layers[0].Status != LayerIngested || len(*pushed) != 2 {
+		t.Fatalf("Wrong conversion after the removal of the layer: %+v, %v", report, err)
+	}
+	if _, err := os.Stat(filepath.Join(LayerRootfsPath(testRepo, digestHex(shared.Digest)), "shared")); err != nil {
+		t.Errorf("The removed layer was not ingested again: %s", err)
+	}
+}
+
+func TestConvertWishesConcurrently(t *testing.T) {
+	cvmfs := newFakeCvmfs(t, testRepo)
+	defer cvmfs.Close()
+	registry := newFakeRegistry()
+	defer registry.Close()
+	pushed, restore := fakePush(t, registry)
+	defer restore()
+
+	first := registry.AddImage(t, "library/first", "latest",
+		map[string]string{"shared": "shared"}, map[string]string{"first": "first"})
+	second := registry.AddImage(t, "library/second", "latest",
+		map[string]string{"shared": "shared"}, map[string]string{"second": "second"})
+	shared := first.Layers[0].Digest
+	if second.Layers[0].Digest != shared {
+		t.Fatalf("The images do not share the first layer")
+	}
+	wishes := []WishFriendly{
+		testWish(registry, "library/first", "latest"),
+		testWish(registry, "library/second", "latest")}
+
+	// the fake cvmfs_server fails when a transaction or an ingestion
+	// overlaps with another one
+	reports, stopped := ConvertWishes(context.Background(), wishes, 2,
+		func(ctx context.Context, wish WishFriendly) ConversionReport {
+			report, _ := ConvertWish(ctx, wish, false, false, false)
+			return report
+		})
+	if stopped || len(reports) != 2 || len(*pushed) != 2 {
+		t.Fatalf("Wrong conversions: %+v", reports)
+	}
+	for i, report := range reports {
+		if report.InputImage != wishes[i].InputName || report.Outcome != OutcomeConverted {
+			t.Errorf("Wrong report of the conversion: %+v", report)
+		}
+	}
+	if cvmfs.InTransaction(testRepo) {
+		t.Errorf("A transaction was left open")
+	}
+
+	sharedPath := TrimCVMFSRepoPrefix(testRepo, LayerRootfsPath(testRepo, digestHex(shared)))
+	ingested := 0
+	for _, command := range cvmfs.Commands() {
+		if strings.HasPrefix(command, "ingest ") && strings.Contains(command, " -b "+sharedPath+" ") {
+			ingested++
+		}
+	}
+	if ingested != 1 {
+		t.Errorf("The shared layer was ingested %d times: %q", ingested, cvmfs.Commands())
+	}
+	if _, err := os.Stat(filepath.Join(LayerRootfsPath(testRepo, digestHex(shared)), "shared")); err != nil {
+		t.Errorf("The shared layer is not in the repository: %s", err)
+	}
+}
+
+func TestConvertWishManifestList(t *testing.T) {
+	cvmfs := newFakeCvmfs(t, testRepo)
+	defer cvmfs.Close()
+	registry := newFakeRegistry()
+	defer registry.Close()
+	pushed, restore := fakePush(t, registry)
+	defer restore()
+
+	images := map[string]da.Manifest{
+		"linux/amd64": registry.AddImage(t, "library/multi", "amd64", map[string]string{"arch": "amd64"}),
+		"linux/arm64": registry.AddImage(t, "library/multi", "arm64", map[string]string{"arch": "arm64"}),
+	}
+	// both kinds of lists, as the registries serve them
+	lists := map[string]string{
+		"index": da.MediaTypeOCIIndex,
+		"list":  da.MediaTypeDockerManifestList}
+	for tag, mediaType := range lists {
+		index := fmt.Sprintf(`{"schemaVersion": 2, "mediaType": "%s", "manifests": [`, mediaType)
+		for _, platform := range []string{"linux/amd64", "linux/arm64"} {
+			content, _ := json.Marshal(images[platform])
+			p, _ := da.ParsePlatform(platform)
+			index += fmt.Sprintf(`{"mediaType": "%s", "size": %d, "digest": "%s", "platform": {"os": "%s", "architecture": "%s"}},`,
+				da.MediaTypeDockerManifest, len(content), sha256Digest(content), p.OS, p.Architecture)
+		}
+		registry.AddManifest("library/multi", tag, mediaType, []byte(strings.TrimSuffix(index, ",")+"]}"))
+	}
+
+	for tag := range lists {
+		for platform, manifest := range images {
+			wish := testWish(registry, "library/multi", tag)
+			wish.Platform = platform
+			wish.OutputName += "-" + platformTag(platform)
+			requests := len(registry.Requests())
+			report, err := ConvertWish(context.Background(), wish, false, false, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the list and the manifest of the platform, once for the whole
+			// conversion
+			fetched := 0
+			for _, request := range registry.Requests()[requests:] {
+				if strings.HasPrefix(request, "GET /v2/library/multi/manifests/") {
+					fetched++
+				}
+			}
+			if fetched != 2 {
+				t.Errorf("Manifest of %s from the %s fetched %d times", platform, tag, fetched)
+			}
+			if report.ConfigDigest != manifest.Config.Digest {
+				t.Errorf("Wrong manifest selected for %s from the %s: %+v", platform, tag, report)
+			}
+
+			image, _ := ParseImage(wish.InputName)
+			image.Platform = platform
+			if !strings.HasSuffix(image.GetPlatformName(), "+"+platformTag(platform)) {
+				t.Errorf("Wrong name of the image of the platform: %s", image.GetPlatformName())
+			}
+			if AlreadyConverted(testRepo, image, manifest.Config.Digest) != ConversionMatch {
+				t.Errorf("No manifest in .metadata for %s", image.GetPlatformName())
+			}
+			layer := LayerRootfsPath(testRepo, digestHex(manifest.Layers[0].Digest))
+			if content, _ := ioutil.ReadFile(filepath.Join(layer, "arch")); string(content) != strings.Split(platform, "/")[1] {
+				t.Errorf("Wrong layer ingested for %s: %s", platform, content)
+			}
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, image := range *pushed {
+		names[image.name] = true
+	}
+	for tag := range lists {
+		for _, platform := range []string{"linux-amd64", "linux-arm64"} {
+			name := registry.Host() + "/thin/library/multi:" + tag + "-" + platform
+			if !names[name] {
+				t.Errorf("Thin image %s not pushed, pushed: %v", name, names)
+			}
+		}
+	}
+}
+
+func TestConvertWishLayerMediaTypes(t *testing.T) {
+	cvmfs := newFakeCvmfs(t, testRepo)
+	defer cvmfs.Close()
+	registry := newFakeRegistry()
+	defer registry.Close()
+	_, restore := fakePush(t, registry)
+	defer restore()
+
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zstdLayer := encoder.EncodeAll(plainTar(t, map[string]string{"zstd": "zstd"}), nil)
+	plainLayer := plainTar(t, map[string]string{"plain": "plain"})
+	foreignLayer := gzipTar(t, map[string]string{"foreign": "foreign"})
+	foreignDigest := sha256Digest(foreignLayer)
+
+	// the foreign layers are not in the registry, they are downloaded from
+	// their URLs, without the token of the registry
+	var foreignRequests []*http.Request
+	foreign := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		foreignRequests = append(foreignRequests, req)
+		w.Write(foreignLayer)
+	}))
+	defer foreign.Close()
+
+	manifest := registry.AddImageOfLayers(t, "library/test", "latest",
+		da.Layer{MediaType: da.MediaTypeOCILayerZstd, Size: len(zstdLayer), Digest: registry.AddBlob(zstdLayer)},
+		da.Layer{MediaType: da.MediaTypeOCILayer, Size: len(plainLayer), Digest: registry.AddBlob(plainLayer)},
+		da.Layer{MediaType: da.MediaTypeDockerForeignLayer, Size: len(foreignLayer), Digest: foreignDigest,
+			URLs: []string{foreign.URL + "/layers/" + foreignDigest}})
+
+	if _, err := ConvertWish(context.Background(), testWish(registry, "library/test", "latest"), false, false, false); err != nil {
+		t.Fatal(err)
+	}
+	for i, file := range []string{"zstd", "plain", "foreign"} {
+		digest := digestHex(manifest.Layers[i].Digest)
+		content, err := ioutil.ReadFile(filepath.Join(LayerRootfsPath(testRepo, digest), file))
+		if err != nil || string(content) != file {
+			t.Errorf("Wrong content of the %s layer: %s, %v", manifest.Layers[i].MediaType, content, err)
+		}
+		var verification LayerVerification
+		content, _ = ioutil.ReadFile(getVerificationPath(testRepo, digest))
+		json.Unmarshal(content, &verification)
+		if !verification.Verified || verification.Size != int64(manifest.Layers[i].Size) {
+			t.Errorf("Wrong verification of the %s layer: %+v", manifest.Layers[i].MediaType, verification)
+		}
+	}
+	if len(foreignRequests) != 1 || foreignRequests[0].Header.Get("Authorization") != "" {
+		t.Errorf("Wrong requests for the foreign layer: %v", foreignRequests)
+	}
+	for _, request := range registry.Requests() {
+		if strings.Contains(request, foreignDigest) {
+			t.Errorf("The foreign layer was asked to the registry: %s", request)
+		}
+	}
+}
+
+func TestAlreadyConverted(t *testing.T) {
+	cvmfs := newFakeCvmfs(t, testRepo)
+	defer cvmfs.Close()
+
+	image, err := ParseImage("https://registry.example.ch/library/test:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if AlreadyConverted(testRepo, image, "sha256:aaaa") != ConversionNotFound {
+		t.Errorf("Image without manifest should not be converted")
+	}
+
+	manifest := da.Manifest{
+		SchemaVersion: 2,
+		MediaType:     da.MediaTypeDockerManifest,
+		Config:        da.ConfigType{Digest: "sha256:aaaa"}}
+	content, _ := json.Marshal(manifest)
+	path := cvmfs.Path(testRepo, ".metadata", image.GetPlatformName(), "manifest.json")
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if AlreadyConverted(testRepo, image, "sha256:aaaa") != ConversionMatch {
+		t.Errorf("Image with the same configuration should be converted")
+	}
+	if AlreadyConverted(testRepo, image, "sha256:bbbb") != ConversionNotMatch {
+		t.Errorf("Image with a different configuration should not match")
+	}
+
+	manifest.MediaType = "application/vnd.example.unknown"
+	content, _ = json.Marshal(manifest)
+	ioutil.WriteFile(path, content, 0644)
+	if AlreadyConverted(testRepo, image, "sha256:aaaa") != ConversionNotFound {
+		t.Errorf("Manifest of unknown type should be ignored")
+	}
+}
@@ -0,0 +1,296 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The credentials to access a registry are looked up, for each registry, in
+// this order:
+//
+// 1. the environment variable referenced by the wish (input_credentials or
+//    output_credentials in the recipe), with the user of the wish
+// 2. the docker configuration file, ~/.docker/config.json or
+//    $DOCKER_CONFIG/config.json: the `auths` entries, the credential helper
+//    of the registry (`credHelpers`) or the default one (`credsStore`)
+// 3. the DOCKER2CVMFS_DOCKER_REGISTRY_PASS environment variable, with the
+//    user of the wish, only for the registry in DOCKER2CVMFS_DOCKER_REGISTRY
+//    or, when it is not set, only for the output registry of the wish, where
+//    the thin images are pushed
+//
+// if nothing is found the registry is accessed anonymously.
+
+// the registry the password in DOCKER2CVMFS_DOCKER_REGISTRY_PASS belongs to,
+// without it the password is sent only to the output registries
+const defaultPasswordRegistryVariable = "DOCKER2CVMFS_DOCKER_REGISTRY"
+
+type Credentials struct {
+	Username string
+	Password string
+	// OAuth refresh token, used instead of the password to get the bearer
+	// token
+	IdentityToken string
+	// bearer token to use directly against the registry
+	RegistryToken string
+}
+
+func (c Credentials) IsAnonymous() bool {
+	return c.Password == "" && c.IdentityToken == "" && c.RegistryToken == ""
+}
+
+// the subset of the docker configuration file we care about
+type dockerConfig struct {
+	Auths       map[string]dockerAuthEntry `json:"auths"`
+	CredsStore  string                     `json:"credsStore"`
+	CredHelpers map[string]string          `json:"credHelpers"`
+}
+
+type dockerAuthEntry struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+	RegistryToken string `json:"registrytoken"`
+}
+
+var (
+	dockerConfigLock sync.Mutex
+	dockerConfigPath string
+)
+
+// use the docker configuration file in path instead of the default one
+func SetDockerConfigPath(path string) {
+	dockerConfigLock.Lock()
+	defer dockerConfigLock.Unlock()
+	dockerConfigPath = path
+}
+
+func getDockerConfigPath() string {
+	dockerConfigLock.Lock()
+	defer dockerConfigLock.Unlock()
+	if dockerConfigPath != "" {
+		return dockerConfigPath
+	}
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+// the configuration is read every time, so the loop picks up changes without
+// restarting, a missing file is an empty configuration
+func readDockerConfig() (dockerConfig, error) {
+	var config dockerConfig
+	path := getDockerConfigPath()
+	if path == "" {
+		return config, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(content, &config)
+	if err != nil {
+		return config, fmt.Errorf("Error in parsing the docker configuration %s: %s", path, err)
+	}
+	return config, nil
+}
+
+// the docker hub is known under several names, but its credentials are
+// stored under the name of the old index
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+func normalizeRegistry(registry string) string {
+	if u, err := url.Parse(registry); err == nil && u.Host != "" {
+		registry = u.Host
+	}
+	registry = strings.SplitN(registry, "/", 2)[0]
+	switch registry {
+	case "docker.io", "index.docker.io", "registry.hub.docker.com", "registry-1.docker.io":
+		return "index.docker.io"
+	}
+	return registry
+}
+
+func helperServerName(registry string) string {
+	if normalizeRegistry(registry) == "index.docker.io" {
+		return dockerHubAuthKey
+	}
+	return registry
+}
+
+// look up the credentials of the registry in the docker configuration, the
+// boolean is false if there are none
+func (config dockerConfig) credentialsFor(registry string) (Credentials, bool, error) {
+	registry = normalizeRegistry(registry)
+
+	helper := config.CredsStore
+	for key, h := range config.CredHelpers {
+		if normalizeRegistry(key) == registry {
+			helper = h
+		}
+	}
+	if helper != "" {
+		credentials, found, err := credentialsFromHelper(helper, helperServerName(registry))
+		if err != nil || found {
+			return credentials, found, err
+		}
+	}
+
+	for key, entry := range config.Auths {
+		if normalizeRegistry(key) != registry {
+			continue
+		}
+		credentials := Credentials{
+			Username:      entry.Username,
+			Password:      entry.Password,
+			IdentityToken: entry.IdentityToken,
+			RegistryToken: entry.RegistryToken}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return Credentials{}, false, fmt.Errorf("Wrong auth entry for %s: %s", key, err)
+			}
+			userPass := strings.SplitN(string(decoded), ":", 2)
+			if len(userPass) != 2 {
+				return Credentials{}, false, fmt.Errorf("Wrong auth entry for %s", key)
+			}
+			credentials.Username = userPass[0]
+			credentials.Password = userPass[1]
+		}
+		if credentials.IsAnonymous() {
+			continue
+		}
+		return credentials, true, nil
+	}
+	return Credentials{}, false, nil
+}
+
+// the protocol of the docker credential helpers: we run
+// `docker-credential-$helper get`, write the server on the standard input
+// and read back a json with Username and Secret
+func credentialsFromHelper(helper, server string) (Credentials, bool, error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		message := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(message, "credentials not found") {
+			return Credentials{}, false, nil
+		}
+		return Credentials{}, false, fmt.Errorf("Error from the credential helper %s: %s %s", helper, err, message)
+	}
+	var response struct {
+		Username string
+		Secret   string
+	}
+	err = json.Unmarshal(stdout.Bytes(), &response)
+	if err != nil {
+		return Credentials{}, false, fmt.Errorf("Wrong answer from the credential helper %s: %s", helper, err)
+	}
+	// the helpers store identity tokens with this special username
+	if response.Username == "<token>" {
+		return Credentials{IdentityToken: response.Secret}, true, nil
+	}
+	return Credentials{Username: response.Username, Password: response.Secret}, true, nil
+}
+
+// the credentials to use with the registry, user and reference come from the
+// wish, see the top of the file for the order of the lookup
+func GetCredentials(registry, user, reference string) (Credentials, error) {
+	return getCredentials(registry, user, reference, false)
+}
+
+// as GetCredentials, for the output registry of the wish, where the thin
+// images are pushed
+func GetOutputCredentials(registry, user, reference string) (Credentials, error) {
+	return getCredentials(registry, user, reference, true)
+}
+
+func getCredentials(registry, user, reference string, output bool) (Credentials, error) {
+	llog := func(l *log.Entry) *log.Entry {
+		return l.WithFields(log.Fields{"action": "get credentials",
+			"registry": registry,
+			"user":     user})
+	}
+	if reference != "" {
+		password, err := getPassword(reference)
+		if err != nil {
+			llog(LogE(err)).Error("Error in reading the credentials of the wish")
+			return Credentials{}, err
+		}
+		return Credentials{Username: user, Password: password}, nil
+	}
+
+	config, err := readDockerConfig()
+	if err != nil {
+		llog(LogE(err)).Warning("Error in reading the docker configuration, ignoring it")
+	} else {
+		credentials, found, err := config.credentialsFor(registry)
+		if err != nil {
+			llog(LogE(err)).Warning("Error in reading the credentials from the docker configuration")
+		}
+		if found {
+			if user != "" && credentials.Username != "" && credentials.Username != user {
+				llog(Log()).WithFields(log.Fields{"configured user": credentials.Username}).Warning(
+					"The docker configuration has credentials for a different user, ignoring them")
+			} else {
+				return credentials, nil
+			}
+		}
+	}
+
+	password, err := getPassword("")
+	if err != nil {
+		return Credentials{}, nil
+	}
+	passwordRegistry := os.Getenv(defaultPasswordRegistryVariable)
+	if passwordRegistry == "" {
+		if !output {
+			llog(Log()).Debug(fmt.Sprintf("%s is set without %s, using it only for the output registries",
+				defaultPasswordVariable, defaultPasswordRegistryVariable))
+			return Credentials{}, nil
+		}
+		return Credentials{Username: user, Password: password}, nil
+	}
+	if normalizeRegistry(passwordRegistry) != normalizeRegistry(registry) {
+		return Credentials{}, nil
+	}
+	return Credentials{Username: user, Password: password}, nil
+}
+
+// the credentials of the image, anonymous if there are none
+func (img Image) GetCredentials() Credentials {
+	credentials, err := GetCredentials(img.Registry, img.User, img.Credentials)
+	if err != nil {
+		LogE(err).WithFields(log.Fields{"registry": img.Registry}).Warning(
+			"Unable to retrieve the credentials, trying anonymously.")
+		return Credentials{}
+	}
+	if credentials.IsAnonymous() {
+		Log().WithFields(log.Fields{"registry": img.Registry}).Info(
+			"No credentials for the registry, trying anonymously.")
+	}
+	return credentials
+}
@@ -0,0 +1,156 @@
+package lib
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestGetCredentialsFromDockerConfig(t *testing.T) {
+	auth := base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+	config := fmt.Sprintf(`{
+	"auths": {
+		"https://registry.example.ch/v2/": {"auth": "%s"},
+		"https://index.docker.io/v1/": {"username": "bob", "password": "hub"},
+		"tokens.example.ch": {"registrytoken": "bearer"}
+	},
+	"credHelpers": {"helped.example.ch": "fake"}
+}`, auth)
+	defer fakeDockerConfig(t, config, map[string][2]string{
+		"helped.example.ch": {"<token>", "identity"},
+	})()
+
+	for _, test := range []struct {
+		registry, user string
+		expected       Credentials
+	}{
+		{"registry.example.ch", "", Credentials{Username: "alice", Password: "secret"}},
+		{"registry.example.ch", "alice", Credentials{Username: "alice", Password: "secret"}},
+		{"registry.hub.docker.com", "", Credentials{Username: "bob", Password: "hub"}},
+		{"docker.io", "", Credentials{Username: "bob", Password: "hub"}},
+		{"tokens.example.ch", "", Credentials{RegistryToken: "bearer"}},
+		{"helped.example.ch", "", Credentials{IdentityToken: "identity"}},
+		{"unknown.example.ch", "", Credentials{}},
+		// credentials of another user are not used
+		{"registry.example.ch", "carol", Credentials{}},
+	} {
+		credentials, err := GetCredentials(test.registry, test.user, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if credentials != test.expected {
+			t.Errorf("Wrong credentials for %s: %+v, expected %+v", test.registry, credentials, test.expected)
+		}
+	}
+
+	// the reference of the wish wins over the configuration
+	os.Setenv("TEST_CREDENTIALS_PASSWORD", "from-env")
+	defer os.Unsetenv("TEST_CREDENTIALS_PASSWORD")
+	credentials, err := GetCredentials("registry.example.ch", "dave", "TEST_CREDENTIALS_PASSWORD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credentials != (Credentials{Username: "dave", Password: "from-env"}) {
+		t.Errorf("Wrong credentials from the reference: %+v", credentials)
+	}
+	if _, err := GetCredentials("registry.example.ch", "dave", "TEST_CREDENTIALS_MISSING"); err == nil {
+		t.Errorf("Expected an error for a reference to a missing variable")
+	}
+}
+
+func TestGetCredentialsFromPasswordVariable(t *testing.T) {
+	defer fakeDockerConfig(t, `{}`, nil)()
+	defer setenv(defaultPasswordVariable, "password")()
+
+	// without the registry the password is sent only to the output registry
+	defer setenv(defaultPasswordRegistryVariable, "")()
+	credentials, err := GetCredentials("registry.example.ch", "dave", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credentials != (Credentials{}) {
+		t.Errorf("Password sent to an input registry without a registry: %+v", credentials)
+	}
+	credentials, err = GetOutputCredentials("registry.example.ch", "dave", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credentials != (Credentials{Username: "dave", Password: "password"}) {
+		t.Errorf("Password not sent to the output registry: %+v", credentials)
+	}
+
+	os.Setenv(defaultPasswordRegistryVariable, "https://registry.example.ch/")
+	for _, test := range []struct {
+		registry string
+		expected Credentials
+	}{
+		{"registry.example.ch", Credentials{Username: "dave", Password: "password"}},
+		{"other.example.ch", Credentials{}},
+		{"docker.io", Credentials{}},
+	} {
+		// with the registry only that one gets it, also as output
+		credentials, err := GetOutputCredentials(test.registry, "dave", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if credentials != test.expected {
+			t.Errorf("Wrong credentials for %s: %+v, expected %+v", test.registry, credentials, test.expected)
+		}
+	}
+}
+
+func TestCredentialHelperNotFound(t *testing.T) {
+	defer fakeDockerConfig(t, `{
+	"credsStore": "fake",
+	"auths": {"registry.example.ch": {"username": "alice", "password": "secret"}}
+}`, map[string][2]string{
+		"https://index.docker.io/v1/": {"bob", "hub"},
+	})()
+
+	// the docker hub credentials are stored under the name of the old index
+	credentials, err := GetCredentials("registry-1.docker.io", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credentials != (Credentials{Username: "bob", Password: "hub"}) {
+		t.Errorf("Wrong credentials from the helper: %+v", credentials)
+	}
+
+	// nothing in the helper, we fall back to the auths
+	credentials, err = GetCredentials("registry.example.ch", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credentials != (Credentials{Username: "alice", Password: "secret"}) {
+		t.Errorf("Wrong credentials from the auths: %+v", credentials)
+	}
+}
+
+func TestGetManifestWithCredentials(t *testing.T) {
+	registry := newFakeRegistry()
+	defer registry.Close()
+	registry.AddImage(t, "library/private", "latest", map[string]string{"file": "content"})
+	image, err := ParseImage("http://" + registry.Host() + "/library/private:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registry.RequireLogin("alice", "secret", "")
+	if _, err := image.GetManifest(); err == nil {
+		t.Fatal("Expected an error getting the manifest anonymously")
+	}
+	auth := base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+	restore := fakeDockerConfig(t, fmt.Sprintf(`{"auths": {"%s": {"auth": "%s"}}}`, registry.Host(), auth), nil)
+	if _, err := image.GetManifest(); err != nil {
+		t.Errorf("Error getting the manifest with the docker configuration: %s", err)
+	}
+	restore()
+
+	registry.RequireLogin("", "", "identity")
+	defer fakeDockerConfig(t, fmt.Sprintf(`{"credHelpers": {"%s": "fake"}}`, registry.Host()),
+		map[string][2]string{registry.Host(): {"<token>", "identity"}})()
+	if _, err := image.GetManifest(); err != nil {
+		t.Errorf("Error getting the manifest with the identity token: %s", err)
+	}
+}
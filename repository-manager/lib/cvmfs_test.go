@@ -0,0 +1,45 @@
+package lib
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func TestCommitCanceled(t *testing.T) {
+	cvmfs := newFakeCvmfs(t, testRepo)
+	defer cvmfs.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	transaction := NewTransaction(testRepo)
+	transaction.WriteFile("first", []byte("first"))
+	transaction.UpdateFile("second", func(current []byte) ([]byte, error) {
+		// canceled while applying an operation, the operation completes
+		cancel()
+		return []byte("second"), nil
+	})
+	transaction.WriteFile("third", []byte("third"))
+
+	if err := transaction.Commit(ctx); err != context.Canceled {
+		t.Errorf("Expected the commit to be canceled, got: %v", err)
+	}
+	if cvmfs.InTransaction(testRepo) {
+		t.Errorf("The transaction was not aborted")
+	}
+	if revision := cvmfs.Revision(testRepo); revision != 0 {
+		t.Errorf("The canceled transaction was published")
+	}
+	for _, name := range []string{"first", "second", "third"} {
+		if _, err := os.Stat(cvmfs.Path(testRepo, name)); err == nil {
+			t.Errorf("The abort did not roll back %s", name)
+		}
+	}
+	if len(openTransactions.transactions) != 0 {
+		t.Errorf("The aborted transaction is still open")
+	}
+
+	// a context canceled before the commit does not even open the transaction
+	if err := transaction.Commit(ctx); err != context.Canceled {
+		t.Errorf("Expected the commit to be canceled, got: %v", err)
+	}
+}
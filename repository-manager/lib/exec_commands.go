@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -15,9 +16,10 @@ type execCmd struct {
 	out io.ReadCloser
 }
 
-func ExecCommand(input ...string) *execCmd {
+// the command is killed if ctx is canceled before it finishes
+func ExecCommand(ctx context.Context, input ...string) *execCmd {
 	Log().WithFields(log.Fields{"action": "executing"}).Info(input)
-	cmd := exec.Command(input[0], input[1:]...)
+	cmd := exec.CommandContext(ctx, input[0], input[1:]...)
 	stdout, errOUT := cmd.StdoutPipe()
 	if errOUT != nil {
 		LogE(errOUT).Warning("Impossible to obtain the STDOUT pipe")
@@ -0,0 +1,315 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// fsck checks that a repository is coherent: every image in .metadata has all
+// its layers, every layer has its catalog, the reference index matches the
+// manifests, the singularity symlinks point to existing singularity images
+// and, on request, that the content of the layers is still the one we
+// ingested. What can be repaired is repaired in a single transaction, a layer
+// missing or corrupted is removed together with the manifests of the images
+// that use it, so that the next conversion converts them again.
+
+type ProblemKind string
+
+const (
+	ProblemUnreadableManifest ProblemKind = "unreadable-manifest"
+	ProblemMissingLayer       ProblemKind = "missing-layer"
+	ProblemMissingCatalog     ProblemKind = "missing-catalog"
+	ProblemReferenceIndex     ProblemKind = "reference-index"
+	ProblemDanglingSymlink    ProblemKind = "dangling-symlink"
+	ProblemLayerContent       ProblemKind = "layer-content"
+)
+
+type Problem struct {
+	Kind ProblemKind `json:"kind"`
+	// relative to the root of the repository
+	Path   string `json:"path"`
+	Image  string `json:"image,omitempty"`
+	Layer  string `json:"layer,omitempty"`
+	Detail string `json:"detail,omitempty"`
+	// false if the problem can not be repaired
+	Repairable bool `json:"repairable"`
+	Repaired   bool `json:"repaired"`
+}
+
+type FsckOptions struct {
+	Repair bool
+	// hash again the files of the layers that have a file list
+	VerifyContent bool
+}
+
+type FsckReport struct {
+	Repository string    `json:"repository"`
+	Checked    time.Time `json:"checked"`
+	Images     int       `json:"images"`
+	Layers     int       `json:"layers"`
+	// the layers without a file list, ingested by older versions, are not
+	// verified
+	Unverified int       `json:"unverified_layers,omitempty"`
+	Problems   []Problem `json:"problems"`
+}
+
+// true if some problems are still there
+func (r FsckReport) Unrepaired() bool {
+	for _, problem := range r.Problems {
+		if !problem.Repaired {
+			return true
+		}
+	}
+	return false
+}
+
+// how many differences of the content of a layer go in the detail
+const maxDifferences = 5
+
+func checkRepository(CVMFSRepo string, options FsckOptions) (report FsckReport, err error) {
+	report = FsckReport{Repository: CVMFSRepo, Checked: time.Now(), Problems: []Problem{}}
+	problem := func(p Problem) {
+		report.Problems = append(report.Problems, p)
+	}
+
+	manifests, err := storedManifests(CVMFSRepo)
+	if err != nil {
+		// nothing else can be trusted without all the manifests
+		problem(Problem{Kind: ProblemUnreadableManifest, Path: ".metadata", Detail: err.Error()})
+		return report, nil
+	}
+	report.Images = len(manifests)
+	names := make([]string, 0, len(manifests))
+	for name := range manifests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// the digests, with their algorithm, of the layers used by the images
+	layerDigests := make(map[string]string)
+	for _, name := range names {
+		for _, layer := range manifests[name].Layers {
+			hex := withoutAlgorithm(layer.Digest)
+			layerDigests[hex] = layer.Digest
+			if len(hex) < 2 {
+				problem(Problem{Kind: ProblemUnreadableManifest, Path: filepath.Join(".metadata", name, "manifest.json"),
+					Image: name, Layer: layer.Digest, Detail: "wrong digest of the layer"})
+				continue
+			}
+			if _, err := os.Stat(LayerRootfsPath(CVMFSRepo, hex)); err != nil {
+				problem(Problem{Kind: ProblemMissingLayer, Path: TrimCVMFSRepoPrefix(CVMFSRepo, LayerRootfsPath(CVMFSRepo, hex)),
+					Image: name, Layer: layer.Digest, Repairable: true})
+			}
+		}
+	}
+
+	prefixes, _ := ioutil.ReadDir(RepositoryPath(CVMFSRepo, subDirInsideRepo))
+	for _, prefix := range prefixes {
+		if !prefix.IsDir() || len(prefix.Name()) != 2 {
+			continue
+		}
+		layers, err := ioutil.ReadDir(RepositoryPath(CVMFSRepo, subDirInsideRepo, prefix.Name()))
+		if err != nil {
+			return report, err
+		}
+		catalogs := []string{filepath.Join(subDirInsideRepo, prefix.Name())}
+		for _, layer := range layers {
+			if !layer.IsDir() || !strings.HasPrefix(layer.Name(), prefix.Name()) {
+				continue
+			}
+			report.Layers++
+			rootfs := TrimCVMFSRepoPrefix(CVMFSRepo, LayerRootfsPath(CVMFSRepo, layer.Name()))
+			if _, err := os.Stat(RepositoryPath(CVMFSRepo, rootfs)); err != nil {
+				// reported with the images using it, if any
+				continue
+			}
+			catalogs = append(catalogs, rootfs)
+			if options.VerifyContent {
+				p, verified, err := checkLayerContent(CVMFSRepo, layer.Name(), layerDigests[layer.Name()])
+				if err != nil {
+					return report, err
+				}
+				if p != nil {
+					problem(*p)
+				}
+				if !verified {
+					report.Unverified++
+				}
+			}
+		}
+		for _, catalog := range catalogs {
+			stat, err := os.Lstat(RepositoryPath(CVMFSRepo, catalog, ".cvmfscatalog"))
+			if err != nil || !stat.Mode().IsRegular() {
+				problem(Problem{Kind: ProblemMissingCatalog, Path: filepath.Join(catalog, ".cvmfscatalog"),
+					Repairable: err != nil})
+			}
+		}
+	}
+
+	_, current, rebuilt, err := rebuiltReferenceIndex(CVMFSRepo)
+	if err != nil {
+		return report, err
+	}
+	if !bytes.Equal(current, rebuilt) {
+		detail := "not consistent with the manifests"
+		if current == nil {
+			detail = "missing"
+		} else if _, err := unmarshalReferenceIndex(current); err != nil {
+			detail = err.Error()
+		}
+		problem(Problem{Kind: ProblemReferenceIndex, Path: TrimCVMFSRepoPrefix(CVMFSRepo, ReferenceIndexLocation(CVMFSRepo)),
+			Detail: detail, Repairable: true})
+	}
+
+	flat := ClientPath(CVMFSRepo, ".flat") + "/"
+	err = walkSymlinks(CVMFSRepo, func(symlink, target string) {
+		if !strings.HasPrefix(target, flat) {
+			return
+		}
+		tree := strings.TrimPrefix(target, ClientPath(CVMFSRepo)+"/")
+		if _, err := os.Stat(RepositoryPath(CVMFSRepo, tree)); os.IsNotExist(err) {
+			problem(Problem{Kind: ProblemDanglingSymlink, Path: symlink, Detail: "points to " + target, Repairable: true})
+		}
+	})
+	return report, err
+}
+
+// the problem with the content of the layer, if any, and false if the layer
+// has no file list to check. The digest comes from the manifests, empty if
+// no image uses the layer
+func checkLayerContent(CVMFSRepo, layer, digest string) (*Problem, bool, error) {
+	content, err := ioutil.ReadFile(getFileListPath(CVMFSRepo, layer))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	var files map[string]LayerFile
+	if err = json.Unmarshal(content, &files); err != nil {
+		return nil, false, nil
+	}
+	differences, err := verifyFileList(LayerRootfsPath(CVMFSRepo, layer), files)
+	if err != nil || len(differences) == 0 {
+		return nil, true, err
+	}
+	detail := fmt.Sprintf("%d differences", len(differences))
+	if len(differences) > maxDifferences {
+		differences = differences[:maxDifferences]
+	}
+	return &Problem{Kind: ProblemLayerContent, Path: TrimCVMFSRepoPrefix(CVMFSRepo, LayerRootfsPath(CVMFSRepo, layer)),
+		Layer: digest, Detail: detail + ": " + strings.Join(differences, "; "), Repairable: true}, true, nil
+}
+
+// add to the transaction the repair of the problems: the broken layers are
+// removed with the manifests of the images that use them, the catalogs
+// created, the dangling symlinks removed and the index rebuilt, at the end,
+// from what is left
+func addRepairs(t *Transaction, problems []Problem) error {
+	// the manifests, not the index that may be broken as well, tell which
+	// images use a layer
+	manifests, err := storedManifests(t.CVMFSRepo)
+	if err != nil {
+		return err
+	}
+	removed := make(map[string]bool)
+	removeImage := func(name string) {
+		if !removed[name] {
+			removed[name] = true
+			t.RemoveAll(filepath.Join(".metadata", name, "manifest.json"))
+		}
+	}
+	rebuildIndex := false
+	for _, p := range problems {
+		switch p.Kind {
+		case ProblemMissingCatalog:
+			t.CreateCatalog(filepath.Dir(p.Path))
+		case ProblemDanglingSymlink:
+			t.RemoveSymlink(p.Path)
+		case ProblemMissingLayer:
+			removeImage(p.Image)
+			rebuildIndex = true
+		case ProblemLayerContent:
+			t.RemoveAll(filepath.Dir(p.Path))
+			for name, manifest := range manifests {
+				for _, layer := range manifest.Layers {
+					if withoutAlgorithm(layer.Digest) == withoutAlgorithm(p.Layer) {
+						removeImage(name)
+					}
+				}
+			}
+			rebuildIndex = true
+		case ProblemReferenceIndex:
+			rebuildIndex = true
+		}
+	}
+	if rebuildIndex {
+		addReferenceIndexRebuild(t)
+	}
+	return nil
+}
+
+// check the repository and, with Repair, repair what can be repaired, see
+// above. The problems found are in the report, an error means that the check
+// itself failed
+func Fsck(CVMFSRepo string, options FsckOptions) (report FsckReport, err error) {
+	llog := func(l *log.Entry) *log.Entry {
+		return l.WithFields(log.Fields{"action": "fsck",
+			"repo":   CVMFSRepo,
+			"repair": options.Repair})
+	}
+	report, err = checkRepository(CVMFSRepo, options)
+	if err != nil {
+		llog(LogE(err)).Error("Error in checking the repository")
+		return
+	}
+	for _, p := range report.Problems {
+		llog(Log()).WithFields(log.Fields{"kind": p.Kind, "path": p.Path, "detail": p.Detail}).Warning("Problem found")
+	}
+	if !options.Repair || len(repairableProblems(report)) == 0 {
+		return
+	}
+
+	t := NewTransaction(CVMFSRepo)
+	t.add("repair", "", func(p Publisher, _ string) error {
+		// the repository may have changed before the transaction opened,
+		// the repairs are made from what is there now
+		report, err = checkRepository(CVMFSRepo, options)
+		if err != nil {
+			return err
+		}
+		repairs := NewTransaction(CVMFSRepo)
+		if err = addRepairs(repairs, repairableProblems(report)); err != nil {
+			llog(LogE(err)).Error("Impossible to repair the repository")
+			return err
+		}
+		return repairs.applyTo(p)
+	})
+	if err = t.Commit(context.Background()); err != nil {
+		llog(LogE(err)).Error("Error in repairing the repository")
+		return
+	}
+	for i := range report.Problems {
+		report.Problems[i].Repaired = report.Problems[i].Repairable
+	}
+	llog(Log()).WithFields(log.Fields{"repaired": len(repairableProblems(report))}).Info("Repository repaired")
+	return
+}
+
+func repairableProblems(report FsckReport) (repairable []Problem) {
+	for _, p := range report.Problems {
+		if p.Repairable {
+			repairable = append(repairable, p)
+		}
+	}
+	return
+}
@@ -0,0 +1,164 @@
+package lib
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func problemKinds(report FsckReport) (kinds []string) {
+	for _, problem := range report.Problems {
+		kinds = append(kinds, string(problem.Kind))
+	}
+	sort.Strings(kinds)
+	return
+}
+
+func TestFsck(t *testing.T) {
+	cvmfs := newFakeCvmfs(t, testRepo)
+	defer cvmfs.Close()
+	registry := newFakeRegistry()
+	defer registry.Close()
+	_, restore := fakePush(t, registry)
+	defer restore()
+
+	shared := map[string]string{"etc/os-release": "shared"}
+	first := registry.AddImage(t, "library/first", "latest", shared,
+		map[string]string{"first": "first"})
+	second := registry.AddImage(t, "library/second", "latest", shared,
+		map[string]string{"second": "second"})
+	convert := func() {
+		for _, name := range []string{"library/first", "library/second"} {
+			if _, err := ConvertWish(context.Background(), testWish(registry, name, "latest"), false, false, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	convert()
+	options := FsckOptions{VerifyContent: true}
+	report, err := Fsck(testRepo, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 0 || report.Images != 2 || report.Layers != 3 || report.Unverified != 0 {
+		t.Fatalf("Wrong report of a coherent repository: %+v", report)
+	}
+
+	// break the repository in all the ways we can find
+	firstLayer := digestHex(first.Layers[1].Digest)
+	os.RemoveAll(LayerPath(testRepo, firstLayer))
+	secondLayer := digestHex(second.Layers[1].Digest)
+	ioutil.WriteFile(filepath.Join(LayerRootfsPath(testRepo, secondLayer), "second"), []byte("broken"), 0644)
+	sharedLayer := digestHex(first.Layers[0].Digest)
+	os.Remove(filepath.Join(LayerRootfsPath(testRepo, sharedLayer), ".cvmfscatalog"))
+	os.Remove(ReferenceIndexLocation(testRepo))
+	symlink := cvmfs.Path(testRepo, "singularity", "first")
+	os.MkdirAll(filepath.Dir(symlink), 0755)
+	os.Symlink(ClientPath(testRepo, GetSingularityPathFromManifest(first)), symlink)
+
+	revision := cvmfs.Revision(testRepo)
+	report, err = Fsck(testRepo, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"dangling-symlink", "layer-content", "missing-catalog", "missing-layer", "reference-index"}
+	if kinds := problemKinds(report); len(kinds) != len(expected) {
+		t.Fatalf("Wrong problems found: %+v", report.Problems)
+	} else {
+		for i := range expected {
+			if kinds[i] != expected[i] {
+				t.Errorf("Wrong problems found: %+v", report.Problems)
+			}
+		}
+	}
+	if !report.Unrepaired() || cvmfs.Revision(testRepo) != revision {
+		t.Errorf("The repository was modified without repairing")
+	}
+	for _, problem := range report.Problems {
+		if problem.Kind == ProblemLayerContent && problem.Layer != second.Layers[1].Digest {
+			t.Errorf("Wrong layer with a different content: %s", problem.Layer)
+		}
+	}
+
+	options.Repair = true
+	report, err = Fsck(testRepo, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Unrepaired() || cvmfs.Revision(testRepo) != revision+1 {
+		t.Errorf("The repository was not repaired: %+v", report.Problems)
+	}
+	if _, err := os.Lstat(symlink); !os.IsNotExist(err) {
+		t.Errorf("The dangling symlink is still there")
+	}
+	if _, err := os.Stat(LayerPath(testRepo, secondLayer)); !os.IsNotExist(err) {
+		t.Errorf("The corrupted layer is still there")
+	}
+	if report, err = Fsck(testRepo, FsckOptions{VerifyContent: true}); err != nil || len(report.Problems) != 0 || report.Images != 0 {
+		t.Errorf("Problems left after the repair: %+v, %v", report, err)
+	}
+
+	// the images with the broken layers are converted again
+	convert()
+	if report, err = Fsck(testRepo, FsckOptions{VerifyContent: true}); err != nil || len(report.Problems) != 0 || report.Images != 2 {
+		t.Errorf("Problems left after converting again: %+v, %v", report, err)
+	}
+}
+
+func TestFsckRepairChecksAgain(t *testing.T) {
+	cvmfs := newFakeCvmfs(t, testRepo)
+	defer cvmfs.Close()
+	registry := newFakeRegistry()
+	defer registry.Close()
+	_, restore := fakePush(t, registry)
+	defer restore()
+
+	manifest := registry.AddImage(t, "library/test", "latest",
+		map[string]string{"first": "first"}, map[string]string{"second": "second"})
+	if _, err := ConvertWish(context.Background(), testWish(registry, "library/test", "latest"), false, false, false); err != nil {
+		t.Fatal(err)
+	}
+	catalog := func(layer int) string {
+		return filepath.Join(LayerRootfsPath(testRepo, digestHex(manifest.Layers[layer].Digest)), ".cvmfscatalog")
+	}
+	os.Remove(catalog(0))
+
+	// another transaction is running while fsck checks the repository
+	held, release := make(chan struct{}), make(chan struct{})
+	go InRepositoryQueue(testRepo, func() error {
+		close(held)
+		<-release
+		return nil
+	})
+	<-held
+	type result struct {
+		report FsckReport
+		err    error
+	}
+	done := make(chan result)
+	go func() {
+		report, err := Fsck(testRepo, FsckOptions{Repair: true})
+		done <- result{report, err}
+	}()
+	time.Sleep(200 * time.Millisecond)
+	// and breaks the repository a bit more
+	os.Remove(catalog(1))
+	close(release)
+
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if kinds := problemKinds(r.report); len(kinds) != 2 || r.report.Unrepaired() {
+		t.Errorf("The repairs were not made from the repository in the transaction: %+v", r.report.Problems)
+	}
+	for layer := range manifest.Layers {
+		if _, err := os.Stat(catalog(layer)); err != nil {
+			t.Errorf("The catalog of the layer %d was not repaired: %s", layer, err)
+		}
+	}
+}
@@ -1,11 +1,13 @@
 package lib
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -58,71 +60,220 @@ func FindImageToGarbageCollect(CVMFSRepo string) ([]da.Manifest, error) {
 }
 
 // with image and layer we pass the digest of the layer and the digest of the image,
-// both without the sha256: prefix
+// both without the sha256: prefix, the layer is removed if no image in the
+// reference index, other than image, uses it
 func GarbageCollectSingleLayer(CVMFSRepo, image, layer string) error {
-	backlink, err := getBacklinkFromLayer(CVMFSRepo, layer)
 	llog := func(l *log.Entry) *log.Entry {
 		return l.WithFields(log.Fields{"action": "garbage collect layer",
 			"repo":  CVMFSRepo,
 			"image": image,
 			"layer": layer})
 	}
+	idx, err := ReadReferenceIndex(CVMFSRepo)
 	if err != nil {
-		llog(LogE(err)).Error("Impossible to retrieve the backlink information")
+		llog(LogE(err)).Error("Impossible to retrieve the reference index")
 		return err
 	}
-	var newOrigin []string
-	for _, origin := range backlink.Origin {
-		withoutPrefix := strings.Split(origin, ":")[1]
-		if withoutPrefix != image {
-			newOrigin = append(newOrigin, origin)
+	for layerDigest, users := range idx.Layers {
+		if withoutAlgorithm(layerDigest) != layer {
+			continue
 		}
-	}
-	if len(newOrigin) > 0 {
-		backlink.Origin = newOrigin
-		backLinkMarshall, err := json.Marshal(backlink)
-		if err != nil {
-			llog(LogE(err)).Error("Error in marshaling the new backlink")
-			return err
+		for _, user := range users {
+			if withoutAlgorithm(user) != image {
+				llog(Log()).WithFields(log.Fields{"used by": user}).Info("Layer still used, not removing it")
+				return nil
+			}
 		}
+	}
+	err = RemoveLayer(CVMFSRepo, layer)
+	if err != nil {
+		llog(LogE(err)).Error("Error in deleting the layer")
+	}
+	return err
+}
 
-		backlinkPath := getBacklinkPath(CVMFSRepo, layer)
+// The garbage collection is a mark and sweep: every manifest.json under
+// .metadata is an image we serve, all the layers and the singularity trees of
+// those images are marked and any .layers/xx/$DIGEST or .flat/xx/$DIGEST not
+// marked is removed, together with the symlinks pointing to the removed
+// singularity trees. What was written less than the grace period ago is kept,
+// it may belong to a conversion not yet completed. The sweep runs inside a
+// single transaction and marks again once the transaction is open, so what is
+// published meanwhile is kept. A layer that a running conversion found in the
+// repository, and did not download, may still be removed: the conversion
+// checks its layers inside its own transactions and fails, the next run
+// downloads the layer again.
 
-		err = ExecCommand("cvmfs_server", "transaction", CVMFSRepo).Start()
-		if err != nil {
-			llog(LogE(err)).Error("Error in opening the transaction")
-			return err
+type GarbageCollectionOptions struct {
+	GracePeriod time.Duration
+	// only find what would be removed
+	DryRun bool
+}
+
+type Garbage struct {
+	// relative to the root of the repository, ex: .layers/ab/abcd
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+type GarbageCollectionResult struct {
+	Removed []Garbage `json:"removed"`
+	// the symlinks to the singularity trees removed
+	Symlinks []string `json:"symlinks"`
+	// not referenced, but written during the grace period
+	Kept      int   `json:"kept_in_grace_period"`
+	Reclaimed int64 `json:"reclaimed"`
+}
+
+// the directories and the files referenced by the manifests in .metadata
+func markReferenced(CVMFSRepo string) (map[string]bool, error) {
+	referenced := make(map[string]bool)
+	manifests, err := storedManifests(CVMFSRepo)
+	if err != nil {
+		// we do not know what the images use, better not to remove anything
+		return nil, err
+	}
+	// the digests are already validated by storedManifests
+	for _, manifest := range manifests {
+		for _, layer := range manifest.Layers {
+			digest := withoutAlgorithm(layer.Digest)
+			referenced[filepath.Join(subDirInsideRepo, digest[0:2], digest)] = true
 		}
+		referenced[GetSingularityPathFromManifest(manifest)] = true
+	}
+	return referenced, nil
+}
 
-		dir := filepath.Dir(backlinkPath)
-		if _, err := os.Stat(dir); os.IsNotExist(err) {
-			err = os.MkdirAll(dir, 0666)
+func directorySize(path string) (size int64) {
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return
+}
+
+// the layers and the singularity trees not referenced by any manifest, and the
+// symlinks to the trees
+func findGarbage(CVMFSRepo string, gracePeriod time.Duration) (result GarbageCollectionResult, err error) {
+	referenced, err := markReferenced(CVMFSRepo)
+	if err != nil {
+		return
+	}
+	removed := make(map[string]bool)
+	for _, top := range []string{subDirInsideRepo, ".flat"} {
+		prefixes, _ := ioutil.ReadDir(RepositoryPath(CVMFSRepo, top))
+		for _, prefix := range prefixes {
+			if !prefix.IsDir() || len(prefix.Name()) != 2 {
+				continue
+			}
+			entries, err := ioutil.ReadDir(RepositoryPath(CVMFSRepo, top, prefix.Name()))
 			if err != nil {
-				llog(LogE(err)).WithFields(log.Fields{"directory": dir}).Error(
-					"Error in creating the directory for the backlinks file, skipping...")
-				return err
+				return result, err
+			}
+			for _, entry := range entries {
+				// only what we wrote, a digest in its own prefix
+				if !entry.IsDir() || !strings.HasPrefix(entry.Name(), prefix.Name()) {
+					continue
+				}
+				path := filepath.Join(top, prefix.Name(), entry.Name())
+				if referenced[path] {
+					continue
+				}
+				if time.Since(entry.ModTime()) < gracePeriod {
+					result.Kept++
+					continue
+				}
+				size := directorySize(RepositoryPath(CVMFSRepo, path))
+				result.Removed = append(result.Removed, Garbage{Path: path, Size: size})
+				result.Reclaimed += size
+				removed[ClientPath(CVMFSRepo, path)] = true
 			}
 		}
+	}
 
-		err = ioutil.WriteFile(backlinkPath, backLinkMarshall, 0666)
-		if err != nil {
-			llog(LogE(err)).WithFields(log.Fields{"file": backlinkPath}).Error(
-				"Error in writing the backlink file, skipping...")
-			return err
+	err = walkSymlinks(CVMFSRepo, func(symlink, target string) {
+		if removed[target] {
+			result.Symlinks = append(result.Symlinks, symlink)
 		}
+	})
+	return
+}
 
-		err = ExecCommand("cvmfs_server", "publish", CVMFSRepo).Start()
+// the symlinks to the singularity images are outside the hidden directories,
+// found is called with the path of each symlink, relative to the root of the
+// repository, and its target
+func walkSymlinks(CVMFSRepo string, found func(symlink, target string)) error {
+	root := RepositoryPath(CVMFSRepo)
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			llog(LogE(err)).Error("Error in publishing after adding the backlinks")
 			return err
 		}
-		// write it to file
+		if path != root && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		target, err := os.Readlink(path)
+		if err == nil {
+			relative, _ := RelativeRepositoryPath(CVMFSRepo, path)
+			found(relative, target)
+		}
 		return nil
-	} else {
-		err = RemoveLayer(CVMFSRepo, layer)
+	})
+}
+
+// remove all the layers and singularity trees not used by any image, see
+// above, the remove schedule is not needed anymore and is removed as well.
+// Canceling ctx gives up the garbage collection as it does for a conversion
+func GarbageCollect(ctx context.Context, CVMFSRepo string, options GarbageCollectionOptions) (result GarbageCollectionResult, err error) {
+	llog := func(l *log.Entry) *log.Entry {
+		return l.WithFields(log.Fields{"action": "garbage collect",
+			"repo":    CVMFSRepo,
+			"dry run": options.DryRun,
+		})
+	}
+	result, err = findGarbage(CVMFSRepo, options.GracePeriod)
+	if err != nil {
+		llog(LogCE(ctx, err)).Error("Error in finding the garbage, not removing anything")
+		return
+	}
+	if options.DryRun || len(result.Removed) == 0 {
+		llog(LogC(ctx)).WithFields(log.Fields{"garbage": len(result.Removed),
+			"reclaimed": result.Reclaimed}).Info("Garbage found, nothing removed")
+		return
+	}
+
+	t := NewTransaction(CVMFSRepo)
+	t.add("garbage collect", "", func(p Publisher, _ string) error {
+		// the repository may have changed before the transaction opened
+		result, err = findGarbage(CVMFSRepo, options.GracePeriod)
 		if err != nil {
-			llog(LogE(err)).Error("Error in deleting the layer")
+			return err
 		}
-		return err
+		for _, symlink := range result.Symlinks {
+			if err = p.Remove(symlink); err != nil {
+				return err
+			}
+		}
+		for _, garbage := range result.Removed {
+			llog(LogC(ctx)).WithFields(log.Fields{"path": garbage.Path, "size": garbage.Size}).Info("Removing")
+			if err = p.Remove(garbage.Path); err != nil {
+				return err
+			}
+		}
+		return p.Remove(TrimCVMFSRepoPrefix(CVMFSRepo, RemoveScheduleLocation(CVMFSRepo)))
+	})
+	if err = t.Commit(ctx); err != nil {
+		llog(LogCE(ctx, err)).Error("Error in the garbage collection")
+		return GarbageCollectionResult{}, err
 	}
+	llog(LogC(ctx)).WithFields(log.Fields{"removed": len(result.Removed),
+		"reclaimed": result.Reclaimed}).Info("Garbage collection completed")
+	return
 }
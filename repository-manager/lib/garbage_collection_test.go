@@ -0,0 +1,153 @@
+package lib
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	da "github.com/cvmfs/docker-graphdriver/repository-manager/docker-api"
+)
+
+func TestGarbageCollectSingleLayer(t *testing.T) {
+	cvmfs := newFakeCvmfs(t, testRepo)
+	defer cvmfs.Close()
+	registry := newFakeRegistry()
+	defer registry.Close()
+	_, restore := fakePush(t, registry)
+	defer restore()
+
+	shared := map[string]string{"etc/os-release": "shared"}
+	first := registry.AddImage(t, "library/first", "latest", shared,
+		map[string]string{"first": "first"})
+	second := registry.AddImage(t, "library/second", "latest", shared,
+		map[string]string{"second": "second"})
+	for _, name := range []string{"library/first", "library/second"} {
+		if _, err := ConvertWish(context.Background(), testWish(registry, name, "latest"), false, false, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sharedLayer := digestHex(first.Layers[0].Digest)
+	if sharedLayer != digestHex(second.Layers[0].Digest) {
+		t.Fatalf("The images should share the first layer")
+	}
+	firstLayer := digestHex(first.Layers[1].Digest)
+	firstImage := digestHex(first.Config.Digest)
+
+	err := GarbageCollectSingleLayer(testRepo, firstImage, sharedLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(LayerPath(testRepo, sharedLayer)); err != nil {
+		t.Errorf("A layer still used by another image was removed")
+	}
+	err = GarbageCollectSingleLayer(testRepo, firstImage, firstLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(LayerPath(testRepo, firstLayer)); !os.IsNotExist(err) {
+		t.Errorf("A layer not used anymore was not removed")
+	}
+	if cvmfs.InTransaction(testRepo) {
+		t.Errorf("Repository left in a transaction")
+	}
+}
+
+func TestGarbageCollect(t *testing.T) {
+	cvmfs := newFakeCvmfs(t, testRepo)
+	defer cvmfs.Close()
+	registry := newFakeRegistry()
+	defer registry.Close()
+	_, restore := fakePush(t, registry)
+	defer restore()
+
+	shared := map[string]string{"etc/os-release": "shared"}
+	first := registry.AddImage(t, "library/first", "latest", shared,
+		map[string]string{"first": "first"})
+	second := registry.AddImage(t, "library/second", "latest", shared,
+		map[string]string{"second": "second"})
+	for _, name := range []string{"library/first", "library/second"} {
+		if _, err := ConvertWish(context.Background(), testWish(registry, name, "latest"), false, false, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the singularity images, the one of the second image has a symlink
+	for _, manifest := range []da.Manifest{first, second} {
+		flat := cvmfs.Path(testRepo, GetSingularityPathFromManifest(manifest))
+		os.MkdirAll(filepath.Join(flat, "etc"), 0755)
+		ioutil.WriteFile(filepath.Join(flat, "etc", "os-release"), []byte("flat"), 0644)
+	}
+	symlink := cvmfs.Path(testRepo, "registry.example.ch", "library", "second:latest")
+	os.MkdirAll(filepath.Dir(symlink), 0755)
+	os.Symlink(ClientPath(testRepo, GetSingularityPathFromManifest(second)), symlink)
+
+	// the second image is not served anymore
+	image, _ := ParseImage(testWish(registry, "library/second", "latest").InputName)
+	os.Remove(cvmfs.Path(testRepo, ".metadata", image.GetPlatformName(), "manifest.json"))
+	secondLayer := LayerPath(testRepo, digestHex(second.Layers[1].Digest))
+	secondFlat := cvmfs.Path(testRepo, GetSingularityPathFromManifest(second))
+	revision := cvmfs.Revision(testRepo)
+
+	result, err := GarbageCollect(context.Background(), testRepo, GarbageCollectionOptions{GracePeriod: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Removed) != 0 || result.Kept != 2 {
+		t.Errorf("The grace period was not respected: %+v", result)
+	}
+
+	result, err = GarbageCollect(context.Background(), testRepo, GarbageCollectionOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Removed) != 2 || len(result.Symlinks) != 1 || result.Reclaimed == 0 {
+		t.Errorf("Wrong garbage found: %+v", result)
+	}
+	if _, err := os.Stat(secondLayer); err != nil || cvmfs.Revision(testRepo) != revision {
+		t.Errorf("The dry run removed something")
+	}
+
+	result, err = GarbageCollect(context.Background(), testRepo, GarbageCollectionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, removed := range []string{secondLayer, secondFlat, symlink} {
+		if _, err := os.Lstat(removed); !os.IsNotExist(err) {
+			t.Errorf("Garbage not removed: %s", removed)
+		}
+	}
+	for _, kept := range []string{
+		LayerPath(testRepo, digestHex(first.Layers[0].Digest)),
+		LayerPath(testRepo, digestHex(first.Layers[1].Digest)),
+		cvmfs.Path(testRepo, GetSingularityPathFromManifest(first))} {
+		if _, err := os.Stat(kept); err != nil {
+			t.Errorf("Removed something still in use: %s", kept)
+		}
+	}
+	if cvmfs.Revision(testRepo) != revision+1 || cvmfs.InTransaction(testRepo) {
+		t.Errorf("The garbage collection was not published")
+	}
+
+	// a manifest we can not read stops the garbage collection
+	image, _ = ParseImage(testWish(registry, "library/first", "latest").InputName)
+	ioutil.WriteFile(cvmfs.Path(testRepo, ".metadata", image.GetPlatformName(), "manifest.json"), []byte("{"), 0644)
+	if _, err = GarbageCollect(context.Background(), testRepo, GarbageCollectionOptions{}); err == nil {
+		t.Errorf("Garbage collection with a corrupted manifest")
+	}
+	if _, err := os.Stat(LayerPath(testRepo, digestHex(first.Layers[1].Digest))); err != nil {
+		t.Errorf("Layer removed with a corrupted manifest")
+	}
+
+	// as a manifest with digests that are not digests
+	for _, manifest := range []string{
+		`{"config": {"digest": "sha256"}, "layers": []}`,
+		`{"config": {"digest": "` + first.Config.Digest + `"}, "layers": [{"digest": "sha256:a"}]}`,
+	} {
+		ioutil.WriteFile(cvmfs.Path(testRepo, ".metadata", image.GetPlatformName(), "manifest.json"), []byte(manifest), 0644)
+		if _, err = GarbageCollect(context.Background(), testRepo, GarbageCollectionOptions{}); err == nil {
+			t.Errorf("Garbage collection with a wrong manifest: %s", manifest)
+		}
+	}
+}
@@ -0,0 +1,835 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	copy "github.com/otiai10/copy"
+
+	da "github.com/cvmfs/docker-graphdriver/repository-manager/docker-api"
+)
+
+// The tests never touch the real /cvmfs nor the network: the test binary
+// itself plays the role of `cvmfs_server` (it is invoked through a symlink
+// called cvmfs_server placed first in the PATH) and the registry is an in
+// process HTTP server. In the same way the test binary plays the docker
+// credential helper `docker-credential-fake`. The docker configuration of
+// the user running the tests is never read.
+
+func TestMain(m *testing.M) {
+	if filepath.Base(os.Args[0]) == "cvmfs_server" {
+		os.Exit(fakeCvmfsServerMain(os.Args[1:]))
+	}
+	if filepath.Base(os.Args[0]) == "docker-credential-fake" {
+		os.Exit(fakeCredentialHelperMain(os.Args[1:]))
+	}
+	SetDockerConfigPath(filepath.Join(os.TempDir(), "docker2cvmfs-tests-no-config.json"))
+	blobCache, err := ioutil.TempDir("", "blob_cache")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	SetBlobCacheDirectory(blobCache)
+	code := m.Run()
+	os.RemoveAll(blobCache)
+	os.Exit(code)
+}
+
+const (
+	fakeCvmfsRootEnv  = "FAKE_CVMFS_ROOT"
+	fakeCvmfsStateEnv = "FAKE_CVMFS_STATE"
+)
+
+// implementation of the fake cvmfs_server, the repositories are directories
+// in $FAKE_CVMFS_ROOT, the state of the transactions is kept in
+// $FAKE_CVMFS_STATE. Opening a transaction takes a snapshot of the
+// repository, abort restores it.
+func fakeCvmfsServerMain(args []string) int {
+	root := os.Getenv(fakeCvmfsRootEnv)
+	state := os.Getenv(fakeCvmfsStateEnv)
+	if root == "" || state == "" || len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "fake cvmfs_server: wrong invocation", args)
+		return 2
+	}
+	appendToFile(filepath.Join(state, "log"), strings.Join(args, " ")+"\n")
+
+	command := args[0]
+	args = args[1:]
+	repo := strings.SplitN(args[len(args)-1], "/", 2)[0]
+	repoDir := filepath.Join(root, repo)
+	transactionFile := filepath.Join(state, repo+".transaction")
+	snapshot := filepath.Join(state, repo+".snapshot")
+
+	if _, err := os.Stat(repoDir); err != nil {
+		fmt.Fprintf(os.Stderr, "fake cvmfs_server: repository %s does not exist\n", repo)
+		return 1
+	}
+	_, err := os.Stat(transactionFile)
+	inTransaction := err == nil
+
+	fail := func(err error) int {
+		fmt.Fprintln(os.Stderr, "fake cvmfs_server:", err)
+		return 1
+	}
+
+	switch command {
+	case "transaction":
+		// created exclusively, two overlapping transactions are never
+		// both opened
+		file, err := os.OpenFile(transactionFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return fail(fmt.Errorf("%s is already in a transaction", repo))
+		}
+		file.WriteString(args[len(args)-1])
+		file.Close()
+		if err := copy.Copy(repoDir, snapshot); err != nil {
+			os.Remove(transactionFile)
+			return fail(err)
+		}
+	case "publish":
+		if !inTransaction {
+			return fail(fmt.Errorf("%s is not in a transaction", repo))
+		}
+		if _, err := os.Stat(filepath.Join(state, repo+".fail-publish")); err == nil {
+			return fail(fmt.Errorf("publish of %s failed on purpose", repo))
+		}
+		os.RemoveAll(snapshot)
+		os.Remove(transactionFile)
+		if err := syncReadOnlyBranch(state, repo, repoDir); err != nil {
+			return fail(err)
+		}
+		incrementRevision(state, repo)
+	case "abort":
+		if !inTransaction {
+			return fail(fmt.Errorf("%s is not in a transaction", repo))
+		}
+		if err := os.RemoveAll(repoDir); err != nil {
+			return fail(err)
+		}
+		if err := os.Rename(snapshot, repoDir); err != nil {
+			return fail(err)
+		}
+		os.Remove(transactionFile)
+	case "ingest":
+		// ingest opens its own transaction
+		if inTransaction {
+			return fail(fmt.Errorf("%s is already in a transaction", repo))
+		}
+		var tarball, base, toDelete string
+		catalog := false
+		for i := 0; i < len(args)-1; i++ {
+			switch args[i] {
+			case "--catalog":
+				catalog = true
+			case "-t", "--tar_file":
+				i++
+				tarball = args[i]
+			case "-b", "--base_dir":
+				i++
+				base = args[i]
+			case "-d", "--delete":
+				i++
+				toDelete = args[i]
+			}
+		}
+		if toDelete != "" {
+			if err := os.RemoveAll(filepath.Join(repoDir, toDelete)); err != nil {
+				return fail(err)
+			}
+		}
+		if tarball != "" {
+			dest := filepath.Join(repoDir, base)
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				return fail(err)
+			}
+			if err := extractTar(tarball, dest); err != nil {
+				return fail(err)
+			}
+			if catalog {
+				if err := ioutil.WriteFile(filepath.Join(dest, ".cvmfscatalog"), nil, 0644); err != nil {
+					return fail(err)
+				}
+			}
+		}
+		if err := syncReadOnlyBranch(state, repo, repoDir); err != nil {
+			return fail(err)
+		}
+		incrementRevision(state, repo)
+	default:
+		return fail(fmt.Errorf("unknown command %s", command))
+	}
+	return 0
+}
+
+func appendToFile(path, content string) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	file.WriteString(content)
+}
+
+// the read only branch, if any, shows what was published
+func syncReadOnlyBranch(state, repo, repoDir string) error {
+	branch, err := ioutil.ReadFile(filepath.Join(state, repo+".rdonly"))
+	if err != nil {
+		return nil
+	}
+	if err := os.RemoveAll(string(branch)); err != nil {
+		return err
+	}
+	return copy.Copy(repoDir, string(branch))
+}
+
+func incrementRevision(state, repo string) {
+	path := filepath.Join(state, repo+".revision")
+	revision, _ := ioutil.ReadFile(path)
+	n, _ := strconv.Atoi(string(revision))
+	ioutil.WriteFile(path, []byte(strconv.Itoa(n+1)), 0644)
+}
+
+type fakeCvmfs struct {
+	root  string
+	state string
+
+	oldPath       string
+	oldMountRoot  string
+	oldUnionRoot  string
+	oldBlobCache  string
+	readOnlyRepos []string
+	tmp           string
+}
+
+// set up the fake cvmfs_server with the repositories, the returned object
+// must be closed at the end of the test
+func newFakeCvmfs(t *testing.T, repos ...string) *fakeCvmfs {
+	tmp, err := ioutil.TempDir("", "fake_cvmfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeCvmfs{
+		root:         filepath.Join(tmp, "cvmfs"),
+		state:        filepath.Join(tmp, "state"),
+		oldPath:      os.Getenv("PATH"),
+		oldMountRoot: cvmfsMountRoot,
+		oldUnionRoot: unionMountRoot,
+		oldBlobCache: getBlobCacheDirectory(),
+		tmp:          tmp}
+	bin := filepath.Join(tmp, "bin")
+	for _, dir := range []string{f.root, f.state, bin} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, repo := range repos {
+		if err := os.MkdirAll(filepath.Join(f.root, repo), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(executable, filepath.Join(bin, "cvmfs_server")); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+f.oldPath)
+	os.Setenv(fakeCvmfsRootEnv, f.root)
+	os.Setenv(fakeCvmfsStateEnv, f.state)
+	SetCVMFSMountRoot(f.root)
+	unionMountRoot = f.root
+	// each test starts with an empty blob cache
+	SetBlobCacheDirectory(filepath.Join(tmp, "blobs"))
+	if err := SetPublisher(PublisherConfig{Type: PublisherCvmfsServer}); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func (f *fakeCvmfs) Close() {
+	os.Setenv("PATH", f.oldPath)
+	os.Unsetenv(fakeCvmfsRootEnv)
+	os.Unsetenv(fakeCvmfsStateEnv)
+	SetCVMFSMountRoot(f.oldMountRoot)
+	unionMountRoot = f.oldUnionRoot
+	for _, repo := range f.readOnlyRepos {
+		SetRepositoryRoot(repo, "")
+	}
+	SetBlobCacheDirectory(f.oldBlobCache)
+	os.RemoveAll(f.tmp)
+}
+
+// how many times the repository was published
+func (f *fakeCvmfs) Revision(repo string) int {
+	revision, _ := ioutil.ReadFile(filepath.Join(f.state, repo+".revision"))
+	n, _ := strconv.Atoi(string(revision))
+	return n
+}
+
+func (f *fakeCvmfs) InTransaction(repo string) bool {
+	_, err := os.Stat(filepath.Join(f.state, repo+".transaction"))
+	return err == nil
+}
+
+// make the next publish of the repository fail
+// the repository is read from a read only branch, as
+// /var/spool/cvmfs/$REPO/rdonly, updated at each publish, while it is still
+// written in the union mount
+func (f *fakeCvmfs) ReadOnlyBranch(t *testing.T, repo string) string {
+	branch := filepath.Join(f.tmp, "spool", repo, "rdonly")
+	if err := ioutil.WriteFile(filepath.Join(f.state, repo+".rdonly"), []byte(branch), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := syncReadOnlyBranch(f.state, repo, filepath.Join(f.root, repo)); err != nil {
+		t.Fatal(err)
+	}
+	SetRepositoryRoot(repo, branch)
+	f.readOnlyRepos = append(f.readOnlyRepos, repo)
+	return branch
+}
+
+// the invocations of cvmfs_server, in order
+func (f *fakeCvmfs) Commands() []string {
+	log, _ := ioutil.ReadFile(filepath.Join(f.state, "log"))
+	return strings.Split(strings.TrimSpace(string(log)), "\n")
+}
+
+func (f *fakeCvmfs) FailPublish(repo string) {
+	ioutil.WriteFile(filepath.Join(f.state, repo+".fail-publish"), []byte{}, 0644)
+}
+
+func (f *fakeCvmfs) Path(repo string, path ...string) string {
+	return filepath.Join(append([]string{f.root, repo}, path...)...)
+}
+
+// an in memory docker registry (API v2), it serves the manifests and the blobs
+// that are added to it behind a bearer token, like the docker hub does
+type fakeRegistry struct {
+	*httptest.Server
+
+	lock      sync.Mutex
+	manifests map[string]fakeManifest // repository:reference -> manifest
+	blobs     map[string][]byte       // digest -> content
+	linked    map[string]bool         // repository:digest -> the blob is in the repository
+	corrupted map[string]bool         // digest -> serve a wrong content
+	interrupt map[string]int          // digest -> bytes served before dropping the connection, once
+	stalled   map[string]bool         // digest -> the download hangs until the client gives up
+	redirect  string                  // if set, the blobs are redirected to redirect/$digest
+	requests  []string
+	token     string
+	uploads   int
+	// if set, the token is given only to who logs in with them
+	user          string
+	password      string
+	identityToken string
+	// use the Basic scheme instead of the tokens
+	basic bool
+}
+
+type fakeManifest struct {
+	mediaType string
+	content   []byte
+}
+
+func newFakeRegistry() *fakeRegistry {
+	r := &fakeRegistry{
+		manifests: make(map[string]fakeManifest),
+		blobs:     make(map[string][]byte),
+		linked:    make(map[string]bool),
+		corrupted: make(map[string]bool),
+		interrupt: make(map[string]int),
+		stalled:   make(map[string]bool),
+		token:     "fake-token"}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serve))
+	return r
+}
+
+func (r *fakeRegistry) Host() string {
+	return strings.TrimPrefix(r.URL, "http://")
+}
+
+func (r *fakeRegistry) AddBlob(content []byte) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+	r.blobs[digest] = content
+	return digest
+}
+
+func (r *fakeRegistry) CorruptBlob(digest string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.corrupted[digest] = true
+}
+
+// answer to the blob requests with a redirect to storage/$digest, like the
+// registries that keep the blobs in an object storage
+func (r *fakeRegistry) RedirectBlobs(storage string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.redirect = storage
+}
+
+func (r *fakeRegistry) Blob(digest string) ([]byte, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	blob, ok := r.blobs[digest]
+	return blob, ok
+}
+
+func (r *fakeRegistry) DeleteBlob(digest string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.blobs, digest)
+}
+
+// the downloads of the blob never end, until the client cancels them
+func (r *fakeRegistry) StallBlob(digest string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.stalled[digest] = true
+}
+
+// the next download of the blob stops after n bytes
+func (r *fakeRegistry) InterruptBlob(digest string, n int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.interrupt[digest] = n
+}
+
+// store the manifest under the reference (a tag) and under its own digest
+func (r *fakeRegistry) AddManifest(repository, reference, mediaType string, content []byte) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+	m := fakeManifest{mediaType: mediaType, content: content}
+	r.manifests[repository+":"+reference] = m
+	r.manifests[repository+":"+digest] = m
+	return digest
+}
+
+// add an image made of the layers, each layer is a map path -> content
+// of regular files, and return its manifest
+func (r *fakeRegistry) AddImage(t *testing.T, repository, tag string, layers ...map[string]string) da.Manifest {
+	var described []da.Layer
+	for _, files := range layers {
+		layer := gzipTar(t, files)
+		described = append(described, da.Layer{
+			MediaType: da.MediaTypeDockerLayer,
+			Size:      len(layer),
+			Digest:    r.AddBlob(layer)})
+	}
+	return r.AddImageOfLayers(t, repository, tag, described...)
+}
+
+// add an image made of layers already described, their blobs are added with
+// AddBlob or, for the foreign layers, served somewhere else
+func (r *fakeRegistry) AddImageOfLayers(t *testing.T, repository, tag string, layers ...da.Layer) da.Manifest {
+	// the configuration must be different for each image
+	config := []byte(fmt.Sprintf(
+		`{"architecture":"amd64","os":"linux","config":{"Env":["IMAGE=%s:%s"],"Cmd":["sh"]}}`,
+		repository, tag))
+	manifest := da.Manifest{
+		SchemaVersion: 2,
+		MediaType:     da.MediaTypeDockerManifest,
+		Config: da.ConfigType{
+			MediaType: "application/vnd.docker.container.image.v1+json",
+			Size:      len(config),
+			Digest:    r.AddBlob(config)},
+		Layers: layers}
+	r.lock.Lock()
+	for _, layer := range manifest.Layers {
+		r.linked[repository+":"+layer.Digest] = true
+	}
+	r.linked[repository+":"+manifest.Config.Digest] = true
+	r.lock.Unlock()
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.AddManifest(repository, tag, da.MediaTypeDockerManifest, content)
+	return manifest
+}
+
+// require the user and the password, or the identity token, to get the
+// token
+func (r *fakeRegistry) RequireLogin(user, password, identityToken string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.user = user
+	r.password = password
+	r.identityToken = identityToken
+}
+
+// answer to the requests with the Basic scheme, with the user and password
+func (r *fakeRegistry) RequireBasicAuth(user, password string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.basic = true
+	r.user = user
+	r.password = password
+}
+
+// refuse the token given until now, like when it expires
+func (r *fakeRegistry) RotateToken(token string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.token = token
+}
+
+func (r *fakeRegistry) loggedIn(req *http.Request) bool {
+	if r.user == "" && r.identityToken == "" {
+		return true
+	}
+	if req.Method == "POST" {
+		return r.identityToken != "" &&
+			req.FormValue("grant_type") == "refresh_token" &&
+			req.FormValue("refresh_token") == r.identityToken
+	}
+	user, password, ok := req.BasicAuth()
+	return ok && r.user != "" && user == r.user && password == r.password
+}
+
+func (r *fakeRegistry) Requests() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string{}, r.requests...)
+}
+
+func (r *fakeRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	// the requests refused for the authentication are not recorded
+	request := req.Method + " " + req.URL.Path
+	if byteRange := req.Header.Get("Range"); byteRange != "" {
+		request += " " + byteRange
+	}
+
+	if req.URL.Path == "/token" {
+		r.requests = append(r.requests, request)
+		if !r.loggedIn(req) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"token": r.token, "expires_in": 300})
+		return
+	}
+	if !strings.HasPrefix(req.URL.Path, "/v2/") {
+		http.NotFound(w, req)
+		return
+	}
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	if r.basic {
+		if !r.loggedIn(req) {
+			w.Header().Set("Www-Authenticate", `Basic realm="fake registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	} else if req.Header.Get("Authorization") != "Bearer "+r.token {
+		repository := path
+		for _, suffix := range []string{"/tags/list", "/manifests/", "/blobs/"} {
+			if i := strings.LastIndex(repository, suffix); i >= 0 {
+				repository = repository[:i]
+			}
+		}
+		w.Header().Set("Www-Authenticate", fmt.Sprintf(
+			`Bearer realm="%s/token",service="fake",scope="repository:%s:pull,push"`, r.URL, repository))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	r.requests = append(r.requests, request)
+	if strings.HasSuffix(path, "/tags/list") {
+		r.serveTags(w, req, strings.TrimSuffix(path, "/tags/list"))
+		return
+	}
+	if i := strings.LastIndex(path, "/blobs/uploads/"); i >= 0 {
+		r.serveUpload(w, req, path[:i], path[i+len("/blobs/uploads/"):])
+		return
+	}
+	if i := strings.LastIndex(path, "/manifests/"); i >= 0 && req.Method == "PUT" {
+		r.storeManifest(w, req, path[:i], path[i+len("/manifests/"):])
+		return
+	}
+	if i := strings.LastIndex(path, "/manifests/"); i >= 0 && req.Method == "DELETE" {
+		r.deleteManifest(w, path[:i], path[i+len("/manifests/"):])
+		return
+	}
+	if i := strings.LastIndex(path, "/manifests/"); i >= 0 {
+		m, ok := r.manifests[path[:i]+":"+path[i+len("/manifests/"):]]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Header().Set("Docker-Content-Digest", fmt.Sprintf("sha256:%x", sha256.Sum256(m.content)))
+		w.Write(m.content)
+		return
+	}
+	if i := strings.LastIndex(path, "/blobs/"); i >= 0 {
+		digest := path[i+len("/blobs/"):]
+		blob, ok := r.blobs[digest]
+		if !ok || (req.Method == "HEAD" && !r.linked[path[:i]+":"+digest]) {
+			http.NotFound(w, req)
+			return
+		}
+		if r.stalled[digest] && req.Method == "GET" {
+			// the other requests go on while this one hangs
+			r.lock.Unlock()
+			<-req.Context().Done()
+			r.lock.Lock()
+			return
+		}
+		if r.redirect != "" {
+			http.Redirect(w, req, r.redirect+"/"+digest, http.StatusTemporaryRedirect)
+			return
+		}
+		if r.corrupted[digest] {
+			blob = append([]byte{}, blob...)
+			blob[len(blob)-1] ^= 0xff
+		}
+		if n, ok := r.interrupt[digest]; ok {
+			delete(r.interrupt, digest)
+			w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+			w.Write(blob[:n])
+			w.(http.Flusher).Flush()
+			// the client sees the connection closed before the end
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(blob))
+		return
+	}
+	http.NotFound(w, req)
+}
+
+// the uploads are monolithic: POST to start them, or to mount a blob from
+// another repository, then PUT of the whole blob
+func (r *fakeRegistry) serveUpload(w http.ResponseWriter, req *http.Request, repository, upload string) {
+	query := req.URL.Query()
+	switch {
+	case req.Method == "POST" && r.linked[query.Get("from")+":"+query.Get("mount")]:
+		r.linked[repository+":"+query.Get("mount")] = true
+		w.Header().Set("Location", "/v2/"+repository+"/blobs/"+query.Get("mount"))
+		w.WriteHeader(http.StatusCreated)
+	case req.Method == "POST":
+		r.uploads++
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%d?state=fake", repository, r.uploads))
+		w.WriteHeader(http.StatusAccepted)
+	case req.Method == "PUT" && upload != "" && query.Get("state") == "fake":
+		content, err := ioutil.ReadAll(req.Body)
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+		if err != nil || digest != query.Get("digest") {
+			http.Error(w, "DIGEST_INVALID", http.StatusBadRequest)
+			return
+		}
+		r.blobs[digest] = content
+		r.linked[repository+":"+digest] = true
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.Error(w, "BLOB_UPLOAD_INVALID", http.StatusBadRequest)
+	}
+}
+
+// the manifest is refused if its blobs are not in the repository
+func (r *fakeRegistry) storeManifest(w http.ResponseWriter, req *http.Request, repository, reference string) {
+	content, err := ioutil.ReadAll(req.Body)
+	var manifest da.Manifest
+	if err == nil {
+		err = json.Unmarshal(content, &manifest)
+	}
+	if err != nil {
+		http.Error(w, "MANIFEST_INVALID", http.StatusBadRequest)
+		return
+	}
+	for _, digest := range append([]string{manifest.Config.Digest}, layerDigests(manifest)...) {
+		if !r.linked[repository+":"+digest] {
+			http.Error(w, "MANIFEST_BLOB_UNKNOWN", http.StatusBadRequest)
+			return
+		}
+	}
+	m := fakeManifest{mediaType: req.Header.Get("Content-Type"), content: content}
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+	r.manifests[repository+":"+reference] = m
+	r.manifests[repository+":"+digest] = m
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// the manifests are deleted by digest, with all the tags pointing to them
+func (r *fakeRegistry) deleteManifest(w http.ResponseWriter, repository, digest string) {
+	if !strings.HasPrefix(digest, "sha256:") {
+		http.Error(w, "UNSUPPORTED", http.StatusBadRequest)
+		return
+	}
+	if _, ok := r.manifests[repository+":"+digest]; !ok {
+		http.NotFound(w, nil)
+		return
+	}
+	for reference, m := range r.manifests {
+		if strings.HasPrefix(reference, repository+":") && fmt.Sprintf("sha256:%x", sha256.Sum256(m.content)) == digest {
+			delete(r.manifests, reference)
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func layerDigests(manifest da.Manifest) (digests []string) {
+	for _, layer := range manifest.Layers {
+		digests = append(digests, layer.Digest)
+	}
+	return
+}
+
+// the tags are served in pages of at most tagsPageSize tags, whatever the
+// client asks, like some registries do
+const tagsPageSize = 2
+
+func (r *fakeRegistry) serveTags(w http.ResponseWriter, req *http.Request, repository string) {
+	var tags []string
+	for reference := range r.manifests {
+		if strings.HasPrefix(reference, repository+":") {
+			tag := strings.TrimPrefix(reference, repository+":")
+			if !strings.HasPrefix(tag, "sha256:") {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	if len(tags) == 0 {
+		http.NotFound(w, req)
+		return
+	}
+	sort.Strings(tags)
+	last := req.URL.Query().Get("last")
+	start := sort.SearchStrings(tags, last)
+	if last != "" && start < len(tags) && tags[start] == last {
+		start++
+	}
+	end := start + tagsPageSize
+	if end < len(tags) {
+		w.Header().Set("Link", fmt.Sprintf(`</v2/%s/tags/list?n=%d&last=%s>; rel="next"`,
+			repository, tagsPageSize, tags[end-1]))
+	} else {
+		end = len(tags)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"name": repository, "tags": tags[start:end]})
+}
+
+func gzipTar(t *testing.T, files map[string]string) []byte {
+	var buffer bytes.Buffer
+	compressor := gzip.NewWriter(&buffer)
+	if _, err := compressor.Write(plainTar(t, files)); err != nil {
+		t.Fatal(err)
+	}
+	if err := compressor.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func plainTar(t *testing.T, files map[string]string) []byte {
+	var buffer bytes.Buffer
+	writer := tar.NewWriter(&buffer)
+	for name, content := range files {
+		err := writer.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+const fakeCredentialsEnv = "FAKE_CREDENTIALS"
+
+// implementation of the fake credential helper, the credentials are a json
+// object server -> {"Username": ..., "Secret": ...} in $FAKE_CREDENTIALS
+func fakeCredentialHelperMain(args []string) int {
+	if len(args) != 1 || args[0] != "get" {
+		fmt.Fprintln(os.Stderr, "fake credential helper: wrong invocation", args)
+		return 2
+	}
+	server, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var store map[string]struct{ Username, Secret string }
+	if err := json.Unmarshal([]byte(os.Getenv(fakeCredentialsEnv)), &store); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	entry, ok := store[strings.TrimSpace(string(server))]
+	if !ok {
+		fmt.Println("credentials not found in native keychain")
+		return 1
+	}
+	json.NewEncoder(os.Stdout).Encode(map[string]string{
+		"ServerURL": string(server),
+		"Username":  entry.Username,
+		"Secret":    entry.Secret})
+	return 0
+}
+
+// install the fake credential helper in the PATH, serving the credentials in
+// the store (server -> username, secret), and use the docker configuration
+func fakeDockerConfig(t *testing.T, config string, store map[string][2]string) func() {
+	tmp, err := ioutil.TempDir("", "docker2cvmfs-docker-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(executable, filepath.Join(tmp, "docker-credential-fake")); err != nil {
+		t.Fatal(err)
+	}
+	entries := make(map[string]map[string]string)
+	for server, userSecret := range store {
+		entries[server] = map[string]string{"Username": userSecret[0], "Secret": userSecret[1]}
+	}
+	encoded, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(tmp, "config.json")
+	if err := ioutil.WriteFile(configPath, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	oldPath := os.Getenv("PATH")
+	oldConfigPath := getDockerConfigPath()
+	os.Setenv("PATH", tmp+string(os.PathListSeparator)+oldPath)
+	os.Setenv(fakeCredentialsEnv, string(encoded))
+	SetDockerConfigPath(configPath)
+	return func() {
+		os.Setenv("PATH", oldPath)
+		os.Unsetenv(fakeCredentialsEnv)
+		SetDockerConfigPath(oldConfigPath)
+		os.RemoveAll(tmp)
+	}
+}
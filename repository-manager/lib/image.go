@@ -2,6 +2,7 @@ package lib
 
 import (
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -12,9 +13,12 @@ import (
 	"reflect"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/docker/docker/image"
+	"github.com/klauspost/compress/zstd"
 	"github.com/olekukonko/tablewriter"
+	digest "github.com/opencontainers/go-digest"
 	log "github.com/sirupsen/logrus"
 
 	da "github.com/cvmfs/docker-graphdriver/repository-manager/docker-api"
@@ -34,7 +38,10 @@ type Image struct {
 	Tag        string
 	Digest     string
 	IsThin     bool
-	Manifest   *da.Manifest
+	Platform   string
+	// reference to the password of the user, see GetCredentials
+	Credentials string
+	Manifest    *da.Manifest
 }
 
 func (i Image) GetSimpleName() string {
@@ -46,6 +53,21 @@ func (i Image) GetSimpleName() string {
 	}
 }
 
+// the name used inside the repository to store the metadata and the
+// singularity image, the platform is appended only when explicitly requested
+// so that images converted before the platform support keep their location.
+// The `+` cannot appear in a tag so the name is never ambiguous.
+func (i Image) GetPlatformName() string {
+	return i.GetSimpleName() + i.platformSuffix()
+}
+
+func (i Image) platformSuffix() string {
+	if i.Platform == "" {
+		return ""
+	}
+	return "+" + strings.Replace(i.Platform, "/", "-", -1)
+}
+
 func (i Image) WholeName() string {
 	root := fmt.Sprintf("%s://%s/%s", i.Scheme, i.Registry, i.Repository)
 	if i.Tag != "" {
@@ -126,10 +148,13 @@ func (img Image) GetManifest() (da.Manifest, error) {
 	if img.Manifest != nil {
 		return *img.Manifest, nil
 	}
-	bytes, err := img.getByteManifest()
+	bytes, mediaType, _, err := img.getPlatformManifest()
 	if err != nil {
 		return da.Manifest{}, err
 	}
+	if !da.IsManifest(mediaType) {
+		return da.Manifest{}, fmt.Errorf("Unsupported manifest media type: %s", mediaType)
+	}
 	var manifest da.Manifest
 	err = json.Unmarshal(bytes, &manifest)
 	if err != nil {
@@ -138,247 +163,244 @@ func (img Image) GetManifest() (da.Manifest, error) {
 	if reflect.DeepEqual(da.Manifest{}, manifest) {
 		return manifest, fmt.Errorf("Got empty manifest")
 	}
-	img.Manifest = &manifest
+	// the digests end up in the paths of the repository
+	if _, err := digest.Parse(manifest.Config.Digest); err != nil {
+		return manifest, fmt.Errorf("Invalid digest of the configuration %q: %s", manifest.Config.Digest, err)
+	}
+	for _, layer := range manifest.Layers {
+		if _, err := digest.Parse(layer.Digest); err != nil {
+			return manifest, fmt.Errorf("Invalid digest of the layer %q: %s", layer.Digest, err)
+		}
+	}
+	// the mediaType field is optional in OCI manifests, we store it
+	// anyway so that the manifest we save is self describing
+	if manifest.MediaType == "" {
+		manifest.MediaType = mediaType
+	}
 	return manifest, nil
 }
 
-func (img Image) GetChanges() (changes []string, err error) {
-	user := img.User
-	pass, err := getPassword()
-	if err != nil {
-		LogE(err).Warning("Unable to get the credential for downloading the configuration blog, trying anonymously")
-		user = ""
-		pass = ""
-	}
-
-	changes = []string{"ENV CVMFS_IMAGE true"}
-	manifest, err := img.GetManifest()
+// get the bytes of the manifest of the image, if the registry answer with a
+// manifest list we follow it to the manifest of the platform of the image.
+// The digest returned is the one of the platform manifest, it is empty if
+// the registry gave us directly a manifest.
+func (img Image) getPlatformManifest() (bytes []byte, mediaType, digest string, err error) {
+	bytes, mediaType, err = img.getByteManifest()
 	if err != nil {
-		LogE(err).Warning("Impossible to retrieve the manifest of the image, not changes set")
 		return
 	}
-	configUrl := fmt.Sprintf("%s://%s/v2/%s/blobs/%s",
-		img.Scheme, img.Registry, img.Repository, manifest.Config.Digest)
-	token, err := firstRequestForAuth(configUrl, user, pass)
-	if err != nil {
-		LogE(err).Warning("Impossible to retrieve the token for getting the changes from the repository, not changes set")
+	if !da.IsManifestList(mediaType) {
 		return
 	}
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", configUrl, nil)
+	descriptor, err := img.selectPlatformManifest(bytes)
 	if err != nil {
-		LogE(err).Warning("Impossible to create a request for getting the changes no chnages set.")
 		return
 	}
-	req.Header.Set("Authorization", token)
-	req.Header.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json")
-
-	resp, err := client.Do(req)
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	Log().WithFields(log.Fields{
+		"image":    img.GetSimpleName(),
+		"platform": descriptor.Platform.String(),
+		"digest":   descriptor.Digest}).Info("Selected manifest from the manifest list")
+	platformImg := img
+	platformImg.Digest = descriptor.Digest
+	bytes, mediaType, err = platformImg.getByteManifest()
 	if err != nil {
-		LogE(err).Warning("Error in reading the body from the configuration, no change set")
 		return
 	}
-
-	var config image.Image
-	err = json.Unmarshal(body, &config)
-	if err != nil {
-		LogE(err).Warning("Error in unmarshaling the configuration of the image")
+	if da.IsManifestList(mediaType) {
+		err = fmt.Errorf("Got a manifest list pointing to another manifest list")
 		return
 	}
-	env := config.Config.Env
-
-	if len(env) > 0 {
-		for _, e := range env {
-			envs := strings.SplitN(e, "=", 2)
-			if len(envs) != 2 {
-				continue
-			}
-			change := fmt.Sprintf("ENV %s=\"%s\"", envs[0], envs[1])
-			changes = append(changes, change)
-		}
-	}
-
-	cmd := config.Config.Cmd
-
-	if len(cmd) > 0 {
-		for _, c := range cmd {
-			changes = append(changes, fmt.Sprintf("CMD %s", c))
-		}
-	}
-
-	return
-}
-
-func (img Image) GetSingularityLocation() string {
-	return fmt.Sprintf("docker://%s/%s%s", img.Registry, img.Repository, img.GetReference())
+	return bytes, mediaType, descriptor.Digest, nil
 }
 
-func GetSingularityPathFromManifest(manifest da.Manifest) string {
-	digest := strings.Split(manifest.Config.Digest, ":")[1]
-	return filepath.Join(".flat", digest[0:2], digest)
+func (img Image) GetPlatform() (da.Platform, error) {
+	if img.Platform == "" {
+		return da.DefaultPlatform, nil
+	}
+	return da.ParsePlatform(img.Platform)
 }
 
-// here is where in the FS we are going to store the singularity image
-func (img Image) GetSingularityPath() (string, error) {
-	manifest, err := img.GetManifest()
+func (img Image) selectPlatformManifest(bytes []byte) (da.ManifestDescriptor, error) {
+	var list da.ManifestList
+	err := json.Unmarshal(bytes, &list)
 	if err != nil {
-		LogE(err).Error("Error in getting the manifest to figureout the singularity path")
-		return "", err
+		LogE(err).Error("Error in unmarshaling the manifest list")
+		return da.ManifestDescriptor{}, err
 	}
-	return GetSingularityPathFromManifest(manifest), nil
-}
-
-type Singularity struct {
-	Image         *Image
-	TempDirectory string
+	platform, err := img.GetPlatform()
+	if err != nil {
+		return da.ManifestDescriptor{}, err
+	}
+	return list.SelectPlatform(platform)
 }
 
-func (img Image) DownloadSingularityDirectory(rootPath string) (sing Singularity, err error) {
-	dir, err := ioutil.TempDir(rootPath, "singularity_buffer")
-	if err != nil {
-		LogE(err).Error("Error in creating temporary directory for singularity")
-		return
+// the configuration of the image in the manifest: the command, the
+// environment, the platform...
+func (img Image) GetConfig(manifest da.Manifest) (config image.Image, err error) {
+	credentials := img.GetCredentials()
 
+	configUrl := fmt.Sprintf("%s://%s/v2/%s/blobs/%s",
+		img.Scheme, img.Registry, img.Repository, manifest.Config.Digest)
+	auth := newRegistryAuth(credentials)
+	sources := img.sources(configUrl, auth)
+	var body []byte
+	for i := 0; i <= 3; i++ {
+		source := sources[i%len(sources)]
+		body, err = getVerifiedBlob(source.url, source.auth, manifest.Config.Digest)
+		if err == nil {
+			break
+		}
+		LogE(err).WithFields(log.Fields{"attempt": i}).Warning(
+			"Error in downloading the configuration of the image")
 	}
-	singularityTempCache, err := ioutil.TempDir("", "tempDirSingularityCache")
 	if err != nil {
-		LogE(err).Error("Error in creating temporary directory for singularity cache")
+		LogE(err).Error("Impossible to download the configuration of the image")
 		return
 	}
-	defer os.RemoveAll(singularityTempCache)
-	err = ExecCommand("singularity", "build", "--sandbox", dir, img.GetSingularityLocation()).Env(
-		"SINGULARITY_CACHEDIR", singularityTempCache).Start()
+
+	err = json.Unmarshal(body, &config)
 	if err != nil {
-		LogE(err).Error("Error in downloading the singularity image")
-		return
+		LogE(err).Error("Error in unmarshaling the configuration of the image")
 	}
-
-	Log().Info("Successfully download the singularity image")
-	return Singularity{Image: &img, TempDirectory: dir}, nil
+	return
 }
 
-func (s Singularity) IngestIntoCVMFS(CVMFSRepo string) error {
-	symlinkPath := filepath.Join(s.Image.Registry, s.Image.Repository+":"+s.Image.GetSimpleReference())
-	singularityPath, err := s.Image.GetSingularityPath()
+// download a small blob, like the configuration, and check that what we got
+// matches the expected digest
+func getVerifiedBlob(url string, auth *registryAuth, expectedDigest string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		LogE(err).Error(
-			"Error in ingesting singularity image into CVMFS, unable to get where save the image")
-		return err
+		return nil, err
 	}
-
-	err = IngestIntoCVMFS(CVMFSRepo, singularityPath, s.TempDirectory)
+	resp, err := auth.Do(req)
 	if err != nil {
-		// if there is an error ingest does not remove the folder.
-		// we do want to remove the folder anyway
-		os.RemoveAll(s.TempDirectory)
-		return err
+		return nil, err
 	}
-
-	for _, dir := range []string{
-		filepath.Dir(singularityPath),
-		singularityPath} {
-
-		err = CreateCatalogIntoDir(CVMFSRepo, dir)
-		if err != nil {
-			LogE(err).WithFields(log.Fields{
-				"directory": dir}).Error(
-				"Impossible to create subcatalog in super-directory.")
-		} else {
-			Log().WithFields(log.Fields{
-				"directory": dir}).Info(
-				"Created subcatalog in directory")
-		}
-
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Blob not received, status code: %d", resp.StatusCode)
 	}
-
-	// lets create the symlink
-	err = CreateSymlinkIntoCVMFS(CVMFSRepo, symlinkPath, singularityPath)
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		LogE(err).Error("Error in creating the symlink for the singularity Image")
-		return err
+		return nil, err
 	}
-	return nil
+	expected, err := digest.Parse(expectedDigest)
+	if err != nil {
+		return nil, err
+	}
+	if got := expected.Algorithm().FromBytes(body); got != expected {
+		return nil, fmt.Errorf("Digest mismatch, expected %s got %s", expected, got)
+	}
+	return body, nil
+}
+
+func GetSingularityPathFromManifest(manifest da.Manifest) string {
+	digest := withoutAlgorithm(manifest.Config.Digest)
+	return filepath.Join(".flat", digest[0:2], digest)
 }
 
-func (img Image) getByteManifest() ([]byte, error) {
-	pass, err := getPassword()
+// here is where in the FS we are going to store the singularity image
+func (img Image) GetSingularityPath() (string, error) {
+	manifest, err := img.GetManifest()
 	if err != nil {
-		LogE(err).Warning("Unable to retrieve the password, trying to get the manifest anonymously.")
-		return img.getAnonymousManifest()
+		LogE(err).Error("Error in getting the manifest to figureout the singularity path")
+		return "", err
 	}
-	return img.getManifestWithPassword(pass)
+	return GetSingularityPathFromManifest(manifest), nil
 }
 
-func (img Image) getAnonymousManifest() ([]byte, error) {
-	return getManifestWithUsernameAndPassword(img, "", "")
+// the human friendly symlink to the singularity image
+func (img Image) singularitySymlinkPath() string {
+	return filepath.Join(img.Registry, img.Repository+":"+img.GetSimpleReference()+img.platformSuffix())
 }
 
-func (img Image) getManifestWithPassword(password string) ([]byte, error) {
-	return getManifestWithUsernameAndPassword(img, img.User, password)
+func (img Image) getByteManifest() ([]byte, string, error) {
+	return getManifestWithCredentials(img, img.GetCredentials())
 }
 
-func getManifestWithUsernameAndPassword(img Image, user, pass string) ([]byte, error) {
+func getManifestWithCredentials(img Image, credentials Credentials) ([]byte, string, error) {
 
 	url := img.GetManifestUrl()
 
-	token, err := firstRequestForAuth(url, user, pass)
-	if err != nil {
-		LogE(err).Error("Error in getting the authentication token")
-		return nil, err
+	auth := newRegistryAuth(credentials)
+
+	// the mirrors first, the registry is the last source
+	sources := img.sources(url, auth)
+	var err error
+	for i, source := range sources {
+		var body []byte
+		var mediaType string
+		body, mediaType, err = fetchManifest(img, source)
+		if err == nil {
+			return body, mediaType, nil
+		}
+		if i < len(sources)-1 {
+			LogE(err).WithFields(log.Fields{"url": source.url}).Warning(
+				"Error in getting the manifest from the mirror, trying the next source")
+		}
 	}
+	LogE(err).WithFields(log.Fields{"url": url}).Error("Error in getting the manifest")
+	return nil, "", err
+}
 
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", url, nil)
+func fetchManifest(img Image, source registrySource) ([]byte, string, error) {
+	req, err := http.NewRequest("GET", source.url, nil)
 	if err != nil {
 		LogE(err).Error("Impossible to create a HTTP request")
-		return nil, err
+		return nil, "", err
 	}
 
-	req.Header.Set("Authorization", token)
-	req.Header.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json")
+	req.Header.Set("Accept", strings.Join(da.ManifestMediaTypes, ", "))
 
-	resp, err := client.Do(req)
+	resp, err := source.auth.Do(req)
 	if err != nil {
 		LogE(err).Error("Error in making the HTTP request")
-		return nil, err
+		return nil, "", err
 	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		LogE(err).Error("Error in reading the second http response")
-		return nil, err
+		return nil, "", err
 	}
-	return body, nil
-}
-
-func firstRequestForAuth(url, user, pass string) (token string, err error) {
-	resp, err := http.Get(url)
-	if err != nil {
-		LogE(err).Error("Error in making the first request for auth")
-		return "", err
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("Error in getting the manifest, status code: %d", resp.StatusCode)
+		return nil, "", err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 401 {
-		log.WithFields(log.Fields{
-			"status code": resp.StatusCode,
-		}).Info("Expected status code 401, print body anyway.")
-		body, err := ioutil.ReadAll(resp.Body)
+	// a manifest asked by digest must match it, wherever it comes from
+	if img.Digest != "" {
+		expected, err := digest.Parse(img.Digest)
 		if err != nil {
-			LogE(err).Error("Error in reading the first http response")
+			return nil, "", err
+		}
+		if got := expected.Algorithm().FromBytes(body); got != expected {
+			return nil, "", fmt.Errorf("Digest mismatch of the manifest, expected %s got %s", expected, got)
 		}
-		fmt.Println(string(body))
-		return "", err
-	}
-	WwwAuthenticate := resp.Header["Www-Authenticate"][0]
-	token, err = requestAuthToken(WwwAuthenticate, user, pass)
-	if err != nil {
-		LogE(err).Error("Error in getting the authentication token")
-		return "", err
 	}
-	return token, nil
+	return body, manifestMediaType(resp.Header.Get("Content-Type"), body), nil
+}
 
+// the registry should tell us the media type in the Content-Type header, if
+// it doesn't we fallback to the mediaType field in the manifest itself
+func manifestMediaType(contentType string, body []byte) string {
+	contentType = strings.TrimSpace(strings.Split(contentType, ";")[0])
+	if contentType != "" && contentType != "application/json" && contentType != "text/plain" {
+		return contentType
+	}
+	var probe struct {
+		MediaType string
+		Manifests []json.RawMessage
+	}
+	if err := json.Unmarshal(body, &probe); err != nil {
+		return contentType
+	}
+	if probe.MediaType != "" {
+		return probe.MediaType
+	}
+	if probe.Manifests != nil {
+		return da.MediaTypeOCIIndex
+	}
+	return contentType
 }
 
 func getLayerUrl(img Image, layer da.Layer) string {
@@ -387,194 +409,240 @@ func getLayerUrl(img Image, layer da.Layer) string {
 }
 
 type downloadedLayer struct {
-	Name string
-	Path string
+	Name         string
+	Path         string
+	Verification LayerVerification
+	// the entries of the layer, relative to its root
+	Files   map[string]LayerFile
+	Elapsed time.Duration
+	// set if the layer could not be downloaded, there is no Path then
+	Err error
 }
 
-func (img Image) GetLayers(layersChan chan<- downloadedLayer, manifestChan chan<- string, stopGettingLayers <-chan bool, rootPath string) error {
+// the result of checking the compressed blob we downloaded against the digest
+// in the manifest, it is stored alongside the layer in the repository
+type LayerVerification struct {
+	Digest     string    `json:"digest"`
+	Size       int64     `json:"size"`
+	Source     string    `json:"source"`
+	Verified   bool      `json:"verified"`
+	VerifiedAt time.Time `json:"verified_at"`
+}
+
+// the layers of the manifest for which isIngested returns true are not
+// downloaded, they are sent without Path. A layer that can not be downloaded
+// is sent with its Err, the other downloads are canceled, since the image can
+// not be complete anyway, and an error is returned. Canceling ctx cancels all
+// the downloads.
+func (img Image) GetLayers(ctx context.Context, manifest da.Manifest, layersChan chan<- downloadedLayer, rootPath string, isIngested func(da.Layer) bool) (err error) {
 	defer close(layersChan)
-	defer close(manifestChan)
 
-	user := img.User
-	pass, err := getPassword()
-	if err != nil {
-		LogE(err).Warning("Unable to retrieve the password, trying to get the layers anonymously.")
-		user = ""
-		pass = ""
-	}
+	downloads, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var failedLock sync.Mutex
+	var failed error
 
-	// then we try to get the manifest from our database
-	manifest, err := img.GetManifest()
-	if err != nil {
-		LogE(err).Warn("Error in getting the manifest")
-		return err
+	var toDownload []da.Layer
+	var wg sync.WaitGroup
+	for _, layer := range manifest.Layers {
+		if isIngested != nil && isIngested(layer) {
+			LogC(ctx).WithFields(log.Fields{"layer": layer.Digest}).Info(
+				"Layer already in the repository, not downloading it")
+			wg.Add(1)
+			go func(layer da.Layer) {
+				defer wg.Done()
+				layersChan <- downloadedLayer{Name: layer.Digest}
+			}(layer)
+			continue
+		}
+		toDownload = append(toDownload, layer)
 	}
 
-	// A first request is used to get the authentication
-	firstLayer := manifest.Layers[0]
-	layerUrl := getLayerUrl(img, firstLayer)
-	token, err := firstRequestForAuth(layerUrl, user, pass)
-	if err != nil {
-		return err
-	}
+	// the same authorization for all the layers
+	auth := newRegistryAuth(img.GetCredentials())
 
-	var wg sync.WaitGroup
-	defer wg.Wait()
 	// at this point we iterate each layer and we download it.
-	for _, layer := range manifest.Layers {
+	for _, layer := range toDownload {
 		wg.Add(1)
 		go func(layer da.Layer) {
 			defer wg.Done()
-			Log().WithFields(log.Fields{"layer": layer.Digest}).Info("Start working on layer")
-			toSend, err := img.downloadLayer(layer, token, rootPath)
+			LogC(ctx).WithFields(log.Fields{"layer": layer.Digest}).Info("Start working on layer")
+			start := time.Now()
+			toSend, err := img.downloadLayer(downloads, layer, auth, rootPath)
 			if err != nil {
-				LogE(err).Error("Error in downloading a layer")
+				failedLock.Lock()
+				switch {
+				case ctx.Err() != nil:
+					err = fmt.Errorf("Download canceled: %s", ctx.Err())
+					if failed == nil {
+						failed = err
+					}
+				case failed == nil:
+					failed = fmt.Errorf("Impossible to download the layer %s: %s", layer.Digest, err)
+					LogCE(ctx, err).WithFields(log.Fields{"layer": layer.Digest}).Error(
+						"Error in downloading a layer, canceling the other downloads")
+					cancel()
+				case downloads.Err() != nil:
+					err = fmt.Errorf("Download canceled after the failure of another layer")
+				}
+				failedLock.Unlock()
+				layersChan <- downloadedLayer{Name: layer.Digest, Err: err}
 				return
 			}
+			toSend.Elapsed = time.Since(start)
 			layersChan <- toSend
 		}(layer)
 	}
 
-	// finally we marshal the manifest and store it into a file
-	manifestBytes, err := json.Marshal(manifest)
-	if err != nil {
-		LogE(err).Error("Error in marshaling the manifest")
-		return err
-	}
-	manifestPath := filepath.Join(rootPath, "manifest.json")
-	err = ioutil.WriteFile(manifestPath, manifestBytes, 0666)
-	if err != nil {
-		LogE(err).Error("Error in writing the manifest to file")
-		return err
-	}
-	// ship the manifest file
-	manifestChan <- manifestPath
+	defer func() {
+		wg.Wait()
+		if err == nil {
+			err = failed
+		}
+	}()
 	return nil
 }
 
-func (img Image) downloadLayer(layer da.Layer, token, rootPath string) (toSend downloadedLayer, err error) {
-	user := img.User
-	pass, err := getPassword()
-	if err != nil {
-		LogE(err).Warning("Unable to retrieve the password, trying to get the layers anonymously.")
-		user = ""
-		pass = ""
-	}
+func (img Image) downloadLayer(ctx context.Context, layer da.Layer, auth *registryAuth, rootPath string) (toSend downloadedLayer, err error) {
 	layerUrl := getLayerUrl(img, layer)
-	if token == "" {
-		token, err = firstRequestForAuth(layerUrl, user, pass)
-		if err != nil {
-			return
+	if auth == nil {
+		auth = newRegistryAuth(img.GetCredentials())
+	}
+	// foreign layers are downloaded from their own URLs, we never send
+	// them the token of the registry
+	var urls []string
+	var auths []*registryAuth
+	if da.IsForeignLayer(layer.MediaType) && len(layer.URLs) > 0 {
+		urls = layer.URLs
+		auths = make([]*registryAuth, len(urls))
+	} else {
+		// the mirrors first, then the registry
+		for _, source := range img.sources(layerUrl, auth) {
+			urls = append(urls, source.url)
+			auths = append(auths, source.auth)
 		}
 	}
+	// other wishes with the same layer wait for us and find it in the cache
+	unlock := lockBlob(layer.Digest)
+	defer unlock()
 	for i := 0; i <= 5; i++ {
-		err = nil
-		client := &http.Client{}
-		req, err := http.NewRequest("GET", layerUrl, nil)
-		if err != nil {
-			LogE(err).Error("Impossible to create the HTTP request.")
-			break
-		}
-		req.Header.Set("Authorization", token)
-		resp, err := client.Do(req)
-		Log().WithFields(log.Fields{"layer": layer.Digest}).Info("Make request for layer")
-		if err != nil {
-			break
+		if ctx.Err() != nil {
+			return toSend, ctx.Err()
 		}
-		if 200 <= resp.StatusCode && resp.StatusCode < 300 {
-
-			gread, err := gzip.NewReader(resp.Body)
-			if err != nil {
-				LogE(err).Warning("Error in creating the zip to unzip the layer")
-				continue
-			}
-
-			tmpFile, err := ioutil.TempFile(rootPath, "layer.*.tar")
-			if err != nil {
-				LogE(err).Warning("Error in creating buffer temp layer")
-				continue
-			}
-			defer tmpFile.Close()
-
-			_, err = io.Copy(tmpFile, gread)
-			if err != nil {
-				LogE(err).Warning("Error in copying the layer into the temp file")
-				os.Remove(tmpFile.Name())
-				continue
+		url := urls[i%len(urls)]
+		LogC(ctx).WithFields(log.Fields{"layer": layer.Digest, "url": url}).Info("Make request for layer")
+		var blobPath string
+		blobPath, err = fetchBlob(ctx, layer, url, auths[i%len(auths)])
+		if err == nil {
+			toSend, err = extractLayer(layer, blobPath, url, rootPath)
+			if err == nil {
+				return toSend, nil
 			}
-
-			toSend = downloadedLayer{Name: layer.Digest, Path: tmpFile.Name()}
-			return toSend, nil
-
-		} else {
-			Log().Warning("Received status code ", resp.StatusCode)
-			err = fmt.Errorf("Layer not received, status code: %s", resp.StatusCode)
-		}
-	}
-	return
-
-}
-
-func parseBearerToken(token string) (realm string, options map[string]string, err error) {
-	options = make(map[string]string)
-	args := token[7:]
-	keyValue := strings.Split(args, ",")
-	for _, kv := range keyValue {
-		splitted := strings.Split(kv, "=")
-		if len(splitted) != 2 {
-			err = fmt.Errorf("Wrong formatting of the token")
-			return
-		}
-		splitted[1] = strings.Trim(splitted[1], `"`)
-		if splitted[0] == "realm" {
-			realm = splitted[1]
-		} else {
-			options[splitted[0]] = splitted[1]
+			// the cached blob is wrong, we download it again
+			removeCachedBlob(layer.Digest)
 		}
+		LogCE(ctx, err).WithFields(log.Fields{"layer": layer.Digest, "attempt": i}).Warning(
+			"Error in downloading the layer")
 	}
 	return
 }
 
-func requestAuthToken(token, user, pass string) (authToken string, err error) {
-	realm, options, err := parseBearerToken(token)
+// decompress the blob of the layer, from the cache, into a tar file in
+// rootPath and verify it against the digest in the manifest
+func extractLayer(layer da.Layer, blobPath, url, rootPath string) (toSend downloadedLayer, err error) {
+	blob, err := os.Open(blobPath)
 	if err != nil {
 		return
 	}
-	req, err := http.NewRequest("GET", realm, nil)
+	defer blob.Close()
+
+	expected, err := digest.Parse(layer.Digest)
 	if err != nil {
 		return
 	}
+	// we hash the compressed stream while we decompress it
+	verifier := expected.Verifier()
+	counter := &byteCounter{}
+	compressed := io.TeeReader(blob, io.MultiWriter(verifier, counter))
 
-	query := req.URL.Query()
-	for k, v := range options {
-		query.Add(k, v)
-	}
-	if user != "" && pass != "" {
-		query.Add("offline_token", "true")
-		req.SetBasicAuth(user, pass)
+	uncompressed, err := decompressLayer(layer.MediaType, compressed)
+	if err != nil {
+		LogE(err).WithFields(log.Fields{"media type": layer.MediaType}).Warning(
+			"Error in creating the reader to decompress the layer")
+		return
 	}
-	req.URL.RawQuery = query.Encode()
+	defer uncompressed.Close()
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	defer resp.Body.Close()
-
-	if resp.StatusCode >= 400 {
-		err = fmt.Errorf("Authorization error %s", resp.Status)
+	tmpFile, err := ioutil.TempFile(rootPath, "layer.*.tar")
+	if err != nil {
+		LogE(err).Warning("Error in creating buffer temp layer")
 		return
 	}
+	defer tmpFile.Close()
 
-	var jsonResp map[string]interface{}
-	err = json.NewDecoder(resp.Body).Decode(&jsonResp)
+	_, err = io.Copy(tmpFile, uncompressed)
+	if err == nil {
+		// the decompressor may stop before the end of the stream, we
+		// need to hash every byte
+		_, err = io.Copy(ioutil.Discard, compressed)
+	}
 	if err != nil {
+		LogE(err).Warning("Error in copying the layer into the temp file")
+		os.Remove(tmpFile.Name())
 		return
 	}
-	authTokenInterface, ok := jsonResp["token"]
-	if ok {
-		authToken = "Bearer " + authTokenInterface.(string)
-	} else {
-		err = fmt.Errorf("Didn't get the token key from the server")
+	if !verifier.Verified() {
+		os.Remove(tmpFile.Name())
+		err = fmt.Errorf("Digest mismatch for layer %s, received %d bytes", layer.Digest, counter.n)
 		return
 	}
-	return
+	if layer.Size > 0 && int64(layer.Size) != counter.n {
+		os.Remove(tmpFile.Name())
+		err = fmt.Errorf("Size mismatch for layer %s, expected %d bytes got %d", layer.Digest, layer.Size, counter.n)
+		return
+	}
+	files, err := tarFileList(tmpFile.Name())
+	if err != nil {
+		LogE(err).Warning("Error in listing the files of the layer")
+		os.Remove(tmpFile.Name())
+		return
+	}
+	verification := LayerVerification{
+		Digest:     layer.Digest,
+		Size:       counter.n,
+		Source:     url,
+		Verified:   true,
+		VerifiedAt: time.Now().UTC(),
+	}
+	return downloadedLayer{Name: layer.Digest, Path: tmpFile.Name(), Verification: verification, Files: files}, nil
+}
+
+type byteCounter struct {
+	n int64
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// wrap the compressed stream of the layer into a reader that produces the
+// plain tar archive, the decompression depends on the media type
+func decompressLayer(mediaType string, compressed io.Reader) (io.ReadCloser, error) {
+	compression, err := da.GetLayerCompression(mediaType)
+	if err != nil {
+		return nil, err
+	}
+	switch compression {
+	case da.Gzip:
+		return gzip.NewReader(compressed)
+	case da.Zstd:
+		decoder, err := zstd.NewReader(compressed)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return ioutil.NopCloser(compressed), nil
+	}
 }
@@ -0,0 +1,275 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The JobQueue keeps the wishes submitted to the server and the jobs to run,
+// conversions and garbage collections, in a state directory: after a restart
+// the wishes are still there and the jobs not completed run again. The log of
+// each job is in logs/$ID.log inside the state directory.
+
+type JobKind string
+
+const (
+	JobConvert           JobKind = "convert"
+	JobGarbageCollection JobKind = "garbage-collection"
+)
+
+type JobStatus string
+
+const (
+	JobQueued  JobStatus = "queued"
+	JobRunning JobStatus = "running"
+	JobDone    JobStatus = "done"
+	JobFailed  JobStatus = "failed"
+)
+
+// how many completed jobs, with their logs, we keep around
+const maxCompletedJobs = 1000
+
+type Job struct {
+	Id           int               `json:"id"`
+	Kind         JobKind           `json:"kind"`
+	Wish         int               `json:"wish,omitempty"`
+	Repository   string            `json:"repository"`
+	ConvertAgain bool              `json:"convert_again,omitempty"`
+	DryRun       bool              `json:"dry_run,omitempty"`
+	Status       JobStatus         `json:"status"`
+	Submitted    time.Time         `json:"submitted"`
+	Started      time.Time         `json:"started"`
+	Finished     time.Time         `json:"finished"`
+	Error        string            `json:"error,omitempty"`
+	Report       *ConversionReport `json:"report,omitempty"`
+
+	GarbageCollection *GarbageCollectionResult `json:"garbage_collection,omitempty"`
+}
+
+func (j Job) completed() bool {
+	return j.Status == JobDone || j.Status == JobFailed
+}
+
+type jobQueueState struct {
+	NextWish int            `json:"next_wish"`
+	NextJob  int            `json:"next_job"`
+	Wishes   []WishFriendly `json:"wishes"`
+	Jobs     []Job          `json:"jobs"`
+}
+
+type JobQueue struct {
+	directory string
+
+	lock  sync.Mutex
+	state jobQueueState
+	// signaled when a job is submitted
+	wake chan struct{}
+}
+
+// open the queue stored in directory, creating it if it does not exist, the
+// jobs that were running when the queue was closed are queued again
+func OpenJobQueue(directory string) (*JobQueue, error) {
+	q := &JobQueue{directory: directory, wake: make(chan struct{}, 1)}
+	q.state.NextWish = 1
+	q.state.NextJob = 1
+	if err := os.MkdirAll(filepath.Join(directory, "logs"), 0755); err != nil {
+		LogE(err).WithFields(log.Fields{"directory": directory}).Error("Impossible to create the state directory")
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(q.statePath())
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &q.state); err != nil {
+		return nil, fmt.Errorf("Corrupted state file %s: %s", q.statePath(), err)
+	}
+	for i := range q.state.Jobs {
+		if q.state.Jobs[i].Status == JobRunning {
+			q.state.Jobs[i].Status = JobQueued
+		}
+	}
+	return q, nil
+}
+
+func (q *JobQueue) statePath() string {
+	return filepath.Join(q.directory, "state.json")
+}
+
+func (q *JobQueue) LogPath(job int) string {
+	return filepath.Join(q.directory, "logs", fmt.Sprintf("%d.log", job))
+}
+
+// write the state, the caller holds the lock
+func (q *JobQueue) save() error {
+	data, err := json.MarshalIndent(q.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp := q.statePath() + ".tmp"
+	if err = ioutil.WriteFile(temp, data, 0600); err != nil {
+		LogE(err).WithFields(log.Fields{"file": temp}).Error("Impossible to write the state of the queue")
+		return err
+	}
+	return os.Rename(temp, q.statePath())
+}
+
+// add the wish, or update the one with the same input, output, repository and
+// platform, and return it with its id
+func (q *JobQueue) AddWish(wish WishFriendly) (WishFriendly, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for i, w := range q.state.Wishes {
+		if w.InputName == wish.InputName && w.OutputName == wish.OutputName &&
+			w.CvmfsRepo == wish.CvmfsRepo && w.Platform == wish.Platform {
+			wish.Id = w.Id
+			q.state.Wishes[i] = wish
+			return wish, q.save()
+		}
+	}
+	wish.Id = q.state.NextWish
+	q.state.NextWish++
+	q.state.Wishes = append(q.state.Wishes, wish)
+	return wish, q.save()
+}
+
+func (q *JobQueue) Wishes() []WishFriendly {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return append([]WishFriendly{}, q.state.Wishes...)
+}
+
+func (q *JobQueue) Wish(id int) (WishFriendly, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, wish := range q.state.Wishes {
+		if wish.Id == id {
+			return wish, true
+		}
+	}
+	return WishFriendly{}, false
+}
+
+// queue the job, unless the same job is already waiting in the queue, and
+// return it with its id
+func (q *JobQueue) Submit(job Job) (Job, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for i, queued := range q.state.Jobs {
+		if queued.Status == JobQueued && queued.Kind == job.Kind &&
+			queued.Wish == job.Wish && queued.Repository == job.Repository &&
+			queued.DryRun == job.DryRun {
+			if job.ConvertAgain && !queued.ConvertAgain {
+				q.state.Jobs[i].ConvertAgain = true
+				if err := q.save(); err != nil {
+					return queued, err
+				}
+			}
+			return q.state.Jobs[i], nil
+		}
+	}
+	job.Id = q.state.NextJob
+	q.state.NextJob++
+	job.Status = JobQueued
+	job.Submitted = time.Now()
+	q.state.Jobs = append(q.state.Jobs, job)
+	if err := q.save(); err != nil {
+		return job, err
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+func (q *JobQueue) Jobs() []Job {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return append([]Job{}, q.state.Jobs...)
+}
+
+func (q *JobQueue) Job(id int) (Job, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, job := range q.state.Jobs {
+		if job.Id == id {
+			return job, true
+		}
+	}
+	return Job{}, false
+}
+
+// the most recent job of the wish
+func (q *JobQueue) LastJob(wish int) (Job, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for i := len(q.state.Jobs) - 1; i >= 0; i-- {
+		if q.state.Jobs[i].Kind == JobConvert && q.state.Jobs[i].Wish == wish {
+			return q.state.Jobs[i], true
+		}
+	}
+	return Job{}, false
+}
+
+// wait for the oldest job in the queue and mark it as running, false if ctx is
+// canceled before
+func (q *JobQueue) next(ctx context.Context) (Job, bool) {
+	for {
+		q.lock.Lock()
+		for i, job := range q.state.Jobs {
+			if job.Status == JobQueued {
+				q.state.Jobs[i].Status = JobRunning
+				q.state.Jobs[i].Started = time.Now()
+				if err := q.save(); err != nil {
+					LogE(err).Warning("Impossible to save the state of the queue, going on")
+				}
+				job = q.state.Jobs[i]
+				q.lock.Unlock()
+				return job, true
+			}
+		}
+		q.lock.Unlock()
+		select {
+		case <-q.wake:
+		case <-ctx.Done():
+			return Job{}, false
+		}
+	}
+}
+
+// store the result of the job and forget the oldest completed jobs
+func (q *JobQueue) finish(job Job) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	completed := 0
+	for i := range q.state.Jobs {
+		if q.state.Jobs[i].Id == job.Id {
+			q.state.Jobs[i] = job
+		}
+		if q.state.Jobs[i].completed() {
+			completed++
+		}
+	}
+	jobs := q.state.Jobs[:0]
+	for _, j := range q.state.Jobs {
+		if completed > maxCompletedJobs && j.completed() {
+			completed--
+			os.Remove(q.LogPath(j.Id))
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	q.state.Jobs = jobs
+	return q.save()
+}
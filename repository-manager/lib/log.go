@@ -1,6 +1,8 @@
 package lib
 
 import (
+	"context"
+
 	log "github.com/sirupsen/logrus"
 )
 
@@ -11,3 +13,24 @@ func LogE(err error) *log.Entry {
 func Log() *log.Entry {
 	return log.WithFields(log.Fields{})
 }
+
+type logEntryKey struct{}
+
+// the messages about the work of ctx are logged with entry and its fields,
+// ex: the id of the job of the server
+func WithLogEntry(ctx context.Context, entry *log.Entry) context.Context {
+	return context.WithValue(ctx, logEntryKey{}, entry)
+}
+
+// as Log, with the fields of the entry of ctx
+func LogC(ctx context.Context) *log.Entry {
+	if entry, ok := ctx.Value(logEntryKey{}).(*log.Entry); ok {
+		return entry.WithFields(log.Fields{})
+	}
+	return Log()
+}
+
+// as LogE, with the fields of the entry of ctx
+func LogCE(ctx context.Context, err error) *log.Entry {
+	return LogC(ctx).WithFields(log.Fields{"error": err})
+}
@@ -0,0 +1,161 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A registry can have mirrors, like pull-through caches, that are tried in
+// order before the registry itself for the manifests and the blobs. A mirror
+// that does not answer, or answers with a server error, is skipped for a
+// while, longer after each failure, and used again after it answers
+// correctly. A mirror that simply does not have the content (404) stays
+// healthy, we just move to the next one. The content from the mirrors is
+// verified against the digests like the one from the registry.
+
+type registryMirror struct {
+	base *url.URL
+
+	lock      sync.Mutex
+	failures  int
+	downUntil time.Time
+}
+
+var (
+	mirrorsLock     sync.Mutex
+	registryMirrors = make(map[string][]*registryMirror)
+)
+
+const (
+	mirrorBackoff    = 30 * time.Second
+	mirrorMaxBackoff = 10 * time.Minute
+)
+
+// set the mirrors of the upstream registry, in order of preference, no
+// mirrors removes them
+func SetRegistryMirrors(upstream string, mirrors []string) error {
+	var parsed []*registryMirror
+	for _, mirror := range mirrors {
+		if !strings.Contains(mirror, "://") {
+			mirror = "https://" + mirror
+		}
+		base, err := url.Parse(strings.TrimRight(mirror, "/"))
+		if err != nil {
+			return fmt.Errorf("Wrong mirror %s: %s", mirror, err)
+		}
+		if base.Host == "" || (base.Scheme != "http" && base.Scheme != "https") {
+			return fmt.Errorf("Wrong mirror %s", mirror)
+		}
+		parsed = append(parsed, &registryMirror{base: base})
+	}
+	mirrorsLock.Lock()
+	defer mirrorsLock.Unlock()
+	if len(parsed) == 0 {
+		delete(registryMirrors, normalizeRegistry(upstream))
+		return nil
+	}
+	registryMirrors[normalizeRegistry(upstream)] = parsed
+	return nil
+}
+
+// parse the mirrors of the command line, ex:
+// registry.hub.docker.com=https://mirror.example.ch,http://proxy:5000
+func ParseRegistryMirrors(spec string) (upstream string, mirrors []string, err error) {
+	upstreamMirrors := strings.SplitN(spec, "=", 2)
+	if len(upstreamMirrors) != 2 || upstreamMirrors[0] == "" || upstreamMirrors[1] == "" {
+		return "", nil, fmt.Errorf("Wrong mirror specification %s, expected REGISTRY=MIRROR[,MIRROR...]", spec)
+	}
+	for _, mirror := range strings.Split(upstreamMirrors[1], ",") {
+		if mirror = strings.TrimSpace(mirror); mirror != "" {
+			mirrors = append(mirrors, mirror)
+		}
+	}
+	return strings.TrimSpace(upstreamMirrors[0]), mirrors, nil
+}
+
+func mirrorsFor(registry string) []*registryMirror {
+	mirrorsLock.Lock()
+	defer mirrorsLock.Unlock()
+	return registryMirrors[normalizeRegistry(registry)]
+}
+
+func (m *registryMirror) healthy() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return time.Now().After(m.downUntil)
+}
+
+// update the health of the mirror with the result of a request
+func (m *registryMirror) observe(resp *http.Response, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err == nil && resp.StatusCode < 500 {
+		if m.failures > 0 {
+			Log().WithFields(log.Fields{"mirror": m.base.String()}).Info("Mirror healthy again")
+		}
+		m.failures = 0
+		m.downUntil = time.Time{}
+		return
+	}
+	m.failures++
+	backoff := mirrorBackoff << uint(m.failures-1)
+	if backoff > mirrorMaxBackoff || backoff <= 0 {
+		backoff = mirrorMaxBackoff
+	}
+	m.downUntil = time.Now().Add(backoff)
+	entry := Log()
+	if err != nil {
+		entry = LogE(err)
+	} else {
+		entry = entry.WithFields(log.Fields{"status code": resp.StatusCode})
+	}
+	entry.WithFields(log.Fields{"mirror": m.base.String(), "failures": m.failures, "retry in": backoff}).Warning(
+		"Mirror not working, skipping it for a while")
+}
+
+// a place to get the content from: a mirror or the registry itself
+type registrySource struct {
+	url  string
+	auth *registryAuth
+}
+
+// the sources for the url of the registry: the healthy mirrors, in order,
+// then the registry, which uses auth
+func (img Image) sources(registryUrl string, auth *registryAuth) []registrySource {
+	var sources []registrySource
+	mirrors := mirrorsFor(img.Registry)
+	if len(mirrors) > 0 {
+		parsed, err := url.Parse(registryUrl)
+		if err != nil {
+			LogE(err).WithFields(log.Fields{"url": registryUrl}).Warning("Wrong url, not using the mirrors")
+			mirrors = nil
+		}
+		for _, mirror := range mirrors {
+			if !mirror.healthy() {
+				continue
+			}
+			mirrorUrl := *mirror.base
+			mirrorUrl.Path = mirror.base.Path + parsed.Path
+			mirrorUrl.RawQuery = parsed.RawQuery
+			mirrorAuth := newRegistryAuth(mirrorCredentials(mirror))
+			mirrorAuth.mirror = mirror
+			sources = append(sources, registrySource{url: mirrorUrl.String(), auth: mirrorAuth})
+		}
+	}
+	return append(sources, registrySource{url: registryUrl, auth: auth})
+}
+
+// the mirrors use their own credentials, from the docker configuration
+func mirrorCredentials(mirror *registryMirror) Credentials {
+	credentials, err := GetCredentials(mirror.base.Host, "", "")
+	if err != nil {
+		return Credentials{}
+	}
+	return credentials
+}
@@ -0,0 +1,145 @@
+package lib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestConvertWishFromMirror(t *testing.T) {
+	cvmfs := newFakeCvmfs(t, testRepo)
+	defer cvmfs.Close()
+	registry := newFakeRegistry()
+	defer registry.Close()
+	mirror := newFakeRegistry()
+	defer mirror.Close()
+	_, restore := fakePush(t, registry)
+	defer restore()
+
+	layers := map[string]string{"etc/os-release": "fake"}
+	manifest := registry.AddImage(t, "library/test", "latest", layers)
+	mirror.AddImage(t, "library/test", "latest", layers)
+	if err := SetRegistryMirrors(registry.Host(), []string{mirror.URL}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetRegistryMirrors(registry.Host(), nil)
+
+	_, err := ConvertWish(context.Background(), testWish(registry, "library/test", "latest"), false, false, false)
+	if err != nil {
+		t.Fatalf("Error in converting the wish: %s", err)
+	}
+	for _, request := range registry.Requests() {
+		if strings.Contains(request, "/manifests/") || strings.Contains(request, "/blobs/") {
+			t.Errorf("Request to the registry instead of the mirror: %s", request)
+		}
+	}
+	if len(blobRequests(mirror, "library/test", manifest.Layers[0].Digest)) != 1 {
+		t.Errorf("The layer was not downloaded from the mirror: %v", mirror.Requests())
+	}
+}
+
+func TestMirrorFallbackAndHealth(t *testing.T) {
+	registry := newFakeRegistry()
+	defer registry.Close()
+	registry.AddImage(t, "library/test", "latest", map[string]string{"etc/os-release": "fake"})
+	image, err := ParseImage("http://" + registry.Host() + "/library/test:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	broken := 0
+	brokenMirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		broken++
+		lock.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer brokenMirror.Close()
+	// a mirror without the image
+	emptyMirror := newFakeRegistry()
+	defer emptyMirror.Close()
+
+	if err := SetRegistryMirrors(registry.Host(), []string{brokenMirror.URL, emptyMirror.URL}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetRegistryMirrors(registry.Host(), nil)
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := image.getByteManifest(); err != nil {
+			t.Fatalf("The registry was not used after the mirrors: %s", err)
+		}
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if broken != 1 {
+		t.Errorf("The broken mirror should be skipped after the first failure, got %d requests", broken)
+	}
+	if !mirrorsFor(registry.Host())[1].healthy() {
+		t.Errorf("A mirror without the image was marked as broken")
+	}
+	if n := countRequests(registry, "GET /v2/library/test/manifests/latest"); n != 2 {
+		t.Errorf("Expected 2 requests to the registry, got %d", n)
+	}
+}
+
+func TestBlobRedirect(t *testing.T) {
+	registry := newFakeRegistry()
+	defer registry.Close()
+	manifest := registry.AddImage(t, "library/test", "latest", map[string]string{"etc/os-release": "fake"})
+	layer := manifest.Layers[0]
+
+	var lock sync.Mutex
+	var authorizations []string
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		authorizations = append(authorizations, req.Header.Get("Authorization"))
+		lock.Unlock()
+		blob, ok := registry.Blob(strings.TrimPrefix(req.URL.Path, "/"))
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write(blob)
+	}))
+	defer storage.Close()
+	registry.RedirectBlobs(storage.URL)
+
+	image, err := ParseImage("http://" + registry.Host() + "/library/test:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := newRegistryAuth(Credentials{})
+	if _, err := getVerifiedBlob(getLayerUrl(image, layer), auth, layer.Digest); err != nil {
+		t.Fatalf("Error in following the redirect: %s", err)
+	}
+	if auth.get() == "" {
+		t.Errorf("The registry was not authenticated")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(authorizations) != 1 || authorizations[0] != "" {
+		t.Errorf("The authorization of the registry was sent to the storage: %v", authorizations)
+	}
+}
+
+func TestParseRegistryMirrors(t *testing.T) {
+	upstream, mirrors, err := ParseRegistryMirrors("registry.hub.docker.com=https://mirror.example.ch, http://proxy:5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upstream != "registry.hub.docker.com" || len(mirrors) != 2 || mirrors[1] != "http://proxy:5000" {
+		t.Errorf("Wrong mirrors: %s %v", upstream, mirrors)
+	}
+	for _, wrong := range []string{"registry.hub.docker.com", "=https://mirror", "registry="} {
+		if _, _, err := ParseRegistryMirrors(wrong); err == nil {
+			t.Errorf("Expected an error for %s", wrong)
+		}
+	}
+	if err := SetRegistryMirrors("registry.example.ch", []string{"ftp://mirror"}); err == nil {
+		t.Errorf("Expected an error for a mirror that is not http")
+	}
+}
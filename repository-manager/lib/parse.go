@@ -38,7 +38,6 @@ func ParseImage(image string) (img Image, err error) {
 
 	}
 	if len(colonPathSplitted) > 3 {
-		fmt.Println(colonPathSplitted)
 		return Image{}, fmt.Errorf("Impossible to parse the string into an image, too many `:` in : %s", image)
 	}
 	// the colon `:` is used also as separator in the digest between sha256
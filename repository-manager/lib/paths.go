@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// All the paths inside a repository are computed from the root of the
+// repository returned by RepositoryRoot. By default the repositories are
+// mounted in /cvmfs/$REPO, the mount root can be changed for all the
+// repositories with SetCVMFSMountRoot and the root of a single repository
+// with SetRepositoryRoot, ex: /var/spool/cvmfs/$REPO/rdonly
+
+var (
+	rootsLock       sync.RWMutex
+	cvmfsMountRoot  = filepath.Join("/", "cvmfs")
+	repositoryRoots = make(map[string]string)
+)
+
+// the repositories are mounted in root/$REPO
+func SetCVMFSMountRoot(root string) {
+	rootsLock.Lock()
+	defer rootsLock.Unlock()
+	cvmfsMountRoot = filepath.Clean(root)
+}
+
+// the repository is mounted exactly in root, an empty root restores the
+// default
+func SetRepositoryRoot(CVMFSRepo, root string) {
+	rootsLock.Lock()
+	defer rootsLock.Unlock()
+	if root == "" {
+		delete(repositoryRoots, CVMFSRepo)
+		return
+	}
+	repositoryRoots[CVMFSRepo] = filepath.Clean(root)
+}
+
+func RepositoryRoot(CVMFSRepo string) string {
+	rootsLock.RLock()
+	defer rootsLock.RUnlock()
+	if root, ok := repositoryRoots[CVMFSRepo]; ok {
+		return root
+	}
+	return filepath.Join(cvmfsMountRoot, CVMFSRepo)
+}
+
+// cvmfs_server always mounts the repository it publishes, writable during a
+// transaction, in /cvmfs/$REPO, whatever root we read the repository from
+var unionMountRoot = filepath.Join("/", "cvmfs")
+
+// where the publishers write the repository
+func unionMountPath(CVMFSRepo string) string {
+	return filepath.Join(unionMountRoot, CVMFSRepo)
+}
+
+// the absolute path of something inside the repository
+// ex: (unpacked.cern.ch, .layers, ab) -> /cvmfs/unpacked.cern.ch/.layers/ab
+func RepositoryPath(CVMFSRepo string, path ...string) string {
+	return filepath.Join(append([]string{RepositoryRoot(CVMFSRepo)}, path...)...)
+}
+
+// the path as the clients see it, they always mount the repository in /cvmfs,
+// wherever we have it
+func ClientPath(CVMFSRepo string, path ...string) string {
+	return filepath.Join(append([]string{"/", "cvmfs", CVMFSRepo}, path...)...)
+}
+
+// from /cvmfs/$REPO/foo/bar -> foo/bar
+func TrimCVMFSRepoPrefix(CVMFSRepo, path string) string {
+	relative, err := RelativeRepositoryPath(CVMFSRepo, path)
+	if err != nil {
+		return path
+	}
+	return relative
+}
+
+// from /cvmfs/$REPO/foo/bar -> foo/bar, the root of the repository gives an
+// empty string, a path outside the repository is an error
+func RelativeRepositoryPath(CVMFSRepo, path string) (string, error) {
+	relative, err := filepath.Rel(RepositoryRoot(CVMFSRepo), path)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, "../") {
+		return "", fmt.Errorf("Path %s not in the CVMFS repository %s", path, CVMFSRepo)
+	}
+	if relative == "." {
+		return "", nil
+	}
+	return relative, nil
+}
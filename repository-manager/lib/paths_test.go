@@ -0,0 +1,48 @@
+package lib
+
+import (
+	"testing"
+)
+
+func TestRepositoryPaths(t *testing.T) {
+	defer SetCVMFSMountRoot(cvmfsMountRoot)
+	defer SetRepositoryRoot("other.example.ch", "")
+
+	SetCVMFSMountRoot("/srv/cvmfs")
+	SetRepositoryRoot("other.example.ch", "/var/spool/cvmfs/other.example.ch/rdonly")
+
+	tests := []struct {
+		repo     string
+		path     string
+		relative string
+	}{
+		{testRepo, "/srv/cvmfs/" + testRepo + "/.layers/ab/abcdef/layerfs", ".layers/ab/abcdef/layerfs"},
+		{testRepo, "/srv/cvmfs/" + testRepo, ""},
+		{"other.example.ch", "/var/spool/cvmfs/other.example.ch/rdonly/.metadata/remove-schedule.json", ".metadata/remove-schedule.json"},
+	}
+	for _, test := range tests {
+		relative, err := RelativeRepositoryPath(test.repo, test.path)
+		if err != nil {
+			t.Errorf("Error for %s: %s", test.path, err)
+		}
+		if relative != test.relative {
+			t.Errorf("Wrong relative path for %s: %s", test.path, relative)
+		}
+	}
+
+	if path := LayerRootfsPath(testRepo, "abcdef"); path != "/srv/cvmfs/"+testRepo+"/.layers/ab/abcdef/layerfs" {
+		t.Errorf("Wrong layer path: %s", path)
+	}
+	if path := RemoveScheduleLocation("other.example.ch"); path != "/var/spool/cvmfs/other.example.ch/rdonly/.metadata/remove-schedule.json" {
+		t.Errorf("Wrong remove schedule path: %s", path)
+	}
+	if path := ClientPath("other.example.ch", "singularity"); path != "/cvmfs/other.example.ch/singularity" {
+		t.Errorf("Wrong client path: %s", path)
+	}
+
+	for _, outside := range []string{"/srv/cvmfs", "/srv/cvmfs/" + testRepo + "/../other", "/cvmfs/" + testRepo + "/foo"} {
+		if _, err := RelativeRepositoryPath(testRepo, outside); err == nil {
+			t.Errorf("Path %s should be outside the repository", outside)
+		}
+	}
+}
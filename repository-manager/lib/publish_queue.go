@@ -0,0 +1,51 @@
+package lib
+
+import (
+	"sync"
+)
+
+// `cvmfs_server transaction` is exclusive on a repository, hence when we
+// convert several wishes concurrently all the operations that open a
+// transaction (or ingest) must be serialized. Each repository has its own
+// queue, served by a single goroutine, that runs one job at the time.
+
+type publishJob struct {
+	job  func() error
+	done chan error
+}
+
+type publishQueue struct {
+	jobs chan publishJob
+}
+
+var (
+	publishQueuesLock sync.Mutex
+	publishQueues     = make(map[string]*publishQueue)
+)
+
+func getPublishQueue(CVMFSRepo string) *publishQueue {
+	publishQueuesLock.Lock()
+	defer publishQueuesLock.Unlock()
+
+	queue, ok := publishQueues[CVMFSRepo]
+	if ok {
+		return queue
+	}
+	queue = &publishQueue{jobs: make(chan publishJob)}
+	go func() {
+		for job := range queue.jobs {
+			job.done <- job.job()
+		}
+	}()
+	publishQueues[CVMFSRepo] = queue
+	return queue
+}
+
+// run the job in the publish queue of the repository and wait for it to
+// complete, the job must not enqueue other jobs for the same repository or
+// it will deadlock
+func InRepositoryQueue(CVMFSRepo string, job func() error) error {
+	done := make(chan error, 1)
+	getPublishQueue(CVMFSRepo).jobs <- publishJob{job: job, done: done}
+	return <-done
+}
@@ -0,0 +1,371 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	copy "github.com/otiai10/copy"
+	log "github.com/sirupsen/logrus"
+)
+
+// A Publisher is what actually modifies a repository. The Transaction
+// collects the operations and, on Commit, opens a transaction on the
+// publisher, applies all of them and finally publishes or aborts. The layers
+// are not extracted inside a transaction, they are ingested with their own
+// publish, see Ingest.
+//
+// All the paths are relative to the root of the repository, ex: .layers/ab/abcd
+type Publisher interface {
+	// open a transaction on the repository, canceling ctx gives up waiting
+	// for it, a transaction is never left half opened
+	Transaction(ctx context.Context) error
+	// publish what was written since the transaction was opened
+	Publish() error
+	// throw away what was written since the transaction was opened
+	Abort() error
+
+	Lstat(path string) (os.FileInfo, error)
+	ReadFile(path string) ([]byte, error)
+	// create or truncate the file and fill it with the content
+	WriteFile(path string, content io.Reader) error
+	// create the directory and all its parents
+	MakeDirectory(path string) error
+	// copy a whole directory from the normal filesystem into path
+	CopyDirectory(source, path string) error
+	// create a symlink in path, target is stored as it is
+	Symlink(path, target string) error
+	// remove path and, if it is a directory, all its content
+	Remove(path string) error
+
+	// ingest the (uncompressed) tarball into path, with a catalog at its
+	// root, in a transaction of its own, hence never while a transaction is
+	// open. With overwrite what is in path is removed first
+	Ingest(ctx context.Context, tarball, path string, overwrite bool) error
+}
+
+const (
+	PublisherCvmfsServer = "cvmfs_server"
+	PublisherGateway     = "gateway"
+	PublisherDirectory   = "directory"
+)
+
+type PublisherConfig struct {
+	// one of PublisherCvmfsServer, PublisherGateway or PublisherDirectory
+	Type string
+	// gateway only, the subpath of the repository we ask the lease for,
+	// empty means the whole repository
+	LeasePath string
+	// gateway only, how many times we try to acquire a busy lease
+	LeaseRetries int
+	// directory only, the repositories are stored, and read, in
+	// Directory/$REPO
+	Directory string
+}
+
+var publisherConfig = PublisherConfig{Type: PublisherCvmfsServer}
+
+// select the publisher used by all the following transactions
+func SetPublisher(config PublisherConfig) error {
+	switch config.Type {
+	case PublisherCvmfsServer:
+	case PublisherGateway:
+		if config.LeaseRetries < 1 {
+			config.LeaseRetries = 1
+		}
+	case PublisherDirectory:
+		if config.Directory == "" {
+			return fmt.Errorf("The directory publisher needs a directory")
+		}
+		// what we publish must be found by who reads the repositories
+		SetCVMFSMountRoot(config.Directory)
+	default:
+		return fmt.Errorf("Unknown publisher: %s", config.Type)
+	}
+	publisherConfig = config
+	return nil
+}
+
+// the publisher of the repository, as selected with SetPublisher
+func GetPublisher(CVMFSRepo string) Publisher {
+	config := publisherConfig
+	switch config.Type {
+	case PublisherGateway:
+		return &gatewayPublisher{
+			localPublisher: localPublisher{
+				readRoot:  RepositoryRoot(CVMFSRepo),
+				writeRoot: unionMountPath(CVMFSRepo)},
+			CVMFSRepo: CVMFSRepo,
+			leasePath: strings.Trim(config.LeasePath, "/"),
+			retries:   config.LeaseRetries}
+	case PublisherDirectory:
+		directory := filepath.Join(config.Directory, CVMFSRepo)
+		return &directoryPublisher{
+			localPublisher: localPublisher{readRoot: directory, writeRoot: directory}}
+	default:
+		return &cvmfsServerPublisher{
+			localPublisher: localPublisher{
+				readRoot:  RepositoryRoot(CVMFSRepo),
+				writeRoot: unionMountPath(CVMFSRepo)},
+			CVMFSRepo: CVMFSRepo}
+	}
+}
+
+// all the file operations on a writable directory, the publishers below
+// only differ on how they open and close the transaction.
+// The repository is read from where it is configured to be, ex:
+// /var/spool/cvmfs/$REPO/rdonly, that may be read only, and written through
+// the union mount, /cvmfs/$REPO, the only place where a transaction is
+// writable
+type localPublisher struct {
+	readRoot  string
+	writeRoot string
+}
+
+func (p *localPublisher) readPath(path string) string {
+	return filepath.Join(p.readRoot, filepath.Clean("/"+path))
+}
+
+func (p *localPublisher) writePath(path string) string {
+	return filepath.Join(p.writeRoot, filepath.Clean("/"+path))
+}
+
+func (p *localPublisher) Lstat(path string) (os.FileInfo, error) {
+	return os.Lstat(p.readPath(path))
+}
+
+func (p *localPublisher) ReadFile(path string) ([]byte, error) {
+	return ioutil.ReadFile(p.readPath(path))
+}
+
+func (p *localPublisher) WriteFile(path string, content io.Reader) error {
+	path = p.writePath(path)
+	err := os.MkdirAll(filepath.Dir(path), dirPermision)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, filePermision)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, content)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (p *localPublisher) MakeDirectory(path string) error {
+	return os.MkdirAll(p.writePath(path), dirPermision)
+}
+
+func (p *localPublisher) CopyDirectory(source, path string) error {
+	path = p.writePath(path)
+	err := os.MkdirAll(path, dirPermision)
+	if err != nil {
+		return err
+	}
+	return copy.Copy(source, path)
+}
+
+func (p *localPublisher) Symlink(path, target string) error {
+	path = p.writePath(path)
+	err := os.MkdirAll(filepath.Dir(path), dirPermision)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(target, path)
+}
+
+func (p *localPublisher) Remove(path string) error {
+	return os.RemoveAll(p.writePath(path))
+}
+
+// the stratum 0 of the repository is this same machine, the commands on the
+// repository are never interrupted: a transaction half opened or half
+// published is worse than waiting for it
+type cvmfsServerPublisher struct {
+	localPublisher
+	CVMFSRepo string
+}
+
+func (p *cvmfsServerPublisher) Transaction(ctx context.Context) error {
+	return ExecCommand(context.Background(), "cvmfs_server", "transaction", p.CVMFSRepo).Start()
+}
+
+func (p *cvmfsServerPublisher) Publish() error {
+	return ExecCommand(context.Background(), "cvmfs_server", "publish", p.CVMFSRepo).Start()
+}
+
+func (p *cvmfsServerPublisher) Abort() error {
+	return ExecCommand(context.Background(), "cvmfs_server", "abort", "-f", p.CVMFSRepo).Start()
+}
+
+func (p *cvmfsServerPublisher) Ingest(ctx context.Context, tarball, path string, overwrite bool) error {
+	return ExecCommand(context.Background(), ingestCommand(p.CVMFSRepo, tarball, path, overwrite)...).Start()
+}
+
+// cvmfs_server ingest keeps the ownership, the devices and the extended
+// attributes of the tarball and does not go through the union mount
+func ingestCommand(CVMFSRepo, tarball, path string, overwrite bool) []string {
+	command := []string{"cvmfs_server", "ingest", "--catalog", "-t", tarball, "-b", path}
+	if overwrite {
+		command = append(command, "-d", path)
+	}
+	return append(command, CVMFSRepo)
+}
+
+// this machine is a publisher of a repository managed by a repository
+// gateway, the transaction acquires a lease on the gateway that may be
+// held by another publisher, in that case we wait and try again
+type gatewayPublisher struct {
+	localPublisher
+	CVMFSRepo string
+	leasePath string
+	retries   int
+}
+
+// the wait before trying again to acquire a busy lease, multiplied by the
+// number of the attempt
+var leaseRetryDelay = 10 * time.Second
+
+func (p *gatewayPublisher) Transaction(ctx context.Context) error {
+	lease := p.CVMFSRepo
+	if p.leasePath != "" {
+		lease = p.CVMFSRepo + "/" + p.leasePath
+	}
+	return p.withLease(ctx, lease, "cvmfs_server", "transaction", lease)
+}
+
+// run the command, that acquires a lease, until it succeeds or we run out of
+// attempts
+func (p *gatewayPublisher) withLease(ctx context.Context, lease string, command ...string) error {
+	var err error
+	for attempt := 1; attempt <= p.retries; attempt++ {
+		// as for cvmfs_server, the command itself is never interrupted
+		err = ExecCommand(context.Background(), command...).Start()
+		if err == nil {
+			return nil
+		}
+		LogC(ctx).WithFields(log.Fields{"action": "acquire lease",
+			"lease":   lease,
+			"attempt": attempt}).Warning("Impossible to acquire the lease")
+		if attempt < p.retries {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(attempt) * leaseRetryDelay):
+			}
+		}
+	}
+	return err
+}
+
+func (p *gatewayPublisher) Publish() error {
+	return ExecCommand(context.Background(), "cvmfs_server", "publish", p.CVMFSRepo).Start()
+}
+
+func (p *gatewayPublisher) Abort() error {
+	return ExecCommand(context.Background(), "cvmfs_server", "abort", "-f", p.CVMFSRepo).Start()
+}
+
+// the lease covers only its subpath, writing outside it would fail at
+// publish time, so we refuse it as soon as possible
+func (p *gatewayPublisher) checkLease(path string) error {
+	if p.leasePath == "" {
+		return nil
+	}
+	path = strings.Trim(filepath.Clean("/"+path), "/")
+	if path == p.leasePath || strings.HasPrefix(path, p.leasePath+"/") {
+		return nil
+	}
+	return fmt.Errorf("Path %s outside of the lease %s", path, p.leasePath)
+}
+
+func (p *gatewayPublisher) WriteFile(path string, content io.Reader) error {
+	if err := p.checkLease(path); err != nil {
+		return err
+	}
+	return p.localPublisher.WriteFile(path, content)
+}
+
+func (p *gatewayPublisher) MakeDirectory(path string) error {
+	if err := p.checkLease(path); err != nil {
+		return err
+	}
+	return p.localPublisher.MakeDirectory(path)
+}
+
+func (p *gatewayPublisher) CopyDirectory(source, path string) error {
+	if err := p.checkLease(path); err != nil {
+		return err
+	}
+	return p.localPublisher.CopyDirectory(source, path)
+}
+
+func (p *gatewayPublisher) Symlink(path, target string) error {
+	if err := p.checkLease(path); err != nil {
+		return err
+	}
+	return p.localPublisher.Symlink(path, target)
+}
+
+// the ingestion acquires a lease on path
+func (p *gatewayPublisher) Ingest(ctx context.Context, tarball, path string, overwrite bool) error {
+	if err := p.checkLease(path); err != nil {
+		return err
+	}
+	path = strings.Trim(filepath.Clean("/"+path), "/")
+	return p.withLease(ctx, p.CVMFSRepo+"/"+path, ingestCommand(p.CVMFSRepo, tarball, path, overwrite)...)
+}
+
+func (p *gatewayPublisher) Remove(path string) error {
+	if err := p.checkLease(path); err != nil {
+		return err
+	}
+	return p.localPublisher.Remove(path)
+}
+
+// a plain directory, useful for staging and for tests. There is no real
+// transaction, the operations are visible as soon as they are applied and
+// an abort does not roll them back
+type directoryPublisher struct {
+	localPublisher
+}
+
+func (p *directoryPublisher) Transaction(ctx context.Context) error {
+	return os.MkdirAll(p.writeRoot, dirPermision)
+}
+
+func (p *directoryPublisher) Publish() error {
+	return nil
+}
+
+// the tarball is extracted here, the ownership and the devices are kept only
+// when running as root and the extended attributes are not kept
+func (p *directoryPublisher) Ingest(ctx context.Context, tarball, path string, overwrite bool) error {
+	if overwrite {
+		if err := p.Remove(path); err != nil {
+			return err
+		}
+	}
+	if err := p.MakeDirectory(path); err != nil {
+		return err
+	}
+	if err := extractTar(tarball, p.writePath(path)); err != nil {
+		return err
+	}
+	return createCatalog(p, path)
+}
+
+func (p *directoryPublisher) Abort() error {
+	Log().WithFields(log.Fields{"directory": p.writeRoot}).Warning(
+		"Abort on a directory publisher, the modifications are not rolled back")
+	return nil
+}
@@ -0,0 +1,167 @@
+package lib
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConvertWishReadOnlyRoot(t *testing.T) {
+	cvmfs := newFakeCvmfs(t, testRepo)
+	defer cvmfs.Close()
+	registry := newFakeRegistry()
+	defer registry.Close()
+	_, restore := fakePush(t, registry)
+	defer restore()
+	branch := cvmfs.ReadOnlyBranch(t, testRepo)
+
+	manifest := registry.AddImage(t, "library/test", "latest", map[string]string{"etc/os-release": "fake"})
+	wish := testWish(registry, "library/test", "latest")
+	if _, err := ConvertWish(context.Background(), wish, false, false, false); err != nil {
+		t.Fatalf("Error in converting the wish: %s", err)
+	}
+	// written in the union mount, read from the read only branch once
+	// published
+	for _, root := range []string{cvmfs.Path(testRepo), branch} {
+		layer := filepath.Join(root, TrimCVMFSRepoPrefix(testRepo, LayerRootfsPath(testRepo, digestHex(manifest.Layers[0].Digest))))
+		if _, err := os.Stat(filepath.Join(layer, "etc", "os-release")); err != nil {
+			t.Errorf("Layer not in %s: %s", root, err)
+		}
+	}
+	report, err := ConvertWish(context.Background(), wish, false, false, false)
+	if err != nil || report.Outcome != OutcomeAlreadyConverted {
+		t.Errorf("The image is not found already converted: %s, %v", report.Outcome, err)
+	}
+}
+
+func TestConvertWishDirectoryPublisher(t *testing.T) {
+	cvmfs := newFakeCvmfs(t)
+	defer cvmfs.Close()
+	registry := newFakeRegistry()
+	defer registry.Close()
+	_, restore := fakePush(t, registry)
+	defer restore()
+
+	directory, err := ioutil.TempDir("", "publisher_directory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	if err := SetPublisher(PublisherConfig{Type: PublisherDirectory, Directory: directory}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetPublisher(PublisherConfig{Type: PublisherCvmfsServer})
+
+	shared := map[string]string{"etc/os-release": "shared"}
+	first := registry.AddImage(t, "library/first", "latest", shared)
+	registry.AddImage(t, "library/second", "latest", shared, map[string]string{"second": "second"})
+	if _, err := ConvertWish(context.Background(), testWish(registry, "library/first", "latest"), false, false, false); err != nil {
+		t.Fatal(err)
+	}
+	layer := filepath.Join(directory, testRepo, ".layers", digestHex(first.Layers[0].Digest)[:2],
+		digestHex(first.Layers[0].Digest), "layerfs", "etc", "os-release")
+	if _, err := os.Stat(layer); err != nil {
+		t.Fatalf("Layer not written in the directory: %s", err)
+	}
+
+	// what was written is read back from the directory
+	report, err := ConvertWish(context.Background(), testWish(registry, "library/first", "latest"), false, false, false)
+	if err != nil || report.Outcome != OutcomeAlreadyConverted {
+		t.Errorf("The image is not found already converted: %s, %v", report.Outcome, err)
+	}
+	report, err = ConvertWish(context.Background(), testWish(registry, "library/second", "latest"), false, false, false)
+	if err != nil || report.Layers[0].Status != LayerSkipped || report.Layers[1].Status != LayerIngested {
+		t.Errorf("Wrong layers converting an image with a layer already there: %+v, %v", report.Layers, err)
+	}
+	fsck, err := Fsck(testRepo, FsckOptions{VerifyContent: true})
+	if err != nil || fsck.Images != 2 || fsck.Layers != 2 || len(fsck.Problems) != 0 {
+		t.Errorf("Wrong check of the directory: %+v, %v", fsck, err)
+	}
+	if cvmfs.Revision(testRepo) != 0 {
+		t.Errorf("The directory publisher invoked cvmfs_server")
+	}
+}
+
+func TestGatewayPublisherLease(t *testing.T) {
+	cvmfs := newFakeCvmfs(t, testRepo)
+	defer cvmfs.Close()
+	defer func(delay time.Duration) { leaseRetryDelay = delay }(leaseRetryDelay)
+	leaseRetryDelay = 50 * time.Millisecond
+	err := SetPublisher(PublisherConfig{Type: PublisherGateway, LeasePath: "/images/", LeaseRetries: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetPublisher(PublisherConfig{Type: PublisherCvmfsServer})
+
+	// the lease is busy for a while, we wait for it
+	other := &cvmfsServerPublisher{CVMFSRepo: testRepo}
+	if err := other.Transaction(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(100*time.Millisecond, func() { other.Publish() })
+	transaction := NewTransaction(testRepo)
+	transaction.WriteFile("images/first", []byte("first"))
+	if err := transaction.Commit(context.Background()); err != nil {
+		t.Fatalf("The lease was not acquired once free: %s", err)
+	}
+	if content, _ := ioutil.ReadFile(cvmfs.Path(testRepo, "images", "first")); string(content) != "first" {
+		t.Errorf("Wrong content published through the lease: %s", content)
+	}
+	log, _ := ioutil.ReadFile(filepath.Join(cvmfs.state, "log"))
+	if !strings.Contains(string(log), "transaction "+testRepo+"/images\n") {
+		t.Errorf("The lease was not asked on the lease path: %s", log)
+	}
+
+	// nothing is written outside of the lease
+	revision := cvmfs.Revision(testRepo)
+	transaction = NewTransaction(testRepo)
+	transaction.WriteFile("images/second", []byte("second"))
+	transaction.WriteFile("other/second", []byte("second"))
+	if err := transaction.Commit(context.Background()); err == nil {
+		t.Errorf("Written outside of the lease")
+	}
+	if _, err := os.Stat(cvmfs.Path(testRepo, "images", "second")); err == nil || cvmfs.Revision(testRepo) != revision {
+		t.Errorf("The transaction outside of the lease was not aborted")
+	}
+}
+
+func TestGatewayPublisherCanceled(t *testing.T) {
+	cvmfs := newFakeCvmfs(t, testRepo)
+	defer cvmfs.Close()
+	defer func(delay time.Duration) { leaseRetryDelay = delay }(leaseRetryDelay)
+	leaseRetryDelay = time.Hour
+	if err := SetPublisher(PublisherConfig{Type: PublisherGateway, LeaseRetries: 5}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetPublisher(PublisherConfig{Type: PublisherCvmfsServer})
+
+	other := &cvmfsServerPublisher{CVMFSRepo: testRepo}
+	if err := other.Transaction(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer other.Abort()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	transaction := NewTransaction(testRepo)
+	transaction.WriteFile("first", []byte("first"))
+	done := make(chan error)
+	go func() {
+		done <- transaction.Commit(ctx)
+	}()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("Expected the commit to be canceled, got: %v", err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatalf("The wait for the lease was not canceled")
+	}
+	// the transaction of the other publisher is not ours to abort
+	if !cvmfs.InTransaction(testRepo) {
+		t.Errorf("The transaction holding the lease was aborted")
+	}
+}
@@ -0,0 +1,251 @@
+package lib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/image"
+	log "github.com/sirupsen/logrus"
+
+	da "github.com/cvmfs/docker-graphdriver/repository-manager/docker-api"
+)
+
+// The thin image is a regular image made of a single layer, a tarball with
+// thin.json, and of the configuration of the original image. We assemble the
+// manifest, the configuration and the layer ourselves and push them with the
+// HTTP API of the registry, no docker daemon is involved. The thin images are
+// reproducible: converting the same image gives the same digests, so the
+// blobs already pushed are not uploaded again, and the ones pushed to another
+// repository of the same registry are mounted from there.
+
+const mediaTypeDockerConfig = "application/vnd.docker.container.image.v1+json"
+
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Size      int    `json:"size"`
+	Digest    string `json:"digest"`
+}
+
+type thinManifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Config        descriptor   `json:"config"`
+	Layers        []descriptor `json:"layers"`
+}
+
+type thinConfig struct {
+	Architecture string            `json:"architecture"`
+	OS           string            `json:"os"`
+	Created      time.Time         `json:"created"`
+	Config       *container.Config `json:"config"`
+	RootFS       thinRootFS        `json:"rootfs"`
+	History      []thinHistory     `json:"history"`
+}
+
+type thinRootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+type thinHistory struct {
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"created_by"`
+	Comment   string    `json:"comment,omitempty"`
+}
+
+func sha256Digest(content []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+}
+
+// the configuration of the thin image: the one of the original image, marked
+// with CVMFS_IMAGE, on top of the thin layer
+func makeThinConfig(original image.Image, thinTar []byte, origin string) ([]byte, error) {
+	var config container.Config
+	if original.Config != nil {
+		config = *original.Config
+	}
+	config.Env = append(append([]string{}, config.Env...), "CVMFS_IMAGE=true")
+	created := original.Created
+	return json.Marshal(thinConfig{
+		Architecture: original.Architecture,
+		OS:           original.OS,
+		Created:      created,
+		Config:       &config,
+		RootFS:       thinRootFS{Type: "layers", DiffIDs: []string{sha256Digest(thinTar)}},
+		History: []thinHistory{{
+			Created:   created,
+			CreatedBy: "docker2cvmfs",
+			Comment:   "thin image of " + origin}},
+	})
+}
+
+// replaced in the tests, to look at what we push
+var pushThinImage = pushThinImageToRegistry
+
+// push the thin image, the tarball with thin.json and its configuration, to
+// the registry of outputImage and return the digest of its manifest
+func pushThinImageToRegistry(outputImage Image, credentials Credentials, thinTar []byte, config []byte) (string, error) {
+	llog := func(l *log.Entry) *log.Entry {
+		return l.WithFields(log.Fields{"action": "push thin image",
+			"image": outputImage.GetSimpleName()})
+	}
+	var layer bytes.Buffer
+	compressor := gzip.NewWriter(&layer)
+	if _, err := compressor.Write(thinTar); err != nil {
+		return "", err
+	}
+	if err := compressor.Close(); err != nil {
+		return "", err
+	}
+
+	manifest := thinManifest{
+		SchemaVersion: 2,
+		MediaType:     da.MediaTypeDockerManifest,
+		Config: descriptor{
+			MediaType: mediaTypeDockerConfig,
+			Size:      len(config),
+			Digest:    sha256Digest(config)},
+		Layers: []descriptor{{
+			MediaType: da.MediaTypeDockerLayer,
+			Size:      layer.Len(),
+			Digest:    sha256Digest(layer.Bytes())}},
+	}
+	auth := newRegistryAuth(credentials)
+	for _, blob := range []struct {
+		digest  string
+		content []byte
+	}{{manifest.Layers[0].Digest, layer.Bytes()}, {manifest.Config.Digest, config}} {
+		if err := pushBlob(outputImage, auth, blob.digest, blob.content); err != nil {
+			llog(LogE(err)).WithFields(log.Fields{"blob": blob.digest}).Error("Error in pushing the blob")
+			return "", err
+		}
+	}
+
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+	reference := outputImage.Tag
+	if reference == "" {
+		reference = "latest"
+	}
+	manifestUrl := fmt.Sprintf("%s://%s/v2/%s/manifests/%s",
+		outputImage.Scheme, outputImage.Registry, outputImage.Repository, reference)
+	req, err := http.NewRequest("PUT", manifestUrl, bytes.NewReader(body))
+	if err != nil {
+		LogE(err).Error("Impossible to create the HTTP request.")
+		return "", err
+	}
+	req.Header.Set("Content-Type", da.MediaTypeDockerManifest)
+	resp, err := auth.Do(req)
+	if err != nil {
+		llog(LogE(err)).Error("Error in pushing the manifest")
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		err = fmt.Errorf("Manifest refused by the registry, status code: %d, %s", resp.StatusCode, message)
+		llog(LogE(err)).Error("Error in pushing the manifest")
+		return "", err
+	}
+	digest := sha256Digest(body)
+	llog(Log()).WithFields(log.Fields{"digest": digest}).Info("Pushed the thin image")
+	return digest, nil
+}
+
+var (
+	pushedBlobsLock sync.Mutex
+	// registry/digest -> the last repository we pushed the blob to, where it
+	// can be mounted from
+	pushedBlobs = make(map[string]string)
+)
+
+// upload the blob to the repository of img, unless it is already there or it
+// can be mounted from another repository of the registry
+func pushBlob(img Image, auth *registryAuth, digest string, content []byte) error {
+	blobsUrl := fmt.Sprintf("%s://%s/v2/%s/blobs/", img.Scheme, img.Registry, img.Repository)
+	req, err := http.NewRequest("HEAD", blobsUrl+digest, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := auth.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		Log().WithFields(log.Fields{"blob": digest}).Info("Blob already in the registry")
+		return nil
+	}
+
+	uploadUrl := blobsUrl + "uploads/"
+	pushedBlobsLock.Lock()
+	from := pushedBlobs[img.Registry+"/"+digest]
+	pushedBlobsLock.Unlock()
+	if from != "" && from != img.Repository {
+		uploadUrl += "?" + url.Values{"mount": {digest}, "from": {from}}.Encode()
+	}
+	req, err = http.NewRequest("POST", uploadUrl, nil)
+	if err != nil {
+		return err
+	}
+	resp, err = auth.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		Log().WithFields(log.Fields{"blob": digest, "from": from}).Info("Blob mounted from another repository")
+		rememberPushedBlob(img, digest)
+		return nil
+	case http.StatusAccepted:
+	default:
+		return fmt.Errorf("Impossible to start the upload of the blob, status code: %d", resp.StatusCode)
+	}
+
+	location, err := resp.Location()
+	if err != nil {
+		return fmt.Errorf("No location to upload the blob: %s", err)
+	}
+	query := location.Query()
+	query.Set("digest", digest)
+	location.RawQuery = query.Encode()
+	uploadAuth := auth
+	if location.Host != req.URL.Host {
+		// never send the authorization of the registry somewhere else
+		uploadAuth = nil
+	}
+	req, err = http.NewRequest("PUT", location.String(), bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err = uploadAuth.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("Blob upload refused by the registry, status code: %d", resp.StatusCode)
+	}
+	rememberPushedBlob(img, digest)
+	return nil
+}
+
+func rememberPushedBlob(img Image, digest string) {
+	pushedBlobsLock.Lock()
+	defer pushedBlobsLock.Unlock()
+	pushedBlobs[img.Registry+"/"+digest] = img.Repository
+}
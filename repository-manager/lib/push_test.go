@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/image"
+
+	da "github.com/cvmfs/docker-graphdriver/repository-manager/docker-api"
+)
+
+func TestPushThinImage(t *testing.T) {
+	registry := newFakeRegistry()
+	defer registry.Close()
+	registry.RequireLogin("alice", "secret", "")
+	credentials := Credentials{Username: "alice", Password: "secret"}
+
+	var original image.Image
+	err := json.Unmarshal([]byte(`{"architecture":"arm64","os":"linux",
+		"config":{"Env":["PATH=/bin"],"Entrypoint":["/app"],"StopSignal":"SIGQUIT"}}`), &original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thinTar := []byte("thin.json tarball")
+	config, err := makeThinConfig(original, thinTar, "docker://example.ch/app:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, _ := ParseImage("http://" + registry.Host() + "/thin/app:latest")
+	if _, err := pushThinImage(first, credentials, thinTar, config); err != nil {
+		t.Fatalf("Error in pushing the thin image: %s", err)
+	}
+	body, _, err := getManifestWithCredentials(first, credentials)
+	if err != nil {
+		t.Fatalf("The thin image is not in the registry: %s", err)
+	}
+	var manifest da.Manifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Layers) != 1 || manifest.Config.Digest != sha256Digest(config) {
+		t.Errorf("Wrong manifest of the thin image: %+v", manifest)
+	}
+	pushedConfig, ok := registry.Blob(manifest.Config.Digest)
+	var thin thinConfig
+	if !ok || json.Unmarshal(pushedConfig, &thin) != nil {
+		t.Fatalf("Configuration not pushed")
+	}
+	if thin.Architecture != "arm64" || thin.Config.StopSignal != "SIGQUIT" ||
+		len(thin.Config.Entrypoint) != 1 || thin.Config.Env[1] != "CVMFS_IMAGE=true" ||
+		thin.RootFS.DiffIDs[0] != sha256Digest(thinTar) {
+		t.Errorf("Wrong configuration of the thin image: %s", pushedConfig)
+	}
+
+	// the same thin image in another repository mounts the blobs
+	second, _ := ParseImage("http://" + registry.Host() + "/other/app:v1")
+	if _, err := pushThinImage(second, credentials, thinTar, config); err != nil {
+		t.Fatalf("Error in pushing the thin image again: %s", err)
+	}
+	for _, request := range registry.Requests() {
+		if strings.HasPrefix(request, "PUT /v2/other/app/blobs/uploads/") {
+			t.Errorf("Blob uploaded instead of mounted: %s", request)
+		}
+	}
+	if _, _, err := getManifestWithCredentials(second, credentials); err != nil {
+		t.Errorf("The second thin image is not in the registry: %s", err)
+	}
+
+	// and pushing again does not even mount them
+	before := len(registry.Requests())
+	if _, err := pushThinImage(second, credentials, thinTar, config); err != nil {
+		t.Fatal(err)
+	}
+	for _, request := range registry.Requests()[before:] {
+		if strings.HasPrefix(request, "POST ") {
+			t.Errorf("Blob pushed again: %s", request)
+		}
+	}
+}
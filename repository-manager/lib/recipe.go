@@ -1,23 +1,67 @@
 package lib
 
 import (
+	"fmt"
+	"regexp"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
 
 	"gopkg.in/yaml.v2"
+
+	da "github.com/cvmfs/docker-graphdriver/repository-manager/docker-api"
 )
 
 type YamlRecipeV1 struct {
 	Version      int      `yaml:"version"`
 	User         string   `yaml:"user"`
 	CVMFSRepo    string   `yaml:"cvmfs_repo"`
+	CVMFSRoot    string   `yaml:"cvmfs_root"`
 	OutputFormat string   `yaml:"output_format"`
+	Platforms    []string `yaml:"platforms"`
 	Input        []string `yaml:"input"`
 }
 
 type Recipe struct {
 	Wishes []WishFriendly
+	// some inputs could not be turned into wishes, ex: the tags could not be
+	// listed, the images missing from Wishes may still be wanted
+	Incomplete bool
+	// where the repositories are mounted, if not in the default location
+	RepositoryRoots map[string]string
+}
+
+// make all the following operations use the roots of the repositories
+// specified in the recipe
+func (r Recipe) SetRepositoryRoots() {
+	for repo, root := range r.RepositoryRoots {
+		SetRepositoryRoot(repo, root)
+	}
+}
+
+// parse the recipe using the schema of its version, the recipes written
+// before the versions were introduced are of version 1
+func ParseYamlRecipe(data []byte) (Recipe, error) {
+	var header struct {
+		Version *int `yaml:"version"`
+	}
+	err := yaml.Unmarshal(data, &header)
+	if err != nil {
+		return Recipe{}, err
+	}
+	if header.Version == nil {
+		Log().Warning("The recipe does not specify its version, reading it as `version: 1`, " +
+			"the recipes without version are deprecated")
+		return ParseYamlRecipeV1(data)
+	}
+	switch *header.Version {
+	case 1:
+		return ParseYamlRecipeV1(data)
+	case 2:
+		return ParseYamlRecipeV2(data)
+	default:
+		return Recipe{}, fmt.Errorf("Unsupported recipe version %d, the supported versions are 1 and 2", *header.Version)
+	}
 }
 
 func ParseYamlRecipeV1(data []byte) (Recipe, error) {
@@ -26,25 +70,71 @@ func ParseYamlRecipeV1(data []byte) (Recipe, error) {
 	if err != nil {
 		return Recipe{}, err
 	}
-	recipe := Recipe{}
+	platforms, err := parsePlatforms(recipeYamlV1.Platforms)
+	if err != nil {
+		return Recipe{}, err
+	}
+	recipe := Recipe{RepositoryRoots: make(map[string]string)}
+	if recipeYamlV1.CVMFSRoot != "" {
+		recipe.RepositoryRoots[recipeYamlV1.CVMFSRepo] = recipeYamlV1.CVMFSRoot
+	}
+	var inputs []string
 	for _, inputImage := range recipeYamlV1.Input {
-		input, err := ParseImage(inputImage)
+		images, err := expandInput(inputImage, "", "", TagFilter{})
 		if err != nil {
-			LogE(err).WithFields(log.Fields{"image": inputImage}).Warning("Impossible to parse the image")
+			LogE(err).WithFields(log.Fields{"image": inputImage}).Warning("Impossible to expand the tags of the image")
+			recipe.Incomplete = true
 			continue
 		}
-		output := formatOutputImage(recipeYamlV1.OutputFormat, input)
-		wish, err := CreateWish(inputImage, output, recipeYamlV1.CVMFSRepo, "", recipeYamlV1.User)
+		inputs = append(inputs, images...)
+	}
+	for _, inputImage := range inputs {
+		input, err := ParseImage(inputImage)
 		if err != nil {
-			LogE(err).Warning("Error in creating the wish")
+			LogE(err).WithFields(log.Fields{"image": inputImage}).Warning("Impossible to parse the image")
+			recipe.Incomplete = true
 			continue
-		} else {
+		}
+		for _, platform := range platforms {
+			input.Platform = platform
+			output := formatOutputImage(recipeYamlV1.OutputFormat, input)
+			if len(platforms) > 1 && !strings.Contains(recipeYamlV1.OutputFormat, "$(platform)") {
+				// without the platform in the output name all the
+				// platforms would be pushed on the same tag
+				output = output + "-" + platformTag(platform)
+			}
+			wish, err := CreateWish(inputImage, output, recipeYamlV1.CVMFSRepo, "", recipeYamlV1.User)
+			if err != nil {
+				LogE(err).Warning("Error in creating the wish")
+				recipe.Incomplete = true
+				continue
+			}
+			wish.Platform = platform
 			recipe.Wishes = append(recipe.Wishes, wish)
 		}
 	}
 	return recipe, nil
 }
 
+// we always return at least one platform, the empty one means the default
+// platform and keeps the naming used before the platform support
+func parsePlatforms(platforms []string) ([]string, error) {
+	if len(platforms) == 0 {
+		return []string{""}, nil
+	}
+	for _, platform := range platforms {
+		if _, err := da.ParsePlatform(platform); err != nil {
+			return nil, err
+		}
+	}
+	return platforms, nil
+}
+
+// from linux/arm64/v8 -> linux-arm64-v8, suitable to be used in a tag
+func platformTag(platform string) string {
+	return strings.Replace(platform, "/", "-", -1)
+}
+
 func formatOutputImage(OutputFormat string, inputImage Image) string {
 
 	s := strings.Replace(OutputFormat, "$(scheme)", inputImage.Scheme, 5)
@@ -54,6 +144,225 @@ func formatOutputImage(OutputFormat string, inputImage Image) string {
 	s = strings.Replace(s, "$(tag)", inputImage.Tag, 5)
 	s = strings.Replace(s, "$(reference)", inputImage.GetReference(), 5)
 	s = strings.Replace(s, "$(image)", inputImage.Repository+inputImage.GetReference(), 5)
+	s = strings.Replace(s, "$(platform)", platformTag(inputImage.Platform), 5)
 
 	return s
 }
+
+// In the recipe v2 the keys at the top level are the defaults for all the
+// inputs and every input can override them
+type YamlRecipeV2 struct {
+	Version            int `yaml:"version"`
+	YamlRecipeSettings `yaml:",inline"`
+	Input              []YamlRecipeV2Input `yaml:"input"`
+}
+
+type YamlRecipeSettings struct {
+	User              string     `yaml:"user"`
+	InputUser         string     `yaml:"input_user"`
+	InputCredentials  string     `yaml:"input_credentials"`
+	OutputCredentials string     `yaml:"output_credentials"`
+	CVMFSRepo         string     `yaml:"cvmfs_repo"`
+	CVMFSRoot         string     `yaml:"cvmfs_root"`
+	OutputFormat      string     `yaml:"output_format"`
+	Platforms         []string   `yaml:"platforms"`
+	Singularity       *bool      `yaml:"singularity"`
+	Tags              *TagFilter `yaml:"tags"`
+}
+
+type YamlRecipeV2Input struct {
+	Image              string `yaml:"image"`
+	YamlRecipeSettings `yaml:",inline"`
+}
+
+// an input can be just the image, like in the recipe v1
+func (i *YamlRecipeV2Input) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var image string
+	if err := unmarshal(&image); err == nil {
+		i.Image = image
+		return nil
+	}
+	type plain YamlRecipeV2Input
+	return unmarshal((*plain)(i))
+}
+
+// the settings of the input, where not specified, are the defaults
+func (s YamlRecipeSettings) merge(defaults YamlRecipeSettings) YamlRecipeSettings {
+	override := func(value, def string) string {
+		if value != "" {
+			return value
+		}
+		return def
+	}
+	s.User = override(s.User, defaults.User)
+	s.InputUser = override(s.InputUser, defaults.InputUser)
+	s.InputCredentials = override(s.InputCredentials, defaults.InputCredentials)
+	s.OutputCredentials = override(s.OutputCredentials, defaults.OutputCredentials)
+	if s.CVMFSRepo == "" {
+		// the root goes together with its repository
+		s.CVMFSRepo = defaults.CVMFSRepo
+		s.CVMFSRoot = override(s.CVMFSRoot, defaults.CVMFSRoot)
+	}
+	s.OutputFormat = override(s.OutputFormat, defaults.OutputFormat)
+	if s.Platforms == nil {
+		s.Platforms = defaults.Platforms
+	}
+	if s.Singularity == nil {
+		s.Singularity = defaults.Singularity
+	}
+	if s.Tags == nil {
+		s.Tags = defaults.Tags
+	}
+	return s
+}
+
+func ParseYamlRecipeV2(data []byte) (Recipe, error) {
+	recipeYamlV2 := YamlRecipeV2{}
+	err := yaml.Unmarshal(data, &recipeYamlV2)
+	if err != nil {
+		return Recipe{}, err
+	}
+	if recipeYamlV2.Version != 2 {
+		return Recipe{}, fmt.Errorf("Expected a recipe of version 2, got version %d", recipeYamlV2.Version)
+	}
+	recipe := Recipe{RepositoryRoots: make(map[string]string)}
+	for i, inputYaml := range recipeYamlV2.Input {
+		if inputYaml.Image == "" {
+			return Recipe{}, fmt.Errorf("Input %d of the recipe without image", i)
+		}
+		settings := inputYaml.YamlRecipeSettings.merge(recipeYamlV2.YamlRecipeSettings)
+		platforms, tags, err := settings.check(inputYaml.Image)
+		if err != nil {
+			return Recipe{}, err
+		}
+		if settings.CVMFSRoot != "" {
+			root, ok := recipe.RepositoryRoots[settings.CVMFSRepo]
+			if ok && root != settings.CVMFSRoot {
+				return Recipe{}, fmt.Errorf("Different cvmfs_root for the same repository %s: %s and %s",
+					settings.CVMFSRepo, root, settings.CVMFSRoot)
+			}
+			recipe.RepositoryRoots[settings.CVMFSRepo] = settings.CVMFSRoot
+		}
+
+		images, err := expandInput(inputYaml.Image, settings.InputUser, settings.InputCredentials, tags)
+		if err != nil {
+			LogE(err).WithFields(log.Fields{"image": inputYaml.Image}).Warning("Impossible to expand the tags of the image")
+			recipe.Incomplete = true
+			continue
+		}
+		for _, image := range images {
+			wishes, complete := createWishesV2(image, settings, platforms, tags)
+			recipe.Wishes = append(recipe.Wishes, wishes...)
+			recipe.Incomplete = recipe.Incomplete || !complete
+		}
+	}
+	return recipe, nil
+}
+
+// check the settings of an input, already merged with the defaults, and
+// return its platforms and its tag filter
+func (s YamlRecipeSettings) check(image string) (platforms []string, tags TagFilter, err error) {
+	if s.CVMFSRepo == "" {
+		return nil, tags, fmt.Errorf("No cvmfs_repo for the input %s", image)
+	}
+	if s.OutputFormat == "" {
+		return nil, tags, fmt.Errorf("No output_format for the input %s", image)
+	}
+	platforms, err = parsePlatforms(s.Platforms)
+	if err != nil {
+		return nil, tags, err
+	}
+	if s.Tags != nil {
+		tags = *s.Tags
+	}
+	err = tags.compile()
+	return
+}
+
+// complete is false if some of the wishes could not be created
+func createWishesV2(image string, settings YamlRecipeSettings, platforms []string, tags TagFilter) (wishes []WishFriendly, complete bool) {
+	input, err := ParseImage(image)
+	if err != nil {
+		LogE(err).WithFields(log.Fields{"image": image}).Warning("Impossible to parse the image")
+		return
+	}
+	complete = true
+	if input.Tag != "" && !tags.Match(input.Tag) {
+		Log().WithFields(log.Fields{"image": image}).Warning(
+			"The tag of the image is excluded by the tag filter, skipping")
+		return
+	}
+	for _, platform := range platforms {
+		input.Platform = platform
+		output := formatOutputImage(settings.OutputFormat, input)
+		if len(platforms) > 1 && !strings.Contains(settings.OutputFormat, "$(platform)") {
+			output = output + "-" + platformTag(platform)
+		}
+		wish, err := CreateWish(image, output, settings.CVMFSRepo, settings.InputUser, settings.User)
+		if err != nil {
+			LogE(err).Warning("Error in creating the wish")
+			complete = false
+			continue
+		}
+		wish.Platform = platform
+		wish.InputCredentials = settings.InputCredentials
+		wish.OutputCredentials = settings.OutputCredentials
+		wish.SkipSingularity = settings.Singularity != nil && !*settings.Singularity
+		wishes = append(wishes, wish)
+	}
+	return
+}
+
+// select the tags of an image with regular expressions, that must match the
+// whole tag. A tag is selected if it matches at least one of the include
+// expressions (or there are none) and none of the exclude expressions.
+// When the tags are expanded from the registry, Latest keeps only the
+// highest Latest versions
+type TagFilter struct {
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+	Latest  int      `yaml:"latest"`
+
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+func (f *TagFilter) compile() (err error) {
+	compileAll := func(expressions []string) ([]*regexp.Regexp, error) {
+		var compiled []*regexp.Regexp
+		for _, expression := range expressions {
+			re, err := regexp.Compile("^(?:" + expression + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("Wrong tag filter %s: %s", expression, err)
+			}
+			compiled = append(compiled, re)
+		}
+		return compiled, nil
+	}
+	if f.include, err = compileAll(f.Include); err != nil {
+		return
+	}
+	f.exclude, err = compileAll(f.Exclude)
+	return
+}
+
+func (f TagFilter) active() bool {
+	return len(f.Include) > 0 || len(f.Exclude) > 0 || f.Latest > 0
+}
+
+func (f TagFilter) Match(tag string) bool {
+	for _, re := range f.exclude {
+		if re.MatchString(tag) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, re := range f.include {
+		if re.MatchString(tag) {
+			return true
+		}
+	}
+	return false
+}
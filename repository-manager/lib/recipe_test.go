@@ -0,0 +1,128 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseYamlRecipeVersions(t *testing.T) {
+	v1 := `
+version: 1
+user: smosciat
+cvmfs_repo: unpacked.cern.ch
+output_format: 'https://registry.cern.ch/thin/$(image)'
+input:
+        - 'https://registry.hub.docker.com/library/fedora:latest'
+`
+	recipe, err := ParseYamlRecipe([]byte(v1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recipe.Wishes) != 1 || recipe.Wishes[0].OutputName != "https://registry.cern.ch/thin/library/fedora:latest" {
+		t.Errorf("Wrong wishes from the recipe v1: %+v", recipe.Wishes)
+	}
+
+	// the recipes written before the versions are still of version 1
+	recipe, err = ParseYamlRecipe([]byte(strings.Replace(v1, "version: 1\n", "", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recipe.Wishes) != 1 || recipe.Wishes[0].OutputName != "https://registry.cern.ch/thin/library/fedora:latest" {
+		t.Errorf("Wrong wishes from the recipe without version: %+v", recipe.Wishes)
+	}
+
+	for _, wrong := range []string{
+		"version: 3\ninput: []\n",
+		"version: 0\ncvmfs_repo: unpacked.cern.ch\n",
+	} {
+		_, err := ParseYamlRecipe([]byte(wrong))
+		if err == nil || !strings.Contains(err.Error(), "version") {
+			t.Errorf("Expected an error about the version, got: %v", err)
+		}
+	}
+}
+
+func TestParseYamlRecipeV2(t *testing.T) {
+	v2 := `
+version: 2
+user: pusher
+output_credentials: PUSH_PASSWORD
+cvmfs_repo: unpacked.cern.ch
+output_format: 'https://registry.cern.ch/thin/$(image)'
+input:
+        - 'https://registry.hub.docker.com/library/fedora:latest'
+        - image: 'https://gitlab-registry.cern.ch/atlas/athena:21.0'
+          input_user: reader
+          input_credentials: GITLAB_PASSWORD
+          cvmfs_repo: atlas.cern.ch
+          cvmfs_root: /var/spool/cvmfs/atlas.cern.ch/rdonly
+          output_format: 'https://registry.cern.ch/atlas/$(repository):$(tag)-$(platform)'
+          platforms: ['linux/amd64', 'linux/arm64']
+          singularity: false
+        - image: 'https://registry.hub.docker.com/library/python:3.7-rc'
+          tags:
+                exclude: ['.*-rc']
+`
+	recipe, err := ParseYamlRecipe([]byte(v2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recipe.Wishes) != 3 {
+		t.Fatalf("Expected 3 wishes, got %d", len(recipe.Wishes))
+	}
+
+	fedora := recipe.Wishes[0]
+	if fedora.CvmfsRepo != "unpacked.cern.ch" || fedora.UserOutput != "pusher" ||
+		fedora.OutputCredentials != "PUSH_PASSWORD" || fedora.SkipSingularity {
+		t.Errorf("The defaults are not applied: %+v", fedora)
+	}
+
+	for i, platform := range []string{"linux/amd64", "linux/arm64"} {
+		athena := recipe.Wishes[1+i]
+		if athena.CvmfsRepo != "atlas.cern.ch" || athena.UserInput != "reader" ||
+			athena.InputCredentials != "GITLAB_PASSWORD" || athena.UserOutput != "pusher" {
+			t.Errorf("The overrides are not applied: %+v", athena)
+		}
+		if athena.Platform != platform || !athena.SkipSingularity {
+			t.Errorf("Wrong platform or singularity: %+v", athena)
+		}
+		expected := "https://registry.cern.ch/atlas/atlas/athena:21.0-" + platformTag(platform)
+		if athena.OutputName != expected {
+			t.Errorf("Wrong output name %s, expected %s", athena.OutputName, expected)
+		}
+	}
+	if root := recipe.RepositoryRoots["atlas.cern.ch"]; root != "/var/spool/cvmfs/atlas.cern.ch/rdonly" {
+		t.Errorf("Wrong root of the repository: %s", root)
+	}
+}
+
+func TestParseYamlRecipeV2Errors(t *testing.T) {
+	for _, wrong := range []string{
+		"version: 2\noutput_format: 'x'\ninput: ['https://registry.hub.docker.com/library/fedora:latest']\n",
+		"version: 2\ncvmfs_repo: r\ninput: ['https://registry.hub.docker.com/library/fedora:latest']\n",
+		"version: 2\ncvmfs_repo: r\noutput_format: 'x'\ninput: [{user: foo}]\n",
+		"version: 2\ncvmfs_repo: r\noutput_format: 'x'\ntags: {include: ['(']}\ninput: ['https://registry.hub.docker.com/library/fedora:latest']\n",
+	} {
+		if _, err := ParseYamlRecipe([]byte(wrong)); err == nil {
+			t.Errorf("Expected an error for the recipe:\n%s", wrong)
+		}
+	}
+}
+
+func TestTagFilter(t *testing.T) {
+	filter := TagFilter{Include: []string{`3\.\d+`, "latest"}, Exclude: []string{`3\.5`}}
+	if err := filter.compile(); err != nil {
+		t.Fatal(err)
+	}
+	for tag, expected := range map[string]bool{
+		"3.7":        true,
+		"latest":     true,
+		"3.5":        false,
+		"3.7-alpine": false,
+		"2.7":        false,
+	} {
+		if filter.Match(tag) != expected {
+			t.Errorf("Wrong match for the tag %s", tag)
+		}
+	}
+}
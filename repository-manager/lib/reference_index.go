@@ -0,0 +1,312 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	log "github.com/sirupsen/logrus"
+
+	da "github.com/cvmfs/docker-graphdriver/repository-manager/docker-api"
+)
+
+// The reference index, in .metadata/references.json, tells which images are
+// converted in the repository and which layers they use, in both directions:
+// from the config digest of an image to its layers and from a layer to the
+// images that use it. It is read, modified and written back inside the same
+// transaction that ingests the layers or retires the image, so it is always
+// published together with them. The index can always be rebuilt from the
+// manifests in .metadata with the fsck command.
+
+type ReferenceIndex struct {
+	// config digest of the image -> image
+	Images map[string]*IndexedImage `json:"images"`
+	// layer digest -> config digests of the images using the layer
+	Layers map[string][]string `json:"layers"`
+}
+
+type IndexedImage struct {
+	Layers []string `json:"layers"`
+	// the same image may be converted under several names, as in .metadata
+	Names map[string]IndexedName `json:"names"`
+}
+
+type IndexedName struct {
+	Converted   time.Time `json:"converted"`
+	InputImage  string    `json:"input_image,omitempty"`
+	OutputImage string    `json:"output_image,omitempty"`
+}
+
+// from sha256:abcd -> abcd, a digest without the algorithm is returned as it is
+func withoutAlgorithm(digest string) string {
+	return digest[strings.Index(digest, ":")+1:]
+}
+
+func NewReferenceIndex() ReferenceIndex {
+	return ReferenceIndex{
+		Images: make(map[string]*IndexedImage),
+		Layers: make(map[string][]string)}
+}
+
+func ReferenceIndexLocation(CVMFSRepo string) string {
+	return RepositoryPath(CVMFSRepo, ".metadata", "references.json")
+}
+
+// the config digests of the images using the layer
+func (idx ReferenceIndex) ImagesOfLayer(layerDigest string) []string {
+	return idx.Layers[layerDigest]
+}
+
+// the image converted with the name, as in .metadata, ex:
+// registry.example.ch/library/ubuntu:latest
+func (idx ReferenceIndex) ImageOfName(name string) (string, bool) {
+	for digest, image := range idx.Images {
+		if _, ok := image.Names[name]; ok {
+			return digest, true
+		}
+	}
+	return "", false
+}
+
+// the name now refers to the image of the manifest, and not anymore to the
+// image it was referring before
+func (idx *ReferenceIndex) add(name string, manifest da.Manifest, indexed IndexedName) {
+	idx.removeName(name)
+	image, ok := idx.Images[manifest.Config.Digest]
+	if !ok {
+		image = &IndexedImage{Names: make(map[string]IndexedName)}
+		idx.Images[manifest.Config.Digest] = image
+	}
+	image.Layers = image.Layers[:0]
+	for _, layer := range manifest.Layers {
+		image.Layers = append(image.Layers, layer.Digest)
+	}
+	image.Names[name] = indexed
+	idx.link()
+}
+
+// the images without any name left are removed from the index
+func (idx *ReferenceIndex) removeName(name string) {
+	for digest, image := range idx.Images {
+		delete(image.Names, name)
+		if len(image.Names) == 0 {
+			delete(idx.Images, digest)
+		}
+	}
+	idx.link()
+}
+
+// compute again the layers -> images direction
+func (idx *ReferenceIndex) link() {
+	idx.Layers = make(map[string][]string)
+	for digest, image := range idx.Images {
+		for _, layer := range image.Layers {
+			idx.Layers[layer] = append(idx.Layers[layer], digest)
+		}
+	}
+	for _, images := range idx.Layers {
+		sort.Strings(images)
+	}
+}
+
+func unmarshalReferenceIndex(content []byte) (ReferenceIndex, error) {
+	idx := NewReferenceIndex()
+	if content == nil {
+		return idx, nil
+	}
+	if err := json.Unmarshal(content, &idx); err != nil {
+		return idx, fmt.Errorf("Corrupted reference index, rebuild it with fsck: %s", err)
+	}
+	if idx.Images == nil {
+		idx.Images = make(map[string]*IndexedImage)
+	}
+	for digest, image := range idx.Images {
+		if image == nil || image.Names == nil {
+			return idx, fmt.Errorf("Corrupted reference index, rebuild it with fsck: wrong image %s", digest)
+		}
+	}
+	idx.link()
+	return idx, nil
+}
+
+// the index as published in the repository, empty if there is none yet
+func ReadReferenceIndex(CVMFSRepo string) (ReferenceIndex, error) {
+	content, err := ioutil.ReadFile(ReferenceIndexLocation(CVMFSRepo))
+	if err != nil && !os.IsNotExist(err) {
+		LogE(err).WithFields(log.Fields{"repo": CVMFSRepo}).Error("Impossible to read the reference index")
+		return NewReferenceIndex(), err
+	}
+	return unmarshalReferenceIndex(content)
+}
+
+// add to the transaction the update of the index, the index is read when the
+// transaction is open, hence it sees what other transactions published
+func updateReferenceIndex(t *Transaction, update func(idx *ReferenceIndex)) {
+	t.UpdateFile(TrimCVMFSRepoPrefix(t.CVMFSRepo, ReferenceIndexLocation(t.CVMFSRepo)), func(current []byte) ([]byte, error) {
+		idx, err := unmarshalReferenceIndex(current)
+		if err != nil {
+			LogE(err).WithFields(log.Fields{"repo": t.CVMFSRepo}).Error("Impossible to update the reference index")
+			return nil, err
+		}
+		update(&idx)
+		return json.MarshalIndent(idx, "", "  ")
+	})
+}
+
+// add to the transaction the references from the image, converted with the
+// name, to its layers
+func AddImageToReferenceIndex(t *Transaction, name string, manifest da.Manifest, indexed IndexedName) {
+	updateReferenceIndex(t, func(idx *ReferenceIndex) {
+		indexed.Converted = time.Now()
+		idx.add(name, manifest, indexed)
+	})
+}
+
+// add to the transaction the removal of the name from the index
+func RemoveImageFromReferenceIndex(t *Transaction, name string) {
+	updateReferenceIndex(t, func(idx *ReferenceIndex) {
+		idx.removeName(name)
+	})
+}
+
+// the manifests in .metadata, name -> manifest, a manifest we can not read is
+// an error: we would not know what the image uses
+func storedManifests(CVMFSRepo string) (map[string]da.Manifest, error) {
+	manifests := make(map[string]da.Manifest)
+	metadata := RepositoryPath(CVMFSRepo, ".metadata")
+	err := filepath.Walk(metadata, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == metadata {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() || info.Name() != "manifest.json" {
+			return nil
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var manifest da.Manifest
+		if err = json.Unmarshal(content, &manifest); err != nil {
+			return fmt.Errorf("Impossible to read the manifest %s: %v", path, err)
+		}
+		// the digests become paths in the repository
+		if _, err = digest.Parse(manifest.Config.Digest); err != nil {
+			return fmt.Errorf("Wrong configuration %q in the manifest %s: %v", manifest.Config.Digest, path, err)
+		}
+		for _, layer := range manifest.Layers {
+			if _, err = digest.Parse(layer.Digest); err != nil {
+				return fmt.Errorf("Wrong layer %q in the manifest %s: %v", layer.Digest, path, err)
+			}
+		}
+		name, err := filepath.Rel(metadata, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		manifests[name] = manifest
+		return nil
+	})
+	return manifests, err
+}
+
+// build the index from the manifests in .metadata, the names already in
+// current keep when they were converted, the others take the time of their
+// manifest
+func BuildReferenceIndex(CVMFSRepo string, current ReferenceIndex) (ReferenceIndex, error) {
+	idx := NewReferenceIndex()
+	manifests, err := storedManifests(CVMFSRepo)
+	if err != nil {
+		return idx, err
+	}
+	for name, manifest := range manifests {
+		indexed := IndexedName{}
+		if image, ok := current.Images[manifest.Config.Digest]; ok {
+			indexed = image.Names[name]
+		}
+		if indexed.Converted.IsZero() {
+			if info, err := os.Stat(RepositoryPath(CVMFSRepo, ".metadata", name, "manifest.json")); err == nil {
+				indexed.Converted = info.ModTime()
+			}
+		}
+		var converted ConvertedWish
+		content, err := ioutil.ReadFile(RepositoryPath(CVMFSRepo, ".metadata", name, "wish.json"))
+		if err == nil && json.Unmarshal(content, &converted) == nil && converted.OutputImage != "" {
+			if converted.InputImage != "" {
+				indexed.InputImage = converted.InputImage
+			}
+			indexed.OutputImage = converted.OutputImage
+		}
+		idx.add(name, manifest, indexed)
+	}
+	return idx, nil
+}
+
+// the index in the repository and the one rebuilt from the manifests, both
+// marshaled, they are the same if the index is consistent
+func rebuiltReferenceIndex(CVMFSRepo string) (idx ReferenceIndex, current, rebuilt []byte, err error) {
+	current, err = ioutil.ReadFile(ReferenceIndexLocation(CVMFSRepo))
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	old, err := unmarshalReferenceIndex(current)
+	if err != nil {
+		// a corrupted index is simply replaced
+		old = NewReferenceIndex()
+	}
+	if idx, err = BuildReferenceIndex(CVMFSRepo, old); err != nil {
+		return
+	}
+	rebuilt, err = json.MarshalIndent(idx, "", "  ")
+	return
+}
+
+// add to the transaction the rebuild of the index, from the manifests as they
+// are when the transaction is open
+func addReferenceIndexRebuild(t *Transaction) {
+	t.add("rebuild reference index", TrimCVMFSRepoPrefix(t.CVMFSRepo, ReferenceIndexLocation(t.CVMFSRepo)), func(p Publisher, path string) error {
+		_, _, rebuilt, err := rebuiltReferenceIndex(t.CVMFSRepo)
+		if err != nil {
+			return err
+		}
+		return p.WriteFile(path, bytes.NewReader(rebuilt))
+	})
+}
+
+// rebuild the index from the manifests and publish it if it is different from
+// the one in the repository, false if it was already correct
+func RebuildReferenceIndex(CVMFSRepo string, dryRun bool) (idx ReferenceIndex, changed bool, err error) {
+	llog := func(l *log.Entry) *log.Entry {
+		return l.WithFields(log.Fields{"action": "rebuild reference index",
+			"repo":    CVMFSRepo,
+			"dry run": dryRun})
+	}
+	idx, current, rebuilt, err := rebuiltReferenceIndex(CVMFSRepo)
+	if err != nil {
+		llog(LogE(err)).Error("Impossible to rebuild the reference index")
+		return
+	}
+	changed = !bytes.Equal(current, rebuilt)
+	if dryRun || !changed {
+		return
+	}
+
+	t := NewTransaction(CVMFSRepo)
+	addReferenceIndexRebuild(t)
+	if err = t.Commit(context.Background()); err != nil {
+		llog(LogE(err)).Error("Error in publishing the reference index")
+		return
+	}
+	llog(Log()).WithFields(log.Fields{"images": len(idx.Images), "layers": len(idx.Layers)}).Info(
+		"Reference index rebuilt")
+	return
+}
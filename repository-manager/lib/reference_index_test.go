@@ -0,0 +1,128 @@
+package lib
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	da "github.com/cvmfs/docker-graphdriver/repository-manager/docker-api"
+)
+
+func TestReferenceIndex(t *testing.T) {
+	cvmfs := newFakeCvmfs(t, testRepo)
+	defer cvmfs.Close()
+	registry := newFakeRegistry()
+	defer registry.Close()
+
+	shared := map[string]string{"etc/os-release": "shared"}
+	first := registry.AddImage(t, "library/first", "latest", shared)
+	second := registry.AddImage(t, "library/second", "latest", shared,
+		map[string]string{"second": "second"})
+	layer := first.Layers[0].Digest
+
+	// the same image converted under two names, and the first name again
+	updates := []struct {
+		name     string
+		manifest da.Manifest
+	}{{"first", first}, {"second", second}, {"other", first}, {"first", first}}
+	for _, update := range updates {
+		transaction := NewTransaction(testRepo)
+		AddImageToReferenceIndex(transaction, update.name, update.manifest, IndexedName{InputImage: update.name})
+		if err := transaction.Commit(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if revision := cvmfs.Revision(testRepo); revision != 4 {
+		t.Errorf("Expected 4 publishes, got %d", revision)
+	}
+
+	index, err := ReadReferenceIndex(testRepo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Images) != 2 || len(index.Images[first.Config.Digest].Names) != 2 {
+		t.Fatalf("Wrong images in the index: %+v", index.Images)
+	}
+	expected := []string{first.Config.Digest, second.Config.Digest}
+	if first.Config.Digest > second.Config.Digest {
+		expected = []string{second.Config.Digest, first.Config.Digest}
+	}
+	if images := index.ImagesOfLayer(layer); !reflect.DeepEqual(images, expected) {
+		t.Errorf("Wrong images of the shared layer: %v", images)
+	}
+
+	// the name moves to another image, the image without names goes away
+	transaction := NewTransaction(testRepo)
+	AddImageToReferenceIndex(transaction, "second", first, IndexedName{})
+	RemoveImageFromReferenceIndex(transaction, "other")
+	if err := transaction.Commit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	index, _ = ReadReferenceIndex(testRepo)
+	if digest, ok := index.ImageOfName("second"); !ok || digest != first.Config.Digest || len(index.Images) != 1 {
+		t.Errorf("Wrong index after moving the name: %+v", index.Images)
+	}
+	if images := index.ImagesOfLayer(second.Layers[1].Digest); len(images) != 0 {
+		t.Errorf("The layer of the image removed is still in the index: %v", images)
+	}
+
+	// a corrupted index stops the transaction
+	ioutil.WriteFile(cvmfs.Path(testRepo, ".metadata", "references.json"), []byte("{"), 0644)
+	transaction = NewTransaction(testRepo)
+	RemoveImageFromReferenceIndex(transaction, "first")
+	if err := transaction.Commit(context.Background()); err == nil {
+		t.Errorf("The corrupted index was updated")
+	}
+}
+
+func TestRebuildReferenceIndex(t *testing.T) {
+	cvmfs := newFakeCvmfs(t, testRepo)
+	defer cvmfs.Close()
+	registry := newFakeRegistry()
+	defer registry.Close()
+	_, restore := fakePush(t, registry)
+	defer restore()
+
+	shared := map[string]string{"etc/os-release": "shared"}
+	registry.AddImage(t, "library/first", "latest", shared)
+	registry.AddImage(t, "library/second", "latest", shared,
+		map[string]string{"second": "second"})
+	for _, name := range []string{"library/first", "library/second"} {
+		if _, err := ConvertWish(context.Background(), testWish(registry, name, "latest"), false, false, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(ReferenceIndexLocation(testRepo)); err != nil {
+		t.Fatalf("The conversions did not write the index: %s", err)
+	}
+
+	// the index written by the conversions is already correct
+	if _, changed, err := RebuildReferenceIndex(testRepo, false); err != nil || changed {
+		t.Errorf("Index rebuilt without need: %v", err)
+	}
+	ioutil.WriteFile(cvmfs.Path(testRepo, ".metadata", "references.json"), []byte("{"), 0644)
+	if _, changed, err := RebuildReferenceIndex(testRepo, true); err != nil || !changed {
+		t.Errorf("Corrupted index not detected: %v", err)
+	}
+	revision := cvmfs.Revision(testRepo)
+	index, changed, err := RebuildReferenceIndex(testRepo, false)
+	if err != nil || !changed || cvmfs.Revision(testRepo) != revision+1 {
+		t.Fatalf("Index not rebuilt: %v", err)
+	}
+	if len(index.Images) != 2 {
+		t.Errorf("Wrong images in the rebuilt index: %+v", index.Images)
+	}
+	rebuilt, _ := ReadReferenceIndex(testRepo)
+	if len(rebuilt.Images) != 2 || !reflect.DeepEqual(rebuilt.Layers, index.Layers) {
+		t.Errorf("The rebuilt index was not published: %+v", rebuilt)
+	}
+	for _, image := range rebuilt.Images {
+		for name, indexed := range image.Names {
+			if indexed.Converted.IsZero() || indexed.InputImage == "" || indexed.OutputImage == "" {
+				t.Errorf("Wrong rebuilt image %s: %+v", name, indexed)
+			}
+		}
+	}
+}
@@ -0,0 +1,448 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The registry tells how to authenticate in the WWW-Authenticate header of a
+// 401 answer. With the Bearer scheme we ask a token to the realm, for the
+// service and the scope of the challenge, and we keep it in a cache until it
+// expires. With the Basic scheme we send directly the user and the password.
+// All the requests for an image (manifest, configuration, layers and tags) go
+// through a registryAuth, which authenticates when the registry answers 401:
+// at the first request and when the token expires, ex: in the middle of a
+// long download.
+
+type authChallenge struct {
+	Scheme string
+	Params map[string]string
+}
+
+func isTokenChar(c byte) bool {
+	if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+type challengeScanner struct {
+	s   string
+	pos int
+}
+
+func (c *challengeScanner) skipSpaces() {
+	for c.pos < len(c.s) && (c.s[c.pos] == ' ' || c.s[c.pos] == '\t') {
+		c.pos++
+	}
+}
+
+func (c *challengeScanner) token() string {
+	start := c.pos
+	for c.pos < len(c.s) && isTokenChar(c.s[c.pos]) {
+		c.pos++
+	}
+	return c.s[start:c.pos]
+}
+
+func (c *challengeScanner) quotedString() (string, error) {
+	// we are on the opening quote
+	c.pos++
+	var value strings.Builder
+	for c.pos < len(c.s) {
+		ch := c.s[c.pos]
+		c.pos++
+		switch ch {
+		case '"':
+			return value.String(), nil
+		case '\\':
+			if c.pos < len(c.s) {
+				value.WriteByte(c.s[c.pos])
+				c.pos++
+			}
+		default:
+			value.WriteByte(ch)
+		}
+	}
+	return "", fmt.Errorf("Unterminated quoted string in the challenge: %s", c.s)
+}
+
+// parse the WWW-Authenticate headers as in RFC 7235: each header may contain
+// several challenges, each one a scheme followed by comma separated
+// parameters, whose values may be quoted and contain commas, like the scope
+// "repository:foo:pull,push"
+func parseChallenges(headers []string) ([]authChallenge, error) {
+	var challenges []authChallenge
+	for _, header := range headers {
+		c := &challengeScanner{s: header}
+		for {
+			c.skipSpaces()
+			for c.pos < len(c.s) && c.s[c.pos] == ',' {
+				c.pos++
+				c.skipSpaces()
+			}
+			if c.pos >= len(c.s) {
+				break
+			}
+			scheme := c.token()
+			if scheme == "" {
+				return nil, fmt.Errorf("Wrong formatting of the challenge: %s", header)
+			}
+			challenge := authChallenge{Scheme: strings.ToLower(scheme), Params: make(map[string]string)}
+			for {
+				c.skipSpaces()
+				start := c.pos
+				name := c.token()
+				c.skipSpaces()
+				if name == "" || c.pos >= len(c.s) || c.s[c.pos] != '=' {
+					// not a parameter, it is the next challenge
+					c.pos = start
+					break
+				}
+				c.pos++
+				c.skipSpaces()
+				var value string
+				if c.pos < len(c.s) && c.s[c.pos] == '"' {
+					var err error
+					value, err = c.quotedString()
+					if err != nil {
+						return nil, err
+					}
+				} else {
+					value = c.token()
+				}
+				challenge.Params[strings.ToLower(name)] = value
+				c.skipSpaces()
+				if c.pos < len(c.s) && c.s[c.pos] == ',' {
+					c.pos++
+					continue
+				}
+				break
+			}
+			challenges = append(challenges, challenge)
+			c.skipSpaces()
+			if c.pos < len(c.s) && c.s[c.pos] != ',' && !isTokenChar(c.s[c.pos]) {
+				return nil, fmt.Errorf("Wrong formatting of the challenge: %s", header)
+			}
+		}
+	}
+	if len(challenges) == 0 {
+		return nil, fmt.Errorf("No authentication challenge from the registry")
+	}
+	return challenges, nil
+}
+
+// the tokens are shared by all the images and cached until they expire
+type cachedToken struct {
+	authorization string
+	expires       time.Time
+}
+
+var (
+	tokenCacheLock sync.Mutex
+	tokenCache     = make(map[string]cachedToken)
+)
+
+// by the distribution spec a token without expires_in lasts 60 seconds
+const defaultTokenLifetime = 60 * time.Second
+
+// the token depends on who asks it, so the credentials are part of the key,
+// hashed to not keep the secrets around
+func tokenCacheKey(challenge authChallenge, credentials Credentials) string {
+	secret := sha256.Sum256([]byte(credentials.Password + "\x00" + credentials.IdentityToken))
+	return strings.Join([]string{
+		challenge.Params["realm"],
+		challenge.Params["service"],
+		challenge.Params["scope"],
+		credentials.Username,
+		fmt.Sprintf("%x", secret)}, "\x00")
+}
+
+func getCachedToken(key string) (string, bool) {
+	tokenCacheLock.Lock()
+	defer tokenCacheLock.Unlock()
+	token, ok := tokenCache[key]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(token.expires) {
+		delete(tokenCache, key)
+		return "", false
+	}
+	return token.authorization, true
+}
+
+func cacheToken(key, authorization string, lifetime time.Duration) {
+	tokenCacheLock.Lock()
+	defer tokenCacheLock.Unlock()
+	// we stop using the token a bit before it expires
+	margin := lifetime / 10
+	if margin > 30*time.Second {
+		margin = 30 * time.Second
+	}
+	tokenCache[key] = cachedToken{authorization: authorization, expires: time.Now().Add(lifetime - margin)}
+}
+
+// forget the token, the registry refused it
+func invalidateToken(authorization string) {
+	tokenCacheLock.Lock()
+	defer tokenCacheLock.Unlock()
+	for key, token := range tokenCache {
+		if token.authorization == authorization {
+			delete(tokenCache, key)
+		}
+	}
+}
+
+// the value of the Authorization header that answers one of the challenges
+func authorize(challenges []authChallenge, credentials Credentials) (string, error) {
+	var basic *authChallenge
+	for i, challenge := range challenges {
+		switch challenge.Scheme {
+		case "bearer":
+			return bearerAuthorization(challenge, credentials)
+		case "basic":
+			basic = &challenges[i]
+		}
+	}
+	if basic != nil {
+		if credentials.Username == "" || credentials.Password == "" {
+			return "", fmt.Errorf("The registry requires basic authentication, but there are no username and password")
+		}
+		userPass := credentials.Username + ":" + credentials.Password
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(userPass)), nil
+	}
+	return "", fmt.Errorf("Unsupported authentication scheme: %s", challenges[0].Scheme)
+}
+
+func bearerAuthorization(challenge authChallenge, credentials Credentials) (string, error) {
+	key := tokenCacheKey(challenge, credentials)
+	if authorization, ok := getCachedToken(key); ok {
+		return authorization, nil
+	}
+	authorization, lifetime, err := requestAuthToken(challenge, credentials)
+	if err != nil {
+		return "", err
+	}
+	cacheToken(key, authorization, lifetime)
+	return authorization, nil
+}
+
+func authorizeFromResponse(resp *http.Response, credentials Credentials) (string, error) {
+	challenges, err := parseChallenges(resp.Header["Www-Authenticate"])
+	if err != nil {
+		return "", err
+	}
+	return authorize(challenges, credentials)
+}
+
+func requestAuthToken(challenge authChallenge, credentials Credentials) (authToken string, lifetime time.Duration, err error) {
+	realm := challenge.Params["realm"]
+	if realm == "" {
+		err = fmt.Errorf("No realm in the bearer challenge")
+		return
+	}
+	options := make(map[string]string)
+	for k, v := range challenge.Params {
+		if k != "realm" && k != "error" && k != "error_description" {
+			options[k] = v
+		}
+	}
+	var req *http.Request
+	if credentials.IdentityToken != "" {
+		req, err = identityTokenRequest(realm, options, credentials.IdentityToken)
+		if err != nil {
+			return
+		}
+	} else {
+		req, err = http.NewRequest("GET", realm, nil)
+		if err != nil {
+			return
+		}
+
+		query := req.URL.Query()
+		for k, v := range options {
+			query.Add(k, v)
+		}
+		if credentials.Username != "" && credentials.Password != "" {
+			query.Add("offline_token", "true")
+			req.SetBasicAuth(credentials.Username, credentials.Password)
+		}
+		req.URL.RawQuery = query.Encode()
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		err = fmt.Errorf("Authorization error %s", resp.Status)
+		return
+	}
+
+	var jsonResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&jsonResp)
+	if err != nil {
+		return
+	}
+	token := jsonResp.Token
+	if token == "" {
+		// the OAuth endpoint answers with access_token
+		token = jsonResp.AccessToken
+	}
+	if token == "" {
+		err = fmt.Errorf("Didn't get the token key from the server")
+		return
+	}
+	lifetime = defaultTokenLifetime
+	if jsonResp.ExpiresIn > 0 {
+		lifetime = time.Duration(jsonResp.ExpiresIn) * time.Second
+	}
+	return "Bearer " + token, lifetime, nil
+}
+
+// an identity token is an OAuth refresh token, exchanged for the bearer token
+// with a POST to the realm
+func identityTokenRequest(realm string, options map[string]string, identityToken string) (*http.Request, error) {
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", identityToken)
+	form.Set("client_id", "docker2cvmfs")
+	for k, v := range options {
+		form.Set(k, v)
+	}
+	req, err := http.NewRequest("POST", realm, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+// the authorization to use against a registry, shared by all the requests
+// for the same image, a nil registryAuth makes anonymous requests
+type registryAuth struct {
+	credentials Credentials
+	// set when the requests go to a mirror, to track its health
+	mirror *registryMirror
+
+	lock          sync.Mutex
+	authorization string
+}
+
+// we learn how to authenticate from the answer to the first request, only a
+// registry token is used from the start
+func newRegistryAuth(credentials Credentials) *registryAuth {
+	auth := &registryAuth{credentials: credentials}
+	if credentials.RegistryToken != "" {
+		auth.authorization = "Bearer " + credentials.RegistryToken
+	}
+	return auth
+}
+
+func (a *registryAuth) get() string {
+	if a == nil {
+		return ""
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.authorization
+}
+
+// the registries redirect the downloads of the blobs, ex: to an object
+// storage with a signed url, the authorization of the registry is never sent
+// to another host
+func dropAuthorizationOnRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return fmt.Errorf("Stopped after 10 redirects")
+	}
+	if req.URL.Host != via[0].URL.Host {
+		req.Header.Del("Authorization")
+	}
+	return nil
+}
+
+// make the request with the authorization, if the registry refuses it we
+// authenticate, following the challenge, and retry once
+func (a *registryAuth) Do(req *http.Request) (*http.Response, error) {
+	resp, err := a.do(req)
+	if a != nil && a.mirror != nil {
+		a.mirror.observe(resp, err)
+	}
+	return resp, err
+}
+
+func (a *registryAuth) do(req *http.Request) (*http.Response, error) {
+	client := &http.Client{CheckRedirect: dropAuthorizationOnRedirect}
+	authorization := a.get()
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := client.Do(req)
+	if err != nil || a == nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	// a 401 after a redirect comes from somewhere else, not from the
+	// registry, there is no challenge to follow
+	if resp.Request != nil && resp.Request.URL.Host != req.URL.Host {
+		return resp, nil
+	}
+	// a registry token can not be renewed
+	if a.credentials.RegistryToken != "" {
+		return resp, nil
+	}
+
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if authorization != "" {
+		Log().WithFields(log.Fields{"url": req.URL.String()}).Info(
+			"Authorization refused by the registry, authenticating again")
+		invalidateToken(authorization)
+	}
+	newAuthorization, err := authorizeFromResponse(resp, a.credentials)
+	if err != nil {
+		LogE(err).WithFields(log.Fields{"url": req.URL.String()}).Error(
+			"Error in getting the authentication token")
+		return nil, err
+	}
+	a.lock.Lock()
+	a.authorization = newAuthorization
+	a.lock.Unlock()
+
+	retry, err := http.NewRequest(req.Method, req.URL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	retry = retry.WithContext(req.Context())
+	// the body of the uploads is sent again
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+		retry.GetBody = req.GetBody
+		retry.ContentLength = req.ContentLength
+	}
+	for k, v := range req.Header {
+		retry.Header[k] = v
+	}
+	retry.Header.Set("Authorization", newAuthorization)
+	return client.Do(retry)
+}
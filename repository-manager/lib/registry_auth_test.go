@@ -0,0 +1,148 @@
+package lib
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseChallenges(t *testing.T) {
+	for _, test := range []struct {
+		headers  []string
+		expected []authChallenge
+	}{
+		{
+			[]string{`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/fedora:pull,push"`},
+			[]authChallenge{{"bearer", map[string]string{
+				"realm":   "https://auth.docker.io/token",
+				"service": "registry.docker.io",
+				"scope":   "repository:library/fedora:pull,push"}}},
+		},
+		{
+			[]string{`Basic realm="Registry \"Realm\""`},
+			[]authChallenge{{"basic", map[string]string{"realm": `Registry "Realm"`}}},
+		},
+		{
+			[]string{`Basic realm="basic", Bearer realm="https://x/token", service=x`},
+			[]authChallenge{
+				{"basic", map[string]string{"realm": "basic"}},
+				{"bearer", map[string]string{"realm": "https://x/token", "service": "x"}}},
+		},
+		{
+			[]string{`Basic realm="one"`, `Bearer realm="two"`},
+			[]authChallenge{
+				{"basic", map[string]string{"realm": "one"}},
+				{"bearer", map[string]string{"realm": "two"}}},
+		},
+	} {
+		challenges, err := parseChallenges(test.headers)
+		if err != nil {
+			t.Errorf("Error parsing %v: %s", test.headers, err)
+			continue
+		}
+		if !reflect.DeepEqual(challenges, test.expected) {
+			t.Errorf("Wrong challenges for %v: %+v", test.headers, challenges)
+		}
+	}
+
+	for _, wrong := range [][]string{
+		nil,
+		{""},
+		{`Bearer realm="unterminated`},
+		{`Bearer realm="x" "stray"`},
+	} {
+		if _, err := parseChallenges(wrong); err == nil {
+			t.Errorf("Expected an error parsing %v", wrong)
+		}
+	}
+}
+
+func countRequests(registry *fakeRegistry, request string) int {
+	n := 0
+	for _, r := range registry.Requests() {
+		if r == request {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRegistryTokenCache(t *testing.T) {
+	registry := newFakeRegistry()
+	defer registry.Close()
+	manifest := registry.AddImage(t, "library/cached", "latest", map[string]string{"file": "content"})
+	image, err := ParseImage("http://" + registry.Host() + "/library/cached:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := image.getByteManifest(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := countRequests(registry, "GET /token"); n != 1 {
+		t.Errorf("Expected a single token request, got %d", n)
+	}
+
+	// the token expires in the middle of the work, we ask a new one
+	auth := newRegistryAuth(Credentials{})
+	req, err := http.NewRequest("GET", image.GetManifestUrl(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := auth.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || auth.get() != "Bearer fake-token" {
+		t.Fatalf("Wrong authentication: %d %s", resp.StatusCode, auth.get())
+	}
+	registry.RotateToken("new-token")
+	if _, err := getVerifiedBlob(getLayerUrl(image, manifest.Layers[0]), auth, manifest.Layers[0].Digest); err != nil {
+		t.Errorf("Error downloading the blob after the token expired: %s", err)
+	}
+	if n := countRequests(registry, "GET /token"); n != 2 {
+		t.Errorf("Expected a second token request, got %d", n)
+	}
+	if auth.get() != "Bearer new-token" {
+		t.Errorf("The new token is not used: %s", auth.get())
+	}
+}
+
+func TestRegistryBasicAuth(t *testing.T) {
+	registry := newFakeRegistry()
+	defer registry.Close()
+	registry.AddImage(t, "library/basic", "latest", map[string]string{"file": "content"})
+	registry.RequireBasicAuth("alice", "secret")
+	image, err := ParseImage("http://" + registry.Host() + "/library/basic:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := getManifestWithCredentials(image, Credentials{}); err == nil {
+		t.Errorf("Expected an error without credentials")
+	}
+	if _, _, err := getManifestWithCredentials(image, Credentials{Username: "alice", Password: "secret"}); err != nil {
+		t.Errorf("Error getting the manifest with basic authentication: %s", err)
+	}
+
+	req, err := http.NewRequest("GET", image.GetManifestUrl(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &registryAuth{credentials: Credentials{Username: "alice", Password: "wrong"}}
+	resp, err := auth.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected the wrong password to be refused, got %d", resp.StatusCode)
+	}
+	if !strings.HasPrefix(auth.get(), "Basic ") {
+		t.Errorf("Expected a basic authorization, got %s", auth.get())
+	}
+}
@@ -0,0 +1,140 @@
+package lib
+
+import (
+	"sync"
+	"time"
+
+	da "github.com/cvmfs/docker-graphdriver/repository-manager/docker-api"
+)
+
+// What happened during the conversion of a wish, for the monitoring: the
+// status of each layer, of the thin image and of the other artifacts written
+// in the repository, how long each step took and the final outcome. A step
+// without status was never completed.
+
+type LayerStatus string
+
+const (
+	// downloaded and added to the transaction, it becomes ingested when the
+	// transaction is published
+	LayerDownloaded LayerStatus = "downloaded"
+	LayerSkipped    LayerStatus = "skipped-existing"
+	LayerIngested   LayerStatus = "ingested"
+	LayerFailed     LayerStatus = "failed"
+)
+
+type StepStatus string
+
+const (
+	StepDone    StepStatus = "done"
+	StepSkipped StepStatus = "skipped"
+	StepFailed  StepStatus = "failed"
+)
+
+type Outcome string
+
+const (
+	OutcomeConverted        Outcome = "converted"
+	OutcomeAlreadyConverted Outcome = "already-converted"
+	OutcomeFailed           Outcome = "failed"
+	// the conversion was stopped, ex: the process is shutting down
+	OutcomeCanceled Outcome = "canceled"
+)
+
+type LayerReport struct {
+	Digest          string      `json:"digest"`
+	Status          LayerStatus `json:"status"`
+	Error           string      `json:"error,omitempty"`
+	Size            int64       `json:"size,omitempty"`
+	DownloadSeconds float64     `json:"download_seconds,omitempty"`
+}
+
+type ConversionTimings struct {
+	Layers  float64 `json:"layers_seconds"`
+	Push    float64 `json:"push_seconds"`
+	Publish float64 `json:"publish_seconds"`
+	Total   float64 `json:"total_seconds"`
+}
+
+type ConversionReport struct {
+	InputImage      string            `json:"input_image"`
+	OutputImage     string            `json:"output_image"`
+	Repository      string            `json:"repository"`
+	Platform        string            `json:"platform,omitempty"`
+	ConfigDigest    string            `json:"config_digest,omitempty"`
+	Layers          []LayerReport     `json:"layers"`
+	ThinImageDigest string            `json:"thin_image_digest,omitempty"`
+	Singularity     StepStatus        `json:"singularity,omitempty"`
+	ReferenceIndex  StepStatus        `json:"reference_index,omitempty"`
+	RemoveSchedule  StepStatus        `json:"remove_schedule,omitempty"`
+	Publish         StepStatus        `json:"publish,omitempty"`
+	Started         time.Time         `json:"started"`
+	Finished        time.Time         `json:"finished"`
+	Timings         ConversionTimings `json:"timings"`
+	Outcome         Outcome           `json:"outcome"`
+	Error           string            `json:"error,omitempty"`
+}
+
+func newConversionReport(wish WishFriendly) ConversionReport {
+	return ConversionReport{
+		InputImage:  wish.InputName,
+		OutputImage: wish.OutputName,
+		Repository:  wish.CvmfsRepo,
+		Platform:    wish.Platform,
+		Layers:      []LayerReport{},
+		Started:     time.Now()}
+}
+
+// the layers are reported by the goroutines of the conversion while it runs
+type layerReports struct {
+	lock   sync.Mutex
+	layers map[string]LayerReport
+}
+
+func (l *layerReports) set(layer LayerReport) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.layers == nil {
+		l.layers = make(map[string]LayerReport)
+	}
+	l.layers[layer.Digest] = layer
+}
+
+// the layers in the order of the manifest, the ones we never heard of failed
+func (l *layerReports) list(manifest da.Manifest, published bool) []LayerReport {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	layers := []LayerReport{}
+	for _, layer := range manifest.Layers {
+		report, ok := l.layers[layer.Digest]
+		if !ok {
+			report = LayerReport{
+				Digest: layer.Digest,
+				Status: LayerFailed,
+				Error:  "layer not downloaded"}
+		}
+		if report.Size == 0 {
+			report.Size = int64(layer.Size)
+		}
+		if report.Status == LayerDownloaded && published {
+			report.Status = LayerIngested
+		}
+		layers = append(layers, report)
+	}
+	return layers
+}
+
+// set the outcome of the conversion from its error
+func (r *ConversionReport) finish(err error) {
+	r.Finished = time.Now()
+	r.Timings.Total = r.Finished.Sub(r.Started).Seconds()
+	switch {
+	case err != nil:
+		if r.Outcome == "" {
+			r.Outcome = OutcomeFailed
+		}
+		r.Error = err.Error()
+	case r.Outcome == "":
+		r.Outcome = OutcomeConverted
+	}
+}
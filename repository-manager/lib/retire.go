@@ -0,0 +1,237 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+
+	da "github.com/cvmfs/docker-graphdriver/repository-manager/docker-api"
+)
+
+// An image is retired when it is converted in a repository but it is not
+// wanted anymore, ex: it was removed from the recipe. Its manifest is removed
+// from .metadata and added to the remove schedule, so that the garbage
+// collection removes its layers and its singularity image if no other image
+// uses them, its singularity symlink is removed and, on request, its thin
+// image is deleted from the registry.
+
+// what the conversion leaves in .metadata/$IMAGE/wish.json, to retire the
+// image later
+type ConvertedWish struct {
+	InputImage         string `json:"input_image,omitempty"`
+	OutputImage        string `json:"output_image"`
+	UserOutput         string `json:"user_output,omitempty"`
+	OutputCredentials  string `json:"output_credentials,omitempty"`
+	ThinImageDigest    string `json:"thin_image_digest,omitempty"`
+	SingularitySymlink string `json:"singularity_symlink,omitempty"`
+}
+
+type RetiredImage struct {
+	// as in .metadata, ex: registry.example.ch/library/ubuntu:latest
+	Image            string `json:"image"`
+	Repository       string `json:"repository"`
+	ThinImage        string `json:"thin_image,omitempty"`
+	ThinImageDeleted bool   `json:"thin_image_deleted"`
+}
+
+// the images converted in the repository, as in .metadata
+func ConvertedImages(CVMFSRepo string) ([]string, error) {
+	var images []string
+	metadata := RepositoryPath(CVMFSRepo, ".metadata")
+	err := filepath.Walk(metadata, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == metadata {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() || info.Name() != "manifest.json" {
+			return nil
+		}
+		image, err := filepath.Rel(metadata, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		images = append(images, image)
+		return nil
+	})
+	sort.Strings(images)
+	return images, err
+}
+
+// the images converted in the repositories of the recipe that are not in the
+// recipe anymore, repository -> images
+func FindRetiredImages(recipe Recipe) (map[string][]string, error) {
+	if recipe.Incomplete {
+		return nil, fmt.Errorf("Some inputs of the recipe could not be expanded, not retiring any image")
+	}
+	wanted := make(map[string]map[string]bool)
+	for _, wish := range recipe.Wishes {
+		image, err := ParseImage(wish.InputName)
+		if err != nil {
+			return nil, err
+		}
+		image.Platform = wish.Platform
+		if wanted[wish.CvmfsRepo] == nil {
+			wanted[wish.CvmfsRepo] = make(map[string]bool)
+		}
+		wanted[wish.CvmfsRepo][image.GetPlatformName()] = true
+	}
+	retired := make(map[string][]string)
+	for repo, images := range wanted {
+		converted, err := ConvertedImages(repo)
+		if err != nil {
+			return nil, err
+		}
+		for _, image := range converted {
+			if !images[image] {
+				retired[repo] = append(retired[repo], image)
+			}
+		}
+	}
+	return retired, nil
+}
+
+// retire all the images not in the recipe anymore, the errors are logged and
+// we go on with the other images, the last one is returned
+func RetireImages(recipe Recipe, deleteThinImages bool) (retired []RetiredImage, err error) {
+	toRetire, err := FindRetiredImages(recipe)
+	if err != nil {
+		LogE(err).Error("Impossible to find the images to retire")
+		return nil, err
+	}
+	for repo, images := range toRetire {
+		for _, image := range images {
+			r, errRetire := RetireImage(repo, image, deleteThinImages)
+			if errRetire != nil {
+				err = errRetire
+				continue
+			}
+			retired = append(retired, r)
+		}
+	}
+	return
+}
+
+func RetireImage(CVMFSRepo, image string, deleteThinImage bool) (retired RetiredImage, err error) {
+	llog := func(l *log.Entry) *log.Entry {
+		return l.WithFields(log.Fields{"action": "retire image",
+			"repo":  CVMFSRepo,
+			"image": image})
+	}
+	retired = RetiredImage{Image: image, Repository: CVMFSRepo}
+	metadata := filepath.Join(".metadata", image)
+	content, err := ioutil.ReadFile(RepositoryPath(CVMFSRepo, metadata, "manifest.json"))
+	if err != nil {
+		llog(LogE(err)).Error("Impossible to read the manifest of the image")
+		return
+	}
+	var manifest da.Manifest
+	if err = json.Unmarshal(content, &manifest); err != nil {
+		llog(LogE(err)).Error("Impossible to unmarshal the manifest of the image")
+		return
+	}
+	// converted before we kept track of the wish, the symlink is where it
+	// is for the images with a tag
+	converted := ConvertedWish{SingularitySymlink: image}
+	content, err = ioutil.ReadFile(RepositoryPath(CVMFSRepo, metadata, "wish.json"))
+	if err == nil {
+		err = json.Unmarshal(content, &converted)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		llog(LogE(err)).Error("Impossible to read the wish of the image")
+		return
+	}
+	retired.ThinImage = converted.OutputImage
+
+	// first the registry, if it fails we can try again the next time
+	if deleteThinImage {
+		if converted.OutputImage == "" || converted.ThinImageDigest == "" {
+			llog(Log()).Warning("Thin image of the image unknown, not deleting it")
+		} else {
+			retired.ThinImageDeleted, err = deleteThinImageFromRegistry(converted)
+			if err != nil {
+				llog(LogE(err)).WithFields(log.Fields{"thin image": converted.OutputImage}).Error(
+					"Error in deleting the thin image, not retiring the image")
+				return
+			}
+		}
+	}
+
+	t := NewTransaction(CVMFSRepo)
+	AddManifestToRemoveScheduler(t, manifest)
+	RemoveImageFromReferenceIndex(t, image)
+	t.RemoveAll(metadata)
+	if converted.SingularitySymlink != "" {
+		t.RemoveSymlink(converted.SingularitySymlink)
+	}
+	if err = t.Commit(context.Background()); err != nil {
+		llog(LogE(err)).Error("Error in retiring the image")
+		return
+	}
+	llog(Log()).WithFields(log.Fields{"thin image deleted": retired.ThinImageDeleted}).Info("Image retired")
+	return retired, nil
+}
+
+// delete the thin image, if its tag still points to the image we pushed,
+// false if the tag is somewhere else or not there anymore
+func deleteThinImageFromRegistry(converted ConvertedWish) (bool, error) {
+	img, err := ParseImage(converted.OutputImage)
+	if err != nil {
+		return false, err
+	}
+	credentials, err := GetOutputCredentials(img.Registry, converted.UserOutput, converted.OutputCredentials)
+	if err != nil {
+		return false, err
+	}
+	auth := newRegistryAuth(credentials)
+	manifestsUrl := fmt.Sprintf("%s://%s/v2/%s/manifests/", img.Scheme, img.Registry, img.Repository)
+	reference := img.Tag
+	if reference == "" {
+		reference = "latest"
+	}
+	req, err := http.NewRequest("HEAD", manifestsUrl+reference, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", da.MediaTypeDockerManifest)
+	resp, err := auth.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode != http.StatusOK:
+		return false, fmt.Errorf("Impossible to find the thin image, status code: %d", resp.StatusCode)
+	case resp.Header.Get("Docker-Content-Digest") != converted.ThinImageDigest:
+		Log().WithFields(log.Fields{"thin image": converted.OutputImage,
+			"digest": resp.Header.Get("Docker-Content-Digest")}).Warning(
+			"The tag of the thin image points to another image, not deleting it")
+		return false, nil
+	}
+
+	req, err = http.NewRequest("DELETE", manifestsUrl+converted.ThinImageDigest, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err = auth.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("The registry refused to delete the thin image, status code: %d", resp.StatusCode)
+	}
+	return true, nil
+}
@@ -0,0 +1,94 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRetireImages(t *testing.T) {
+	cvmfs := newFakeCvmfs(t, testRepo)
+	defer cvmfs.Close()
+	registry := newFakeRegistry()
+	defer registry.Close()
+	_, restore := fakePush(t, registry)
+	defer restore()
+	// the thin images really go to the registry, to be deleted
+	pushThinImage = pushThinImageToRegistry
+
+	shared := map[string]string{"etc/os-release": "shared"}
+	registry.AddImage(t, "library/first", "latest", shared)
+	second := registry.AddImage(t, "library/second", "latest", shared,
+		map[string]string{"second": "second"})
+	first := testWish(registry, "library/first", "latest")
+	for _, wish := range []WishFriendly{first, testWish(registry, "library/second", "latest")} {
+		if _, err := ConvertWish(context.Background(), wish, false, false, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// as if the second image was converted with its singularity image
+	secondImage, _ := ParseImage(testWish(registry, "library/second", "latest").InputName)
+	wishPath := cvmfs.Path(testRepo, ".metadata", secondImage.GetPlatformName(), "wish.json")
+	var converted ConvertedWish
+	content, err := ioutil.ReadFile(wishPath)
+	if err != nil || json.Unmarshal(content, &converted) != nil {
+		t.Fatalf("The conversion did not record the wish: %v", err)
+	}
+	converted.SingularitySymlink = secondImage.singularitySymlinkPath()
+	content, _ = json.Marshal(converted)
+	ioutil.WriteFile(wishPath, content, 0644)
+	symlink := cvmfs.Path(testRepo, converted.SingularitySymlink)
+	os.MkdirAll(filepath.Dir(symlink), 0755)
+	os.Symlink(ClientPath(testRepo, GetSingularityPathFromManifest(second)), symlink)
+
+	// the second image is not in the recipe anymore
+	recipe := Recipe{Wishes: []WishFriendly{first}}
+	if _, err := FindRetiredImages(Recipe{Wishes: recipe.Wishes, Incomplete: true}); err == nil {
+		t.Errorf("Images retired with an incomplete recipe")
+	}
+	retired, err := RetireImages(recipe, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(retired) != 1 || retired[0].Image != secondImage.GetPlatformName() || !retired[0].ThinImageDeleted {
+		t.Fatalf("Wrong images retired: %+v", retired)
+	}
+	if _, err := os.Stat(filepath.Dir(wishPath)); !os.IsNotExist(err) {
+		t.Errorf("The metadata of the retired image are still there")
+	}
+	if _, err := os.Lstat(symlink); !os.IsNotExist(err) {
+		t.Errorf("The singularity symlink of the retired image is still there")
+	}
+	if index, _ := ReadReferenceIndex(testRepo); len(index.Images) != 1 || index.Images[second.Config.Digest] != nil {
+		t.Errorf("The retired image is still in the reference index: %+v", index.Images)
+	}
+	schedule, err := FindImageToGarbageCollect(testRepo)
+	if err != nil || len(schedule) != 1 || schedule[0].Config.Digest != second.Config.Digest {
+		t.Errorf("The retired image was not scheduled for removal: %v", schedule)
+	}
+	secondThin, _ := ParseImage(converted.OutputImage)
+	if _, _, err := getManifestWithCredentials(secondThin, Credentials{}); err == nil {
+		t.Errorf("The thin image of the retired image is still in the registry")
+	}
+	firstThin, _ := ParseImage(first.OutputName)
+	if _, _, err := getManifestWithCredentials(firstThin, Credentials{}); err != nil {
+		t.Errorf("The thin image of the first image was deleted")
+	}
+
+	// nothing else to retire, and the garbage collection removes the layers
+	if retired, err = RetireImages(recipe, true); err != nil || len(retired) != 0 {
+		t.Errorf("Retired again: %+v, %v", retired, err)
+	}
+	if _, err := GarbageCollect(context.Background(), testRepo, GarbageCollectionOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for layer, used := range map[string]bool{second.Layers[0].Digest: true, second.Layers[1].Digest: false} {
+		_, err := os.Stat(LayerPath(testRepo, digestHex(layer)))
+		if used != (err == nil) {
+			t.Errorf("Wrong garbage collection of the layer %s, still used: %v", layer, used)
+		}
+	}
+}
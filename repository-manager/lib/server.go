@@ -0,0 +1,396 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The Server converts the wishes submitted through its HTTP API, the jobs run
+// one at a time from the JobQueue. The job logs with the entry carried by its
+// context, with the id of the job, and only those messages go in the log of
+// the job, not the ones of the HTTP API logged meanwhile.
+//
+//   GET  /wishes                  the wishes with their last job
+//   POST /wishes                  add the wishes of an input of a recipe v2,
+//                                 in YAML or JSON, and convert them now
+//   GET  /wishes/$ID              a single wish
+//   POST /wishes/$ID/convert      convert the wish again
+//   GET  /jobs                    all the jobs
+//   GET  /jobs/$ID                a single job, with the report of the conversion
+//   GET  /jobs/$ID/log            the log of the job
+//   POST /garbage-collection      garbage collect the repository {"cvmfs_repo": ...},
+//                                 with "dry_run": true only find the garbage
+
+type ServerOptions struct {
+	ForceDownload      bool
+	ConvertSingularity bool
+	// of the garbage collections
+	GracePeriod time.Duration
+}
+
+type Server struct {
+	queue   *JobQueue
+	options ServerOptions
+	logs    *jobLogHook
+}
+
+func NewServer(queue *JobQueue, options ServerOptions) *Server {
+	return &Server{queue: queue, options: options, logs: &jobLogHook{
+		formatter: &log.TextFormatter{DisableColors: true, FullTimestamp: true}}}
+}
+
+type wishView struct {
+	Id          int    `json:"id"`
+	InputImage  string `json:"input_image"`
+	OutputImage string `json:"output_image"`
+	Repository  string `json:"repository"`
+	Platform    string `json:"platform,omitempty"`
+	LastJob     *Job   `json:"last_job,omitempty"`
+}
+
+func (s *Server) wishView(wish WishFriendly) wishView {
+	view := wishView{
+		Id:          wish.Id,
+		InputImage:  wish.InputName,
+		OutputImage: wish.OutputName,
+		Repository:  wish.CvmfsRepo,
+		Platform:    wish.Platform}
+	if job, ok := s.queue.LastJob(wish.Id); ok {
+		view.LastJob = &job
+	}
+	return view
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/wishes", s.handleWishes)
+	mux.HandleFunc("/wishes/", s.handleWish)
+	mux.HandleFunc("/jobs", s.handleJobs)
+	mux.HandleFunc("/jobs/", s.handleJob)
+	mux.HandleFunc("/garbage-collection", s.handleGarbageCollection)
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// the id in /$PREFIX/$ID/..., with what follows it
+func parseId(path, prefix string) (id int, rest string, err error) {
+	parts := strings.SplitN(strings.TrimPrefix(path, prefix), "/", 2)
+	id, err = strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, "", fmt.Errorf("Wrong id %s", parts[0])
+	}
+	if len(parts) == 2 {
+		rest = parts[1]
+	}
+	return
+}
+
+func (s *Server) handleWishes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		views := []wishView{}
+		for _, wish := range s.queue.Wishes() {
+			views = append(views, s.wishView(wish))
+		}
+		writeJSON(w, http.StatusOK, views)
+	case "POST":
+		s.submitWishes(w, r)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method))
+	}
+}
+
+// the body is an input of a recipe v2, with all its settings
+func (s *Server) submitWishes(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var input YamlRecipeV2Input
+	if err = yaml.Unmarshal(body, &input); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if input.Image == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("No image in the wish"))
+		return
+	}
+	if input.CVMFSRoot != "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf(
+			"cvmfs_root is not supported by the server, use the --cvmfs-root flag"))
+		return
+	}
+	// the credentials would be read from the environment of the server for
+	// any registry the client names
+	if input.InputCredentials != "" || input.OutputCredentials != "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf(
+			"input_credentials and output_credentials are not supported by the server, "+
+				"configure the registries in the docker configuration of the server"))
+		return
+	}
+	platforms, tags, err := input.YamlRecipeSettings.check(input.Image)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	images, err := expandInput(input.Image, input.InputUser, input.InputCredentials, tags)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, fmt.Errorf("Impossible to expand the tags of the image: %s", err))
+		return
+	}
+	var wishes []WishFriendly
+	for _, image := range images {
+		created, _ := createWishesV2(image, input.YamlRecipeSettings, platforms, tags)
+		wishes = append(wishes, created...)
+	}
+	if len(wishes) == 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("No wish to convert for the image %s", input.Image))
+		return
+	}
+
+	var response struct {
+		Wishes []wishView `json:"wishes"`
+		Jobs   []Job      `json:"jobs"`
+	}
+	for _, wish := range wishes {
+		wish, err = s.queue.AddWish(wish)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		job, err := s.queue.Submit(Job{Kind: JobConvert, Wish: wish.Id, Repository: wish.CvmfsRepo})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		response.Jobs = append(response.Jobs, job)
+		response.Wishes = append(response.Wishes, s.wishView(wish))
+	}
+	writeJSON(w, http.StatusAccepted, response)
+}
+
+func (s *Server) handleWish(w http.ResponseWriter, r *http.Request) {
+	id, rest, err := parseId(r.URL.Path, "/wishes/")
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	wish, ok := s.queue.Wish(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("No wish %d", id))
+		return
+	}
+	switch {
+	case rest == "" && r.Method == "GET":
+		writeJSON(w, http.StatusOK, s.wishView(wish))
+	case rest == "convert" && r.Method == "POST":
+		job, err := s.queue.Submit(Job{Kind: JobConvert, Wish: wish.Id,
+			Repository: wish.CvmfsRepo, ConvertAgain: true})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, job)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("No %s %s", r.Method, r.URL.Path))
+	}
+}
+
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.queue.Jobs())
+}
+
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	id, rest, err := parseId(r.URL.Path, "/jobs/")
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	job, ok := s.queue.Job(id)
+	if !ok || r.Method != "GET" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("No job %d", id))
+		return
+	}
+	switch rest {
+	case "":
+		writeJSON(w, http.StatusOK, job)
+	case "log":
+		logFile, err := os.Open(s.queue.LogPath(id))
+		if os.IsNotExist(err) {
+			// not started yet
+			w.Header().Set("Content-Type", "text/plain")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		defer logFile.Close()
+		w.Header().Set("Content-Type", "text/plain")
+		io.Copy(w, logFile)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("No %s %s", r.Method, r.URL.Path))
+	}
+}
+
+func (s *Server) handleGarbageCollection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method))
+		return
+	}
+	var request struct {
+		Repository string `json:"cvmfs_repo"`
+		DryRun     bool   `json:"dry_run"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if request.Repository == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("No cvmfs_repo to garbage collect"))
+		return
+	}
+	job, err := s.queue.Submit(Job{Kind: JobGarbageCollection,
+		Repository: request.Repository, DryRun: request.DryRun})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// run the jobs in the queue until ctx is canceled, the job running at that
+// point is stopped and queued again, to run at the next start
+func (s *Server) Run(ctx context.Context) {
+	log.AddHook(s.logs)
+	for {
+		job, ok := s.queue.next(ctx)
+		if !ok {
+			return
+		}
+		job = s.runJob(ctx, job)
+		if err := s.queue.finish(job); err != nil {
+			LogE(err).WithFields(log.Fields{"job": job.Id}).Error("Impossible to save the result of the job")
+		}
+	}
+}
+
+func (s *Server) runJob(ctx context.Context, job Job) Job {
+	llog := func(l *log.Entry) *log.Entry {
+		return l.WithFields(log.Fields{"action": "run job",
+			"job":  job.Id,
+			"kind": job.Kind,
+			"repo": job.Repository})
+	}
+	logFile, err := os.Create(s.queue.LogPath(job.Id))
+	if err != nil {
+		llog(LogE(err)).Warning("Impossible to create the log of the job, going on")
+	} else {
+		s.logs.set(job.Id, logFile)
+		defer logFile.Close()
+		defer s.logs.set(0, nil)
+	}
+	ctx = WithLogEntry(ctx, Log().WithFields(log.Fields{"job": job.Id}))
+	llog(Log()).Info("Start job")
+
+	switch job.Kind {
+	case JobConvert:
+		wish, ok := s.queue.Wish(job.Wish)
+		if !ok {
+			err = fmt.Errorf("No wish %d", job.Wish)
+			break
+		}
+		var report ConversionReport
+		report, err = ConvertWish(ctx, wish, job.ConvertAgain, s.options.ForceDownload, s.options.ConvertSingularity)
+		job.Report = &report
+	case JobGarbageCollection:
+		var result GarbageCollectionResult
+		result, err = GarbageCollect(ctx, job.Repository, GarbageCollectionOptions{
+			GracePeriod: s.options.GracePeriod,
+			DryRun:      job.DryRun})
+		job.GarbageCollection = &result
+	default:
+		err = fmt.Errorf("Unknown kind of job %s", job.Kind)
+	}
+
+	if err != nil && ctx.Err() != nil {
+		llog(Log()).Info("Job stopped, it will run again at the next start")
+		job.Status = JobQueued
+		job.Report = nil
+		job.GarbageCollection = nil
+		return job
+	}
+	job.Finished = time.Now()
+	if err != nil {
+		llog(LogE(err)).Error("Job failed")
+		job.Status = JobFailed
+		job.Error = err.Error()
+	} else {
+		llog(Log()).Info("Job done")
+		job.Status = JobDone
+	}
+	return job
+}
+
+// a logrus hook that copies the messages of the running job, the ones with
+// its id in the job field, in its log
+type jobLogHook struct {
+	lock      sync.Mutex
+	job       int
+	out       io.Writer
+	formatter *log.TextFormatter
+}
+
+func (h *jobLogHook) set(job int, out io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.job = job
+	h.out = out
+}
+
+func (h *jobLogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *jobLogHook) Fire(entry *log.Entry) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.out == nil || entry.Data["job"] != h.job {
+		return nil
+	}
+	line, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	_, err = h.out.Write(line)
+	return err
+}
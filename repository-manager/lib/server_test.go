@@ -0,0 +1,171 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func apiCall(t *testing.T, method, url, body string, expected int, response interface{}) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	content, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != expected {
+		t.Fatalf("%s %s: expected status %d, got %d: %s", method, url, expected, resp.StatusCode, content)
+	}
+	if response != nil {
+		if err := json.Unmarshal(content, response); err != nil {
+			t.Fatalf("%s %s: wrong response %s", method, url, content)
+		}
+	}
+}
+
+func waitJob(t *testing.T, api string, id int) (job Job) {
+	for start := time.Now(); time.Since(start) < 30*time.Second; time.Sleep(20 * time.Millisecond) {
+		apiCall(t, "GET", api+"/jobs/"+strconv.Itoa(id), "", http.StatusOK, &job)
+		if job.completed() {
+			return
+		}
+	}
+	t.Fatalf("The job %d did not complete: %+v", id, job)
+	return
+}
+
+func TestServer(t *testing.T) {
+	cvmfs := newFakeCvmfs(t, testRepo)
+	defer cvmfs.Close()
+	registry := newFakeRegistry()
+	defer registry.Close()
+	pushed, restore := fakePush(t, registry)
+	defer restore()
+	registry.AddImage(t, "library/test", "latest", map[string]string{"etc/os-release": "fake"})
+
+	state, err := ioutil.TempDir("", "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(state)
+	queue, err := OpenJobQueue(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := httptest.NewServer(NewServer(queue, ServerOptions{}).Handler())
+
+	// the wish is submitted before the worker runs, and the queue persisted
+	wish := `{"image": "http://` + registry.Host() + `/library/test:latest",
+		"output_format": "http://` + registry.Host() + `/thin/$(image)",
+		"cvmfs_repo": "` + testRepo + `"}`
+	var submitted struct {
+		Wishes []wishView
+		Jobs   []Job
+	}
+	apiCall(t, "POST", api.URL+"/wishes", wish, http.StatusAccepted, &submitted)
+	if len(submitted.Wishes) != 1 || len(submitted.Jobs) != 1 || submitted.Jobs[0].Status != JobQueued {
+		t.Fatalf("Wrong response to the submission: %+v", submitted)
+	}
+	apiCall(t, "POST", api.URL+"/wishes", wish, http.StatusAccepted, &submitted)
+	if submitted.Wishes[0].Id != 1 || submitted.Jobs[0].Id != 1 {
+		t.Errorf("The same wish was submitted twice: %+v", submitted)
+	}
+	apiCall(t, "POST", api.URL+"/wishes", `{"image": "library/test"}`, http.StatusBadRequest, nil)
+	for _, key := range []string{"input_credentials", "output_credentials"} {
+		withCredentials := strings.Replace(wish, "{", `{"`+key+`": "HOME", `, 1)
+		apiCall(t, "POST", api.URL+"/wishes", withCredentials, http.StatusBadRequest, nil)
+	}
+	api.Close()
+
+	queue, err = OpenJobQueue(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queue.Wishes()) != 1 || len(queue.Jobs()) != 1 {
+		t.Fatalf("The queue was not persisted")
+	}
+	server := NewServer(queue, ServerOptions{})
+	api = httptest.NewServer(server.Handler())
+	defer api.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Run(ctx)
+
+	job := waitJob(t, api.URL, 1)
+	if job.Status != JobDone || job.Report == nil || job.Report.Outcome != OutcomeConverted {
+		t.Fatalf("Wrong conversion job: %+v", job)
+	}
+	if len(*pushed) != 1 || (*pushed)[0].name != registry.Host()+"/thin/library/test:latest" {
+		t.Errorf("Wrong thin images pushed: %+v", *pushed)
+	}
+	var wishes []wishView
+	apiCall(t, "GET", api.URL+"/wishes", "", http.StatusOK, &wishes)
+	if len(wishes) != 1 || wishes[0].LastJob == nil || wishes[0].LastJob.Id != 1 {
+		t.Errorf("Wrong list of the wishes: %+v", wishes)
+	}
+	resp, err := http.Get(api.URL + "/jobs/1/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logContent, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(logContent), "Conversion completed") {
+		t.Errorf("Wrong log of the job: %s", logContent)
+	}
+
+	// converting again does not skip the image already converted
+	apiCall(t, "POST", api.URL+"/wishes/1/convert", "", http.StatusAccepted, &job)
+	job = waitJob(t, api.URL, job.Id)
+	if job.Status != JobDone || !job.ConvertAgain || job.Report.Outcome != OutcomeConverted {
+		t.Errorf("Wrong conversion job: %+v", job)
+	}
+	apiCall(t, "POST", api.URL+"/wishes/42/convert", "", http.StatusNotFound, nil)
+
+	apiCall(t, "POST", api.URL+"/garbage-collection", `{"cvmfs_repo": "`+testRepo+`"}`, http.StatusAccepted, &job)
+	if job = waitJob(t, api.URL, job.Id); job.Status != JobDone {
+		t.Errorf("Wrong garbage collection job: %+v", job)
+	}
+}
+
+func TestJobLogHook(t *testing.T) {
+	var jobLog bytes.Buffer
+	hook := &jobLogHook{formatter: &log.TextFormatter{DisableColors: true}}
+	hook.set(3, &jobLog)
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	logger.AddHook(hook)
+
+	ctx := WithLogEntry(context.Background(), logger.WithFields(log.Fields{"job": 3}))
+	LogC(ctx).Info("message of the job")
+	LogCE(ctx, fmt.Errorf("failed")).Error("error of the job")
+	// the HTTP API and the other jobs log meanwhile
+	logger.Info("message of the API")
+	logger.WithFields(log.Fields{"job": 4}).Info("message of another job")
+
+	content := jobLog.String()
+	for message, expected := range map[string]bool{
+		"message of the job":     true,
+		"error of the job":       true,
+		"message of the API":     false,
+		"message of another job": false,
+	} {
+		if strings.Contains(content, message) != expected {
+			t.Errorf("Wrong log of the job, expected %q: %v\n%s", message, expected, content)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/image"
+	log "github.com/sirupsen/logrus"
+
+	da "github.com/cvmfs/docker-graphdriver/repository-manager/docker-api"
+)
+
+// The singularity image is the flat root filesystem of the image: the layers
+// applied in order, with their whiteouts, plus in /.singularity.d the
+// environment, the runscript and the actions that singularity runs, generated
+// from the configuration of the image. It is built from the layers the
+// conversion already has, without downloading anything else and without the
+// singularity binary.
+
+type Singularity struct {
+	Image         *Image
+	Manifest      da.Manifest
+	TempDirectory string
+}
+
+// the directories and the files singularity binds into the container
+var singularityMountPoints = []string{"dev", "proc", "sys", "tmp", "home", "mnt", "etc"}
+var singularityBindFiles = []string{"etc/hosts", "etc/resolv.conf"}
+
+const singularitySourceEnvironment = `for script in /.singularity.d/env/*.sh; do
+    if [ -f "$script" ]; then
+        . "$script"
+    fi
+done
+`
+
+var singularityActions = map[string]string{
+	"exec": "#!/bin/sh\n\n" + singularitySourceEnvironment + `
+exec "$@"
+`,
+	"run": "#!/bin/sh\n\n" + singularitySourceEnvironment + `
+if test -x /.singularity.d/runscript; then
+    exec /.singularity.d/runscript "$@"
+fi
+echo "No runscript found, executing /bin/sh"
+exec /bin/sh "$@"
+`,
+	"shell": "#!/bin/sh\n\n" + singularitySourceEnvironment + `
+if test -n "$SINGULARITY_SHELL" -a -x "$SINGULARITY_SHELL"; then
+    exec $SINGULARITY_SHELL "$@"
+elif test -x /bin/bash; then
+    exec /bin/bash --norc "$@"
+elif test -x /bin/sh; then
+    exec /bin/sh "$@"
+fi
+echo "ERROR: /bin/sh does not exist in the container" 1>&2
+exit 1
+`,
+	"test": "#!/bin/sh\n\n" + singularitySourceEnvironment + `
+if test -x /.singularity.d/test; then
+    exec /.singularity.d/test "$@"
+fi
+echo "No test found in the container, exiting"
+exit 0
+`,
+}
+
+var singularityEnvironment = map[string]string{
+	"01-base.sh":        "#!/bin/sh\n",
+	"90-environment.sh": "#!/bin/sh\n# custom environment shell code should follow\n",
+	"99-base.sh": `#!/bin/sh
+if [ -z "$LD_LIBRARY_PATH" ]; then
+    LD_LIBRARY_PATH="/.singularity.d/libs"
+else
+    LD_LIBRARY_PATH="$LD_LIBRARY_PATH:/.singularity.d/libs"
+fi
+PS1="Singularity> "
+export LD_LIBRARY_PATH PS1
+`,
+}
+
+// quote the string for the shell, nothing inside is expanded
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func shellQuoteAll(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// the environment of the image, exported by the shell
+func singularityDockerEnvironment(env []string) string {
+	script := "#!/bin/sh\n"
+	for _, variable := range env {
+		nameValue := strings.SplitN(variable, "=", 2)
+		if len(nameValue) != 2 || nameValue[0] == "" {
+			continue
+		}
+		script += fmt.Sprintf("export %s=%s\n", nameValue[0], shellQuote(nameValue[1]))
+	}
+	return script
+}
+
+// as docker: the entrypoint, followed by the arguments or, without arguments,
+// by the command
+func singularityRunscript(entrypoint, cmd []string) string {
+	if len(entrypoint) == 0 && len(cmd) == 0 {
+		cmd = []string{"/bin/sh"}
+	}
+	withArgs := "exec"
+	if len(entrypoint) > 0 {
+		withArgs += " " + shellQuoteAll(entrypoint)
+	}
+	return fmt.Sprintf(`#!/bin/sh
+if [ $# -gt 0 ]; then
+    %s "$@"
+fi
+exec %s
+`, withArgs, shellQuoteAll(append(append([]string{}, entrypoint...), cmd...)))
+}
+
+// write the /.singularity.d metadata and the mount points into the root
+// filesystem
+func writeSingularityMetadata(rootfs string, config image.Image) error {
+	var entrypoint, cmd, env []string
+	labels := map[string]string{}
+	if config.Config != nil {
+		entrypoint = config.Config.Entrypoint
+		cmd = config.Config.Cmd
+		env = config.Config.Env
+		if config.Config.Labels != nil {
+			labels = config.Config.Labels
+		}
+	}
+	metadata := filepath.Join(rootfs, ".singularity.d")
+	for _, dir := range []string{"actions", "env", "libs"} {
+		if err := os.MkdirAll(filepath.Join(metadata, dir), 0755); err != nil {
+			return err
+		}
+	}
+	files := map[string]string{
+		"runscript":                    singularityRunscript(entrypoint, cmd),
+		"env/10-docker2singularity.sh": singularityDockerEnvironment(env),
+	}
+	for name, content := range singularityEnvironment {
+		files[filepath.Join("env", name)] = content
+	}
+	for name, content := range singularityActions {
+		files[filepath.Join("actions", name)] = content
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(metadata, name), []byte(content), 0755); err != nil {
+			return err
+		}
+	}
+	labelsJson, err := json.MarshalIndent(labels, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(filepath.Join(metadata, "labels.json"), labelsJson, 0644); err != nil {
+		return err
+	}
+
+	for _, dir := range singularityMountPoints {
+		if _, err := os.Lstat(filepath.Join(rootfs, dir)); os.IsNotExist(err) {
+			if err = os.Mkdir(filepath.Join(rootfs, dir), 0755); err != nil {
+				return err
+			}
+		}
+	}
+	for _, file := range singularityBindFiles {
+		// etc may be a symlink to anywhere
+		path, err := securePath(rootfs, file)
+		if err != nil {
+			continue
+		}
+		if _, err = os.Lstat(path); os.IsNotExist(err) {
+			if err = ioutil.WriteFile(path, []byte{}, 0644); err != nil {
+				return err
+			}
+		}
+	}
+	for link, target := range map[string]string{
+		"singularity": ".singularity.d/runscript",
+		"environment": ".singularity.d/env/90-environment.sh"} {
+		if _, err := os.Lstat(filepath.Join(rootfs, link)); os.IsNotExist(err) {
+			if err = os.Symlink(target, filepath.Join(rootfs, link)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// build the singularity image in a temporary directory inside rootPath, the
+// layers in tarballs (digest -> uncompressed tarball) are applied from there,
+// the others from the repository where they are already extracted
+func (img Image) BuildSingularityDirectory(ctx context.Context, CVMFSRepo string, manifest da.Manifest, config image.Image, tarballs map[string]string, rootPath string) (sing Singularity, err error) {
+	llog := func(l *log.Entry) *log.Entry {
+		return l.WithFields(log.Fields{"action": "build singularity image",
+			"image": img.GetSimpleName()})
+	}
+	dir, err := ioutil.TempDir(rootPath, "singularity_buffer")
+	if err != nil {
+		llog(LogCE(ctx, err)).Error("Error in creating temporary directory for singularity")
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+	// the root of the image, not of a temporary directory
+	if err = os.Chmod(dir, 0755); err != nil {
+		return
+	}
+
+	for _, layer := range manifest.Layers {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		var stream io.ReadCloser
+		if tarball, ok := tarballs[layer.Digest]; ok {
+			stream, err = os.Open(tarball)
+		} else {
+			rootfs := LayerRootfsPath(CVMFSRepo, withoutAlgorithm(layer.Digest))
+			if _, err = os.Stat(rootfs); err == nil {
+				stream = tarDirectory(rootfs)
+			}
+		}
+		if err != nil {
+			llog(LogCE(ctx, err)).WithFields(log.Fields{"layer": layer.Digest}).Error("Layer not available")
+			return
+		}
+		err = applyLayer(stream, dir)
+		stream.Close()
+		if err != nil {
+			llog(LogCE(ctx, err)).WithFields(log.Fields{"layer": layer.Digest}).Error("Error in applying the layer")
+			return
+		}
+	}
+	if err = writeSingularityMetadata(dir, config); err != nil {
+		llog(LogCE(ctx, err)).Error("Error in writing the singularity metadata")
+		return
+	}
+
+	llog(LogC(ctx)).Info("Singularity image built")
+	return Singularity{Image: &img, Manifest: manifest, TempDirectory: dir}, nil
+}
+
+// add to the transaction the singularity image and its catalogs, the
+// temporary directory must stay around until the transaction is committed
+func (s Singularity) AddToTransaction(t *Transaction) error {
+	singularityPath := GetSingularityPathFromManifest(s.Manifest)
+
+	err := AddToTransaction(t, singularityPath, s.TempDirectory)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range []string{
+		filepath.Dir(singularityPath),
+		singularityPath} {
+		t.CreateCatalog(dir)
+	}
+	return nil
+}
+
+// add to the transaction the human friendly symlink to the singularity
+// image, it goes with the rest of the image recorded as converted, once the
+// thin image is pushed
+func (s Singularity) AddSymlinkToTransaction(t *Transaction) {
+	t.Symlink(s.Image.singularitySymlinkPath(), GetSingularityPathFromManifest(s.Manifest))
+}
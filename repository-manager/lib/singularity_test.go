@@ -0,0 +1,205 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a tar stream with the entries in order, the names ending with / are
+// directories
+func orderedTar(t *testing.T, names ...string) *bytes.Buffer {
+	var buffer bytes.Buffer
+	writer := tar.NewWriter(&buffer)
+	for _, name := range names {
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(name)), Typeflag: tar.TypeReg}
+		if strings.HasSuffix(name, "/") {
+			header = &tar.Header{Name: name, Mode: 0755, Typeflag: tar.TypeDir}
+		}
+		if err := writer.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			writer.Write([]byte(name))
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buffer
+}
+
+func TestApplyLayer(t *testing.T) {
+	dest, err := ioutil.TempDir("", "rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	layers := [][]string{
+		{"opaque/", "opaque/lower", "opaque/dir/", "opaque/dir/lower", "removed", "dir/", "dir/removed", "dir/kept"},
+		// the opaque whiteout hides only the lower layers, wherever it is
+		{"opaque/upper", "opaque/.wh..wh..opq", ".wh.removed", "dir/.wh.removed", ".wh.never-there"},
+	}
+	for _, layer := range layers {
+		if err := applyLayer(orderedTar(t, layer...), dest); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for path, exists := range map[string]bool{
+		"opaque/upper":        true,
+		"opaque/lower":        false,
+		"opaque/dir":          false,
+		"opaque/.wh..wh..opq": false,
+		"removed":             false,
+		".wh.removed":         false,
+		"dir/removed":         false,
+		"dir/kept":            true,
+	} {
+		if _, err := os.Lstat(filepath.Join(dest, path)); exists != (err == nil) {
+			t.Errorf("Wrong %s after applying the layers, expected to exist: %v", path, exists)
+		}
+	}
+
+	// the layers already extracted in the repository keep the whiteouts,
+	// they are applied the same way
+	extracted, err := ioutil.TempDir("", "layer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(extracted)
+	tarball := writeTemp(t, orderedTar(t, "dir/", "dir/.wh.kept", "new"))
+	defer os.Remove(tarball)
+	if err := extractTar(tarball, extracted); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(extracted, "dir", ".wh.kept")); err != nil {
+		t.Fatalf("The whiteout was not stored in the layer")
+	}
+	ioutil.WriteFile(filepath.Join(extracted, ".cvmfscatalog"), []byte{}, 0644)
+	stream := tarDirectory(extracted)
+	defer stream.Close()
+	if err := applyLayer(stream, dest); err != nil {
+		t.Fatal(err)
+	}
+	for path, exists := range map[string]bool{"dir/kept": false, "new": true, ".cvmfscatalog": false} {
+		if _, err := os.Lstat(filepath.Join(dest, path)); exists != (err == nil) {
+			t.Errorf("Wrong %s after applying the extracted layer, expected to exist: %v", path, exists)
+		}
+	}
+}
+
+func writeTemp(t *testing.T, content *bytes.Buffer) string {
+	file, err := ioutil.TempFile("", "layer.*.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.Write(content.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+func TestConvertWishSingularity(t *testing.T) {
+	cvmfs := newFakeCvmfs(t, testRepo)
+	defer cvmfs.Close()
+	registry := newFakeRegistry()
+	defer registry.Close()
+	_, restore := fakePush(t, registry)
+	defer restore()
+
+	shared := map[string]string{"etc/os-release": "shared", "etc/removed": "removed"}
+	registry.AddImage(t, "library/first", "latest", shared)
+	second := registry.AddImage(t, "library/second", "latest", shared,
+		map[string]string{"second": "second", "etc/.wh.removed": ""})
+	for _, name := range []string{"library/first", "library/second"} {
+		report, err := ConvertWish(context.Background(), testWish(registry, name, "latest"), false, false, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Singularity != StepDone {
+			t.Errorf("Wrong report of the singularity image: %+v", report)
+		}
+	}
+
+	// the shared layer was already in the repository for the second image
+	flat := cvmfs.Path(testRepo, GetSingularityPathFromManifest(second))
+	for path, exists := range map[string]bool{
+		"etc/os-release":      true,
+		"second":              true,
+		"etc/removed":         false,
+		"etc/.wh.removed":     false,
+		".cvmfscatalog":       true,
+		"etc/hosts":           true,
+		"proc":                true,
+		"singularity":         true,
+		".singularity.d/libs": true,
+	} {
+		if _, err := os.Lstat(filepath.Join(flat, path)); exists != (err == nil) {
+			t.Errorf("Wrong %s in the singularity image, expected to exist: %v", path, exists)
+		}
+	}
+	runscript, _ := ioutil.ReadFile(filepath.Join(flat, ".singularity.d", "runscript"))
+	if !strings.Contains(string(runscript), "exec 'sh'\n") {
+		t.Errorf("Wrong runscript: %s", runscript)
+	}
+	env, _ := ioutil.ReadFile(filepath.Join(flat, ".singularity.d", "env", "10-docker2singularity.sh"))
+	if !strings.Contains(string(env), "export IMAGE='library/second:latest'\n") {
+		t.Errorf("Wrong environment: %s", env)
+	}
+	image, _ := ParseImage(testWish(registry, "library/second", "latest").InputName)
+	target, err := os.Readlink(cvmfs.Path(testRepo, image.singularitySymlinkPath()))
+	if err != nil || target != ClientPath(testRepo, GetSingularityPathFromManifest(second)) {
+		t.Errorf("Wrong symlink to the singularity image: %s, %v", target, err)
+	}
+}
+
+func TestConvertWishSingularityFailedPush(t *testing.T) {
+	cvmfs := newFakeCvmfs(t, testRepo)
+	defer cvmfs.Close()
+	registry := newFakeRegistry()
+	defer registry.Close()
+	_, restore := fakePush(t, registry)
+	defer restore()
+	pushThinImage = func(Image, Credentials, []byte, []byte) (string, error) {
+		return "", fmt.Errorf("registry not available")
+	}
+
+	manifest := registry.AddImage(t, "library/test", "latest", map[string]string{"etc/os-release": "fake"})
+	wish := testWish(registry, "library/test", "latest")
+	if _, err := ConvertWish(context.Background(), wish, false, false, true); err == nil {
+		t.Errorf("The conversion should fail when the push fails")
+	}
+	// the singularity image is published with the layers, the symlink only
+	// with the image converted
+	if _, err := os.Stat(cvmfs.Path(testRepo, GetSingularityPathFromManifest(manifest), "etc", "os-release")); err != nil {
+		t.Errorf("The singularity image was not published before the push: %s", err)
+	}
+	image, _ := ParseImage(wish.InputName)
+	if _, err := os.Lstat(cvmfs.Path(testRepo, image.singularitySymlinkPath())); err == nil {
+		t.Errorf("The symlink to the singularity image of an image not pushed was published")
+	}
+}
+
+func TestSingularityRunscript(t *testing.T) {
+	for _, c := range []struct {
+		entrypoint, cmd   []string
+		withArgs, without string
+	}{
+		{nil, []string{"sh"}, `exec "$@"`, "exec 'sh'"},
+		{[]string{"/entry", "it's"}, []string{"cmd"}, `exec '/entry' 'it'\''s' "$@"`, `exec '/entry' 'it'\''s' 'cmd'`},
+		{nil, nil, `exec "$@"`, "exec '/bin/sh'"},
+	} {
+		runscript := singularityRunscript(c.entrypoint, c.cmd)
+		if !strings.Contains(runscript, c.withArgs+"\n") || !strings.Contains(runscript, c.without+"\n") {
+			t.Errorf("Wrong runscript for %v %v: %s", c.entrypoint, c.cmd, runscript)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// An input of the recipe can select several tags of the same repository,
+// either with a wildcard in the tag (ex: python:3.*), with the syntax of
+// path.Match but without `?` that would start the query of the url, or, when
+// there is no tag at all, with the tag filter of the input. The tags are
+// listed from the registry every time the recipe is parsed, so new releases
+// are picked up automatically.
+
+func hasTagWildcard(tag string) bool {
+	return strings.ContainsAny(tag, "*[")
+}
+
+// return the names of the images the input refers to, an input without
+// wildcards is returned as it is
+func expandInput(input string, user, credentials string, filter TagFilter) ([]string, error) {
+	img, err := ParseImage(input)
+	if err != nil {
+		return nil, err
+	}
+	if img.Digest != "" || !(hasTagWildcard(img.Tag) || (img.Tag == "" && filter.active())) {
+		return []string{input}, nil
+	}
+	if img.Tag != "" {
+		if _, err := path.Match(img.Tag, ""); err != nil {
+			return nil, fmt.Errorf("Wrong wildcard in the tag %s: %s", img.Tag, err)
+		}
+	}
+	img.User = user
+	img.Credentials = credentials
+	tags, err := img.ListTags()
+	if err != nil {
+		return nil, err
+	}
+	var selected []string
+	for _, tag := range tags {
+		if img.Tag != "" {
+			if match, _ := path.Match(img.Tag, tag); !match {
+				continue
+			}
+		}
+		if !filter.Match(tag) {
+			continue
+		}
+		selected = append(selected, tag)
+	}
+	if filter.Latest > 0 {
+		selected = latestSemver(selected, filter.Latest)
+	}
+	sort.Strings(selected)
+
+	Log().WithFields(log.Fields{"input": input, "tags": selected}).Info("Expanded the tags of the input")
+	images := make([]string, 0, len(selected))
+	for _, tag := range selected {
+		img.Tag = tag
+		images = append(images, img.WholeName())
+	}
+	return images, nil
+}
+
+// list all the tags of the repository of the image, following the pagination
+// of the registry
+func (img Image) ListTags() ([]string, error) {
+	credentials := img.GetCredentials()
+	llog := func(l *log.Entry) *log.Entry {
+		return l.WithFields(log.Fields{"action": "list tags",
+			"registry":   img.Registry,
+			"repository": img.Repository})
+	}
+
+	tagsUrl := fmt.Sprintf("%s://%s/v2/%s/tags/list?n=1000", img.Scheme, img.Registry, img.Repository)
+	auth := newRegistryAuth(credentials)
+	var tags []string
+	for tagsUrl != "" {
+		req, err := http.NewRequest("GET", tagsUrl, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := auth.Do(req)
+		if err != nil {
+			llog(LogE(err)).Error("Error in listing the tags")
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("Error in listing the tags, status code: %d", resp.StatusCode)
+			llog(LogE(err)).WithFields(log.Fields{"url": tagsUrl}).Error("Error in listing the tags")
+			return nil, err
+		}
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		if err = json.Unmarshal(body, &page); err != nil {
+			return nil, err
+		}
+		tags = append(tags, page.Tags...)
+
+		tagsUrl, err = nextPage(tagsUrl, resp.Header.Get("Link"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tags, nil
+}
+
+var linkNextRegexp = regexp.MustCompile(`<([^>]*)>\s*;\s*rel="?next"?`)
+
+// the registry signals more results with the header
+// Link: </v2/foo/tags/list?last=bar&n=100>; rel="next"
+// the link may be relative to the current url
+func nextPage(current, link string) (string, error) {
+	match := linkNextRegexp.FindStringSubmatch(link)
+	if match == nil {
+		return "", nil
+	}
+	base, err := url.Parse(current)
+	if err != nil {
+		return "", err
+	}
+	next, err := base.Parse(match[1])
+	if err != nil {
+		return "", err
+	}
+	return next.String(), nil
+}
+
+type semver struct {
+	numbers    [3]int
+	prerelease string
+}
+
+var semverRegexp = regexp.MustCompile(`^v?(\d+)(?:\.(\d+))?(?:\.(\d+))?(?:-([0-9A-Za-z.-]+))?$`)
+
+// we accept also the partial versions common in the tags, like 3 or 3.7
+func parseSemver(tag string) (semver, bool) {
+	match := semverRegexp.FindStringSubmatch(tag)
+	if match == nil {
+		return semver{}, false
+	}
+	var v semver
+	for i := 0; i < 3; i++ {
+		if match[i+1] != "" {
+			v.numbers[i], _ = strconv.Atoi(match[i+1])
+		}
+	}
+	v.prerelease = match[4]
+	return v, true
+}
+
+func (v semver) less(other semver) bool {
+	for i := 0; i < 3; i++ {
+		if v.numbers[i] != other.numbers[i] {
+			return v.numbers[i] < other.numbers[i]
+		}
+	}
+	// a pre release comes before the release
+	if v.prerelease == "" || other.prerelease == "" {
+		return v.prerelease != "" && other.prerelease == ""
+	}
+	return v.prerelease < other.prerelease
+}
+
+// the n highest versions among the tags, the tags that are not versions are
+// discarded
+func latestSemver(tags []string, n int) []string {
+	type version struct {
+		tag     string
+		version semver
+	}
+	var versions []version
+	for _, tag := range tags {
+		if v, ok := parseSemver(tag); ok {
+			versions = append(versions, version{tag, v})
+		}
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[j].version.less(versions[i].version)
+	})
+	if len(versions) > n {
+		versions = versions[:n]
+	}
+	latest := make([]string, len(versions))
+	for i, v := range versions {
+		latest[i] = v.tag
+	}
+	return latest
+}
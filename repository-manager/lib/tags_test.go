@@ -0,0 +1,99 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandInput(t *testing.T) {
+	registry := newFakeRegistry()
+	defer registry.Close()
+	_, restore := fakePush(t, registry)
+	defer restore()
+
+	for _, tag := range []string{"2.7", "3.5", "3.6", "3.7", "3.7-alpine", "3.8-rc1", "latest"} {
+		registry.AddManifest("library/python", tag, "application/vnd.docker.distribution.manifest.v2+json", []byte(`{}`))
+	}
+	base := "http://" + registry.Host() + "/library/python"
+
+	tests := []struct {
+		input    string
+		filter   TagFilter
+		expected []string
+	}{
+		{base + ":3.7", TagFilter{}, []string{"3.7"}},
+		{base + ":3.*", TagFilter{}, []string{"3.5", "3.6", "3.7", "3.7-alpine", "3.8-rc1"}},
+		{base + ":[23].[57]", TagFilter{}, []string{"2.7", "3.5", "3.7"}},
+		{base + ":3.*", TagFilter{Exclude: []string{".*-.*"}}, []string{"3.5", "3.6", "3.7"}},
+		{base, TagFilter{Include: []string{`\d+\.\d+`}}, []string{"2.7", "3.5", "3.6", "3.7"}},
+		{base, TagFilter{Latest: 2}, []string{"3.7", "3.8-rc1"}},
+		{base, TagFilter{Latest: 2, Exclude: []string{".*-.*"}}, []string{"3.6", "3.7"}},
+	}
+	for _, test := range tests {
+		if err := test.filter.compile(); err != nil {
+			t.Fatal(err)
+		}
+		images, err := expandInput(test.input, "", "", test.filter)
+		if err != nil {
+			t.Fatalf("Error in expanding %s: %s", test.input, err)
+		}
+		expected := make([]string, len(test.expected))
+		for i, tag := range test.expected {
+			expected[i] = base + ":" + tag
+		}
+		if !reflect.DeepEqual(images, expected) {
+			t.Errorf("Wrong expansion of %s %+v:\n%v\nexpected\n%v", test.input, test.filter, images, expected)
+		}
+	}
+}
+
+func TestParseRecipeWithWildcard(t *testing.T) {
+	registry := newFakeRegistry()
+	defer registry.Close()
+	_, restore := fakePush(t, registry)
+	defer restore()
+
+	for _, tag := range []string{"1.0", "1.1", "2.0"} {
+		registry.AddManifest("library/app", tag, "application/vnd.docker.distribution.manifest.v2+json", []byte(`{}`))
+	}
+	recipe, err := ParseYamlRecipe([]byte(`
+version: 1
+cvmfs_repo: unpacked.cern.ch
+output_format: 'https://registry.cern.ch/thin/$(image)'
+input:
+        - 'http://` + registry.Host() + `/library/app:1.*'
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var outputs []string
+	for _, wish := range recipe.Wishes {
+		outputs = append(outputs, wish.OutputName)
+	}
+	expected := []string{
+		"https://registry.cern.ch/thin/library/app:1.0",
+		"https://registry.cern.ch/thin/library/app:1.1"}
+	if !reflect.DeepEqual(outputs, expected) {
+		t.Errorf("Wrong wishes: %v", outputs)
+	}
+}
+
+func TestLatestSemver(t *testing.T) {
+	tags := []string{"1.2.3", "v1.10.0", "1.9", "latest", "2.0.0-rc1", "2.0.0", "1.10.0-beta"}
+	latest := latestSemver(tags, 4)
+	expected := []string{"2.0.0", "2.0.0-rc1", "v1.10.0", "1.10.0-beta"}
+	if !reflect.DeepEqual(latest, expected) {
+		t.Errorf("Wrong latest versions: %v", latest)
+	}
+}
+
+func TestNextPage(t *testing.T) {
+	next, err := nextPage("https://registry.example.ch/v2/foo/tags/list?n=2",
+		`</v2/foo/tags/list?last=b&n=2>; rel="next"`)
+	if err != nil || next != "https://registry.example.ch/v2/foo/tags/list?last=b&n=2" {
+		t.Errorf("Wrong next page: %s %v", next, err)
+	}
+	if next, _ := nextPage("https://registry.example.ch/v2/foo/tags/list", ""); next != "" {
+		t.Errorf("There should be no next page: %s", next)
+	}
+}
@@ -0,0 +1,428 @@
+package lib
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// the whiteout files of the layers, see the OCI image specification
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// extract the tar archive into dest, the content is stored as it is in the
+// archive, whiteout files included, since it is the graphdriver that applies
+// them when mounting the layers
+func extractTar(tarball, dest string) error {
+	file, err := os.Open(tarball)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return extractTarStream(file, dest, false)
+}
+
+// apply the layer, as a tar stream, on top of what is already in dest: the
+// whiteout files remove what the lower layers put in dest and are not
+// extracted
+func applyLayer(layer io.Reader, dest string) error {
+	return extractTarStream(layer, dest, true)
+}
+
+func extractTarStream(stream io.Reader, dest string, whiteouts bool) error {
+	type dirAttributes struct {
+		path    string
+		mode    os.FileMode
+		modTime time.Time
+	}
+	var dirs []dirAttributes
+	// what this layer wrote, an opaque directory hides only the lower layers
+	added := make(map[string]bool)
+
+	reader := tar.NewReader(stream)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		path, err := securePath(dest, header.Name)
+		if err != nil {
+			return err
+		}
+		if path == dest {
+			continue
+		}
+		if name := filepath.Base(path); whiteouts && strings.HasPrefix(name, whiteoutPrefix) {
+			if err = applyWhiteout(path, added); err != nil {
+				return fmt.Errorf("Error in applying the whiteout %s: %s", header.Name, err)
+			}
+			continue
+		}
+		for dir := path; dir != dest; dir = filepath.Dir(dir) {
+			added[dir] = true
+		}
+		err = os.MkdirAll(filepath.Dir(path), dirPermision)
+		if err != nil {
+			return err
+		}
+		err = extractEntry(reader, header, dest, path)
+		if err != nil {
+			return fmt.Errorf("Error in extracting %s: %s", header.Name, err)
+		}
+		if header.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirAttributes{path, tarFileMode(header.Mode), header.ModTime})
+		}
+	}
+	// the directories may be read only and writing inside them changes
+	// their modification time, we set their attributes at the very end
+	for i := len(dirs) - 1; i >= 0; i-- {
+		dir := dirs[i]
+		if err := os.Chmod(dir.path, dir.mode); err != nil {
+			// removed by a later whiteout
+			if whiteouts && os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		os.Chtimes(dir.path, dir.modTime, dir.modTime)
+	}
+	return nil
+}
+
+// remove what the whiteout hides: the file it names or, for the opaque
+// whiteout, all the content of its directory not added by the same layer
+func applyWhiteout(whiteout string, added map[string]bool) error {
+	dir := filepath.Dir(whiteout)
+	name := filepath.Base(whiteout)
+	if name != whiteoutOpaque {
+		return os.RemoveAll(filepath.Join(dir, strings.TrimPrefix(name, whiteoutPrefix)))
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if path := filepath.Join(dir, entry.Name()); !added[path] {
+			if err = os.RemoveAll(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// a tar stream of the content of the directory, used to apply a layer already
+// extracted in the repository as the ones just downloaded. The catalog at the
+// root is not part of the layer
+func tarDirectory(root string) io.ReadCloser {
+	reader, writer := io.Pipe()
+	go func() {
+		tarWriter := tar.NewWriter(writer)
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			relative, err := filepath.Rel(root, path)
+			if err != nil || relative == "." || relative == ".cvmfscatalog" {
+				return err
+			}
+			link := ""
+			if info.Mode()&os.ModeSymlink != 0 {
+				if link, err = os.Readlink(path); err != nil {
+					return err
+				}
+			}
+			header, err := tar.FileInfoHeader(info, link)
+			if err != nil {
+				return err
+			}
+			header.Name = relative
+			if err = tarWriter.WriteHeader(header); err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			_, err = io.Copy(tarWriter, file)
+			return err
+		})
+		if err == nil {
+			err = tarWriter.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+	return reader
+}
+
+func extractEntry(reader io.Reader, header *tar.Header, dest, path string) error {
+	mode := tarFileMode(header.Mode)
+
+	// whatever is already there is replaced, except directories which
+	// are merged
+	if stat, err := os.Lstat(path); err == nil {
+		if !(stat.IsDir() && header.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(path, dirPermision); err != nil {
+			return err
+		}
+		lchown(path, header)
+		return nil
+	case tar.TypeReg, tar.TypeRegA:
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, reader)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(header.Linkname, path); err != nil {
+			return err
+		}
+		lchown(path, header)
+		return nil
+	case tar.TypeLink:
+		target, err := securePath(dest, header.Linkname)
+		if err != nil {
+			return err
+		}
+		return os.Link(target, path)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		devMode := uint32(mode)
+		switch header.Typeflag {
+		case tar.TypeChar:
+			devMode |= syscall.S_IFCHR
+		case tar.TypeBlock:
+			devMode |= syscall.S_IFBLK
+		case tar.TypeFifo:
+			devMode |= syscall.S_IFIFO
+		}
+		if err := syscall.Mknod(path, devMode, mkdev(header.Devmajor, header.Devminor)); err != nil {
+			return err
+		}
+	case tar.TypeXGlobalHeader:
+		return nil
+	default:
+		return fmt.Errorf("Unsupported type in tar archive: %c", header.Typeflag)
+	}
+
+	lchown(path, header)
+	// the umask may have changed the mode
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	return os.Chtimes(path, header.ModTime, header.ModTime)
+}
+
+// the ownership can be set only when running as root, which is the normal
+// case on a stratum 0, otherwise we keep the files owned by us
+func lchown(path string, header *tar.Header) {
+	if os.Geteuid() == 0 {
+		os.Lchown(path, header.Uid, header.Gid)
+	}
+}
+
+func tarFileMode(mode int64) os.FileMode {
+	fileMode := os.FileMode(mode).Perm()
+	if mode&04000 != 0 {
+		fileMode |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		fileMode |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		fileMode |= os.ModeSticky
+	}
+	return fileMode
+}
+
+// the encoding of the device number used by the linux kernel
+func mkdev(major, minor int64) int {
+	return int((minor & 0xff) | ((major & 0xfff) << 8) |
+		((minor &^ 0xff) << 12) | ((major &^ 0xfff) << 32))
+}
+
+// join the name of the entry to the root, making sure that the result is
+// inside the root, that means no `..` escaping and no symlinks in the
+// directories leading to the entry
+func securePath(root, name string) (string, error) {
+	cleaned := filepath.Clean("/" + name)
+	path := filepath.Join(root, cleaned)
+	current := root
+	components := strings.Split(strings.TrimPrefix(filepath.Dir(cleaned), "/"), "/")
+	for _, component := range components {
+		if component == "" {
+			continue
+		}
+		current = filepath.Join(current, component)
+		stat, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if stat.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("Entry %s goes through the symlink %s", name, current)
+		}
+	}
+	return path, nil
+}
+
+// an entry of a layer as it is once extracted, the list of the entries is
+// stored alongside the layer to verify later what is in the repository
+type LayerFile struct {
+	// file, dir, symlink or device
+	Type   string `json:"type"`
+	Size   int64  `json:"size,omitempty"`
+	Digest string `json:"digest,omitempty"`
+	Link   string `json:"link,omitempty"`
+}
+
+// the entries the extraction of the tar archive leaves, by path relative to
+// the root of the layer: a later entry replaces an earlier one and the hard
+// links are files with the content of their target
+func tarFileList(tarball string) (map[string]LayerFile, error) {
+	file, err := os.Open(tarball)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	files := make(map[string]LayerFile)
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		path := strings.TrimPrefix(filepath.Clean("/"+header.Name), "/")
+		if path == "" || header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		// the extraction creates the missing directories
+		for dir := filepath.Dir(path); dir != "."; dir = filepath.Dir(dir) {
+			if _, ok := files[dir]; !ok {
+				files[dir] = LayerFile{Type: "dir"}
+			}
+		}
+		if previous, ok := files[path]; ok && previous.Type == "dir" && header.Typeflag != tar.TypeDir {
+			for other := range files {
+				if strings.HasPrefix(other, path+"/") {
+					delete(files, other)
+				}
+			}
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			files[path] = LayerFile{Type: "dir"}
+		case tar.TypeReg, tar.TypeRegA:
+			hash := sha256.New()
+			size, err := io.Copy(hash, reader)
+			if err != nil {
+				return nil, err
+			}
+			files[path] = LayerFile{Type: "file", Size: size, Digest: fmt.Sprintf("sha256:%x", hash.Sum(nil))}
+		case tar.TypeLink:
+			files[path] = files[strings.TrimPrefix(filepath.Clean("/"+header.Linkname), "/")]
+		case tar.TypeSymlink:
+			files[path] = LayerFile{Type: "symlink", Link: header.Linkname}
+		default:
+			files[path] = LayerFile{Type: "device"}
+		}
+	}
+	return files, nil
+}
+
+// compare what is in root with the list of the entries, a description of
+// each difference is returned
+func verifyFileList(root string, files map[string]LayerFile) (differences []string, err error) {
+	seen := make(map[string]bool)
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relative, _ := filepath.Rel(root, path)
+		if relative == "." || relative == ".cvmfscatalog" {
+			return nil
+		}
+		seen[relative] = true
+		expected, ok := files[relative]
+		if !ok {
+			differences = append(differences, relative+": not in the layer")
+			return nil
+		}
+		var found LayerFile
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			found = LayerFile{Type: "dir"}
+		case mode.IsRegular():
+			found = LayerFile{Type: "file", Size: info.Size()}
+			if found.Size == expected.Size {
+				file, err := os.Open(path)
+				if err != nil {
+					return err
+				}
+				hash := sha256.New()
+				_, err = io.Copy(hash, file)
+				file.Close()
+				if err != nil {
+					return err
+				}
+				found.Digest = fmt.Sprintf("sha256:%x", hash.Sum(nil))
+			}
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			found = LayerFile{Type: "symlink", Link: link}
+		default:
+			found = LayerFile{Type: "device"}
+		}
+		if found != expected {
+			differences = append(differences, fmt.Sprintf("%s: expected %+v, found %+v", relative, expected, found))
+		}
+		return nil
+	})
+	for path := range files {
+		if !seen[path] {
+			differences = append(differences, path+": missing")
+		}
+	}
+	sort.Strings(differences)
+	return
+}
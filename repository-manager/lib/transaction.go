@@ -0,0 +1,338 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A Transaction collects all the modifications we want to apply to a
+// repository and applies them, through the Publisher of the repository, with
+// a single transaction / publish pair. Nothing touches the repository until
+// Commit is invoked, if any of the operations fails the whole transaction is
+// aborted.
+//
+// All the paths are relative to the root of the repository, ex: .layers/ab/abcd
+type Transaction struct {
+	CVMFSRepo string
+
+	lock       sync.Mutex
+	operations []operation
+}
+
+type operation struct {
+	description string
+	path        string
+	apply       func(p Publisher, path string) error
+}
+
+func NewTransaction(CVMFSRepo string) *Transaction {
+	return &Transaction{CVMFSRepo: CVMFSRepo}
+}
+
+func (t *Transaction) add(description, path string, apply func(p Publisher, path string) error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.operations = append(t.operations, operation{
+		description: description,
+		path:        path,
+		apply:       apply})
+}
+
+func (t *Transaction) Len() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.operations)
+}
+
+// write the content into the file, creating the directories if necessary
+func (t *Transaction) WriteFile(path string, content []byte) {
+	t.add("write file", path, func(p Publisher, path string) error {
+		return p.WriteFile(path, bytes.NewReader(content))
+	})
+}
+
+// read-modify-write of a file, the update function is invoked while the
+// transaction is open, hence it sees the content published by other wishes.
+// If the file does not exists the function is invoked with nil.
+func (t *Transaction) UpdateFile(path string, update func(current []byte) ([]byte, error)) {
+	t.add("update file", path, func(p Publisher, path string) error {
+		current, err := p.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		updated, err := update(current)
+		if err != nil {
+			return err
+		}
+		return p.WriteFile(path, bytes.NewReader(updated))
+	})
+}
+
+// copy a regular file from the normal filesystem into the repository
+func (t *Transaction) CopyFile(source, path string) {
+	t.add("copy file", path, func(p Publisher, path string) error {
+		from, err := os.Open(source)
+		if err != nil {
+			return err
+		}
+		defer from.Close()
+		return p.WriteFile(path, from)
+	})
+}
+
+// copy a whole directory from the normal filesystem into the repository,
+// whatever was in path is replaced
+func (t *Transaction) CopyDirectory(source, path string) {
+	t.add("copy directory", path, func(p Publisher, path string) error {
+		err := p.Remove(path)
+		if err != nil {
+			return err
+		}
+		return p.CopyDirectory(source, path)
+	})
+}
+
+// ingest the (uncompressed) tarball into path, with a catalog at its root, in
+// its own publish through the publish queue of the repository, it is not part
+// of any Transaction. If the path already exists and we are not overwriting
+// we leave it untouched, it may have been ingested by another wish
+func IngestTarball(ctx context.Context, CVMFSRepo, tarball, path string, overwrite bool) error {
+	publisher := GetPublisher(CVMFSRepo)
+	return InRepositoryQueue(CVMFSRepo, func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		llog := func(l *log.Entry) *log.Entry {
+			return l.WithFields(log.Fields{"action": "ingest tarball",
+				"repo": CVMFSRepo,
+				"path": path})
+		}
+		_, err := publisher.Lstat(path)
+		if err == nil && !overwrite {
+			llog(LogC(ctx)).Info("Path already in the repository, skipping the ingestion")
+			return nil
+		}
+		exists := err == nil
+		err = publisher.Ingest(ctx, tarball, path, overwrite && exists)
+		if err != nil {
+			llog(LogCE(ctx, err)).Error("Error in ingesting the tarball")
+		}
+		return err
+	})
+}
+
+// create a symbolic link called `newLinkName` pointing to `toLinkPath`, an
+// existing symlink is replaced, anything else is an error
+func (t *Transaction) Symlink(newLinkName, toLinkPath string) {
+	t.add("create symlink", newLinkName, func(p Publisher, newLinkName string) error {
+		// check if the file we want to link actually exists
+		if _, err := p.Lstat(toLinkPath); err != nil {
+			return err
+		}
+		if lstat, err := p.Lstat(newLinkName); err == nil {
+			if lstat.Mode()&os.ModeSymlink == 0 {
+				return fmt.Errorf(
+					"Error, trying to overwrite with a symlink something that is not a symlink")
+			}
+			err = p.Remove(newLinkName)
+			if err != nil {
+				return fmt.Errorf("Error in removing existsing symlink: %s", err)
+			}
+		}
+		return p.Symlink(newLinkName, ClientPath(t.CVMFSRepo, toLinkPath))
+	})
+}
+
+// make sure that the directory exists and hosts a nested catalog
+func (t *Transaction) CreateCatalog(dir string) {
+	t.add("create catalog", dir, func(p Publisher, dir string) error {
+		err := p.MakeDirectory(dir)
+		if err != nil {
+			return err
+		}
+		return createCatalog(p, dir)
+	})
+}
+
+// remove the symbolic link, anything else in path is left untouched
+func (t *Transaction) RemoveSymlink(path string) {
+	t.add("remove symlink", path, func(p Publisher, path string) error {
+		lstat, err := p.Lstat(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if lstat.Mode()&os.ModeSymlink == 0 {
+			Log().WithFields(log.Fields{"path": path}).Warning("Not a symlink, not removing it")
+			return nil
+		}
+		return p.Remove(path)
+	})
+}
+
+// fail with missing if path is not in the repository, for what was found
+// before the transaction was opened and may be gone since then
+func (t *Transaction) CheckExists(path string, missing error) {
+	t.add("check exists", path, func(p Publisher, path string) error {
+		_, err := p.Lstat(path)
+		if os.IsNotExist(err) {
+			return missing
+		}
+		return err
+	})
+}
+
+func (t *Transaction) RemoveAll(path string) {
+	t.add("remove", path, func(p Publisher, path string) error {
+		return p.Remove(path)
+	})
+}
+
+// apply the operations with p, inside another transaction already open
+func (t *Transaction) applyTo(p Publisher) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, op := range t.operations {
+		if err := op.apply(p, op.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply all the operations in a single transaction, the transaction runs in
+// the publish queue of the repository. Once opened, the transaction is always
+// either published or aborted, also if an operation panics. Canceling ctx
+// stops waiting for a busy lease, lets the operation in progress finish and
+// aborts the transaction, a publish already started is never interrupted.
+func (t *Transaction) Commit(ctx context.Context) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.operations) == 0 {
+		return nil
+	}
+	llog := func(l *log.Entry) *log.Entry {
+		return l.WithFields(log.Fields{"action": "commit transaction",
+			"repo":       t.CVMFSRepo,
+			"operations": len(t.operations)})
+	}
+	publisher := GetPublisher(t.CVMFSRepo)
+	abort := func() {
+		err := publisher.Abort()
+		if err != nil {
+			llog(LogCE(ctx, err)).Warning("Error in aborting the transaction")
+		}
+	}
+
+	return InRepositoryQueue(t.CVMFSRepo, func() error {
+		if err := ctx.Err(); err != nil {
+			llog(LogC(ctx)).Info("Canceled, not opening the transaction")
+			return err
+		}
+		llog(LogC(ctx)).Info("Start transaction")
+		err := publisher.Transaction(ctx)
+		if err != nil && err == ctx.Err() {
+			// nothing was opened, there is nothing to abort
+			llog(LogC(ctx)).Info("Canceled while waiting for the transaction")
+			return err
+		}
+		if err != nil {
+			llog(LogCE(ctx, err)).Error("Error in opening the transaction")
+			abort()
+			return err
+		}
+
+		published := false
+		openTransactions.add(t, publisher)
+		defer func() {
+			openTransactions.remove(t)
+			if published {
+				return
+			}
+			if r := recover(); r != nil {
+				llog(LogC(ctx)).WithFields(log.Fields{"panic": r}).Error("Panic in the transaction, aborting")
+				abort()
+				panic(r)
+			}
+			abort()
+		}()
+
+		for _, op := range t.operations {
+			if err = ctx.Err(); err != nil {
+				llog(LogCE(ctx, err)).Warning("Canceled, aborting the transaction")
+				return err
+			}
+			err = op.apply(publisher, op.path)
+			if err != nil {
+				llog(LogCE(ctx, err)).WithFields(log.Fields{
+					"operation": op.description,
+					"path":      op.path}).Error("Error in the transaction, aborting")
+				return err
+			}
+		}
+
+		llog(LogC(ctx)).Info("Publishing")
+		err = publisher.Publish()
+		if err != nil {
+			llog(LogCE(ctx, err)).Error("Error in publishing the repository")
+			return err
+		}
+		published = true
+		return nil
+	})
+}
+
+// the transactions opened and not yet published or aborted, to abort them if
+// we need to exit without waiting for them
+type transactionsSet struct {
+	lock         sync.Mutex
+	transactions map[*Transaction]Publisher
+}
+
+var openTransactions transactionsSet
+
+func (s *transactionsSet) add(t *Transaction, p Publisher) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.transactions == nil {
+		s.transactions = make(map[*Transaction]Publisher)
+	}
+	s.transactions[t] = p
+}
+
+func (s *transactionsSet) remove(t *Transaction) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.transactions, t)
+}
+
+// AbortOpenTransactions aborts all the transactions that are still open, it
+// is meant to be called right before exiting the process.
+func AbortOpenTransactions() {
+	openTransactions.lock.Lock()
+	defer openTransactions.lock.Unlock()
+	for t, publisher := range openTransactions.transactions {
+		Log().WithFields(log.Fields{"action": "abort open transaction",
+			"repo": t.CVMFSRepo}).Warning("Aborting the transaction")
+		if err := publisher.Abort(); err != nil {
+			LogE(err).WithFields(log.Fields{"repo": t.CVMFSRepo}).Error("Error in aborting the transaction")
+		}
+		delete(openTransactions.transactions, t)
+	}
+}
+
+func createCatalog(p Publisher, dir string) error {
+	catalogPath := filepath.Join(dir, ".cvmfscatalog")
+	if _, err := p.Lstat(catalogPath); err == nil {
+		return nil
+	}
+	return p.WriteFile(catalogPath, bytes.NewReader([]byte{}))
+}
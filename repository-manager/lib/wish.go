@@ -21,6 +21,12 @@ type WishFriendly struct {
 	Converted  bool
 	UserInput  string
 	UserOutput string
+	Platform   string
+	// references to the passwords, see GetCredentials
+	InputCredentials  string
+	OutputCredentials string
+	// do not create the singularity (flat) image for this wish
+	SkipSingularity bool
 }
 
 func CreateWish(inputImage, outputImage, cvmfsRepo, userInput, userOutput string) (wish WishFriendly, err error) {